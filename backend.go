@@ -0,0 +1,113 @@
+//
+//  backend.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package gnotes
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// Backend is a storage backend that all the (already compressed and encrypted)
+// note objects are synced to. Keys are slash separated paths, like
+// "user-id/notes/index.json".
+type Backend interface {
+	// Put uploads all the data from r to key, replacing any existing object.
+	Put(key string, r io.Reader) error
+
+	// Get opens the object at key for reading. The caller must close it.
+	Get(key string) (io.ReadCloser, error)
+
+	// Delete removes the object at key.
+	Delete(key string) error
+
+	// List returns all the objects that start with prefix.
+	List(prefix string) ([]ObjectInfo, error)
+
+	// Stat returns the info for a single object.
+	Stat(key string) (*ObjectInfo, error)
+}
+
+// ObjectInfo is the info for a object stored on a backend.
+type ObjectInfo struct {
+	Key      string
+	Size     int64
+	Modified time.Time
+}
+
+// ErrObjectNotFound is returned by a Backend when the requested object does
+// not exist.
+var ErrObjectNotFound = errors.New("object not found")
+
+// ErrBackendInactive is returned when the selected backend is not enabled in
+// the config file.
+var ErrBackendInactive = errors.New("backend is not active")
+
+// Committer is implemented by backends that group changes together, like git.
+// Commit is called every time the index is saved.
+type Committer interface {
+	Commit(message string) error
+}
+
+// Puller is implemented by backends that need to fetch changes from somewhere
+// else before reading the index.
+type Puller interface {
+	Pull() error
+}
+
+// NewBackend returns the backend selected by the "backend" setting in the
+// config file. Defaults to s3, or the local backend if s3 is not active.
+func NewBackend(conf *Config) (Backend, error) {
+	switch conf.App.Backend {
+	case "":
+		if !conf.S3.Active {
+			log.Printf("S3 is not active, using local backend")
+			return newLocalBackendFromConfig(conf)
+		}
+		return NewS3Backend(conf.S3)
+	case "s3":
+		if !conf.S3.Active {
+			return nil, fmt.Errorf("s3: %w (set active = true in the [s3] section)", ErrBackendInactive)
+		}
+		return NewS3Backend(conf.S3)
+	case "local":
+		return newLocalBackendFromConfig(conf)
+	case "webdav":
+		c := conf.WebDAV
+		c.Timeout = conf.S3.Timeout
+		c.TmpDir = filepath.Join(conf.App.NoteDir, "tmp")
+		return NewWebDAVBackend(c)
+	case "git":
+		c := conf.Git
+		if c.Path == "" {
+			c.Path = filepath.Join(conf.App.NoteDir, "git")
+		}
+		if c.Bare && c.WorkTree == "" {
+			c.WorkTree = filepath.Join(conf.App.NoteDir, "git-worktree")
+		}
+		return NewGitBackend(c)
+	}
+
+	return nil, fmt.Errorf("unknown backend: %q", conf.App.Backend)
+}
+
+func newLocalBackendFromConfig(conf *Config) (Backend, error) {
+	c := conf.Local
+	if c.Path == "" {
+		c.Path = filepath.Join(conf.App.NoteDir, "store")
+	}
+
+	return NewLocalBackend(c)
+}
@@ -0,0 +1,78 @@
+package gnotes
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendSync(t *testing.T) {
+	backend := newMemBackend()
+
+	app, other := testSync(t, backend, "hello world\n")
+	n := app.Notes.Books[0].Notes[0]
+
+	// Objects should never be stored in plain text
+	r, err := backend.Get(app.remotePath(n.S3Path))
+	require.NoError(t, err)
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "hello world")
+
+	// And delete it, its only moved to the trash first
+	require.NoError(t, other.Notes.Books[0].DeleteNote(0))
+	_, err = backend.Stat(other.remotePath(n.S3Path))
+	require.NoError(t, err)
+
+	require.NoError(t, other.Notes.EmptyTrash())
+	_, err = backend.Stat(other.remotePath(n.S3Path))
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+}
+
+func TestNewBackend(t *testing.T) {
+	_, err := NewBackend(&Config{App: appSettings{Backend: "s3"}})
+	assert.ErrorIs(t, err, ErrBackendInactive)
+
+	// Not active, and no backend set should fallback to local
+	dir := t.TempDir()
+	b, err := NewBackend(&Config{App: appSettings{NoteDir: dir}})
+	require.NoError(t, err)
+	assert.IsType(t, &LocalBackend{}, b)
+	assert.DirExists(t, filepath.Join(dir, "store"))
+
+	_, err = NewBackend(&Config{App: appSettings{Backend: "foo"}})
+	assert.Error(t, err)
+
+	b, err = NewBackend(&Config{S3: S3Config{Active: true}})
+	require.NoError(t, err)
+	assert.IsType(t, &S3Backend{}, b)
+}
+
+func TestPrefetchNotes(t *testing.T) {
+	backend := newMemBackend()
+
+	app := newTestApp(t, backend)
+	for i := 0; i < 20; i++ {
+		addNote(t, app, fmt.Sprintf("note %d\n", i))
+	}
+
+	other := openTestApp(t, backend)
+	require.NoError(t, other.PrefetchNotes(4))
+
+	for _, n := range other.Notes.Books[0].Notes {
+		sum, err := SumFile(notePath(other, n))
+		require.NoError(t, err)
+		assert.Equal(t, n.Hash, sum.String())
+	}
+
+	// Missing objects should be reported
+	n := other.Notes.Books[0].Notes[0]
+	backend.Delete(other.remotePath(n.S3Path))
+	os.Remove(notePath(other, n))
+	assert.ErrorIs(t, other.PrefetchNotes(4), ErrObjectNotFound)
+}
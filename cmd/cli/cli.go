@@ -15,11 +15,13 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sync"
 	"time"
 
 	_ "embed"
@@ -52,6 +54,31 @@ type gui struct {
 
 	// app is the internal gnotes app
 	app *gnotes.SelfApp
+
+	// autoSync is true if the notes are synced every sync_interval, stopSync
+	// stops it.
+	autoSync bool
+	stopSync chan struct{}
+
+	// syncing is set while a sync is running in the background, the notes
+	// are not changed by the ui until its done. syncWG waits for it.
+	syncing bool
+	syncWG  sync.WaitGroup
+
+	// syncResult and syncErr are set by the background sync, and applied on
+	// the ui goroutine. syncMu guards them.
+	syncMu     sync.Mutex
+	syncResult *gnotes.SyncResult
+	syncErr    error
+
+	// quitAfterSync is set if ctrl-c was pressed while syncing.
+	quitAfterSync bool
+
+	// readOnlyWarned is set once the read-only warning was shown.
+	readOnlyWarned bool
+
+	// quarantineWarned is set once the quarantined downloads were shown.
+	quarantineWarned bool
 }
 
 func newGUI() *gui {
@@ -61,7 +88,7 @@ func newGUI() *gui {
 	}
 }
 
-const helpKeyBindings = `EXPIRIMENTAL KEYS (some do not work): F1 = Open help with less(1) command    Ctrl+F = Find/Search all notes    F2 = Back to note folder (TODO)    F3 = Search attachment names    Ctrl+D = delete note folder if empty`
+const helpKeyBindings = `EXPIRIMENTAL KEYS (some do not work): F1 = Open help with less(1) command    Ctrl+F = Find/Search all notes    F2 = Back to note folder (TODO)    F3 = Search attachment names    F4 = Note revisions    F5 = Restore note from trash    F6 = Empty trash    F7 = Toggle auto sync    Ctrl+D = delete note folder (notes are moved to the trash)`
 
 func newPrimitive(text string) tview.Primitive {
 	return tview.NewTextView().
@@ -159,6 +186,63 @@ func (self *gui) loadUI() {
 			uilog.Log("Found first attachment list index at: %v", attachmentIndex)
 			self.noteList.SetCurrentItem(attachmentIndex)
 		},
+		tcell.KeyF4: func() {
+			selectedIndex := self.noteList.GetCurrentItem()
+
+			if self.currentPage != pageNotes {
+				self.showWarning("Not in note view, select a note first.")
+				return
+			}
+
+			// Check to make sure its a note (ie. not a menu item)
+			if selectedIndex < 1 || selectedIndex >= self.noteList.GetItemCount()-1 {
+				uilog.Log("Invalid index for revisions: %d", selectedIndex)
+				return
+			}
+
+			self.showRevisions(selectedIndex - 1)
+		},
+		tcell.KeyF5: func() {
+			selectedIndex := self.noteList.GetCurrentItem()
+
+			if self.currentPage != pageNotes || !self.app.Notes.GetSelected().IsTrash() {
+				self.showWarning("Not in the trash, select a note in the Trash folder to restore it.")
+				return
+			}
+
+			// Check to make sure its a note (ie. not a menu item)
+			if selectedIndex < 1 || selectedIndex >= self.noteList.GetItemCount()-1 {
+				uilog.Log("Invalid index to restore: %d", selectedIndex)
+				return
+			}
+
+			err := self.app.Notes.RestoreNote(selectedIndex - 1)
+			if err != nil {
+				self.showWarning(fmt.Sprintf("Failed to restore note: %s", err))
+				return
+			}
+
+			self.reloadNoteList()
+			self.noteList.SetCurrentItem(selectedIndex)
+		},
+		tcell.KeyF6: func() {
+			self.confirm("Delete all notes in the trash forever?", func() {
+				err := self.app.Notes.EmptyTrash()
+				if err != nil {
+					self.showWarning(fmt.Sprintf("Failed to empty trash: %s", err))
+					return
+				}
+
+				if self.currentPage == pageNotes {
+					self.reloadNoteList()
+				} else {
+					self.reloadNoteFolders()
+				}
+			})
+		},
+		tcell.KeyF7: func() {
+			self.toggleAutoSync()
+		},
 		tcell.KeyCtrlD: func() {
 			selectedIndex := self.noteList.GetCurrentItem()
 
@@ -184,6 +268,18 @@ func (self *gui) loadUI() {
 	}
 
 	keyCapture := func(event *tcell.EventKey) *tcell.EventKey {
+		if self.syncing {
+			if event.Key() == tcell.KeyCtrlC {
+				// Dont save the notes while the sync is changing them
+				uilog.Log("Syncing, will exit when its done")
+				self.quitAfterSync = true
+				return nil
+			}
+
+			uilog.Log("Syncing, try again in a moment")
+			return nil
+		}
+
 		for k, v := range keyMapping {
 			if event.Key() == k {
 				v()
@@ -199,9 +295,30 @@ func (self *gui) loadUI() {
 	self.ui.SetInputCapture(keyCapture)
 	self.ui.SetRoot(self.pages, true)
 	self.ui.EnableMouse(false)
+
+	self.startAutoSync()
+
+	if self.app.ReadOnly && !self.readOnlyWarned {
+		self.readOnlyWarned = true
+		if self.app.IndexTooNew {
+			self.showWarning("The notes were saved by a newer version of gnotes, opening read-only. Update gnotes to change them.")
+		} else {
+			self.showWarning("The notes are open in another gnotes, opening read-only.")
+		}
+	} else if !self.quarantineWarned {
+		self.quarantineWarned = true
+
+		paths, err := self.app.Quarantined()
+		if err == nil && len(paths) > 0 {
+			self.showWarning(fmt.Sprintf("%d downloads did not match their checksum, the cached copies were kept. Run \"gnotes quarantine\" to retry, or accept them.", len(paths)))
+		}
+	}
+
 	if err := self.ui.Run(); err != nil {
 		panic(err)
 	}
+
+	self.stopAutoSync()
 }
 
 func (self *gui) showWarning(text string) {
@@ -214,6 +331,21 @@ func (self *gui) showWarning(text string) {
 	self.pages.AddAndSwitchToPage("warning_view", view, true)
 }
 
+// confirm shows a yes/no prompt, and calls fn if yes was selected.
+func (self *gui) confirm(text string, fn func()) {
+	view := tview.NewModal().
+		SetText(text).
+		AddButtons([]string{"Yes", "No"}).
+		SetDoneFunc(func(_ int, label string) {
+			self.pages.RemovePage("confirm_view")
+			if label == "Yes" {
+				fn()
+			}
+		})
+
+	self.pages.AddAndSwitchToPage("confirm_view", view, true)
+}
+
 func (self *gui) reloadNoteFolders() {
 	self.currentPage = pageFolders
 	self.noteList.Clear()
@@ -296,6 +428,7 @@ func (self *gui) reloadNoteList() {
 
 func (self *gui) openNote(index int) error {
 	// Quit the app before opening the text editor
+	self.stopAutoSync()
 	self.ui.Stop()
 
 	//if self.app.Notes.Books[self.app.Notes.LastSelected].Notes[index].IsAttachment {
@@ -317,7 +450,7 @@ func (self *gui) openNote(index int) error {
 				downloadTo := self.app.Notes.GetSelected().Notes[index].AttachmentTitle
 				fmt.Printf("Downloading %s to %s...\n", downloadTo, downloadTo)
 
-				err := self.app.Config.S3.DownloadFileFrom(
+				err := self.app.DownloadFileFrom(
 					filepath.Join(self.app.Config.S3.UserID, "notes", self.app.Notes.GetSelected().Notes[index].S3Path),
 					downloadTo,
 				)
@@ -362,13 +495,40 @@ func (self *gui) openNote(index int) error {
 	}
 
 	// Make sure the note is up-to-date
-	err := self.app.Notes.GetSelected().Notes[index].Download(self.app.Config.App.NoteDir, self.app.Config.S3)
-	if err != nil {
+	err := self.app.Notes.GetSelected().Notes[index].Download(self.app.Config.App.NoteDir)
+	var checksumErr *gnotes.ChecksumError
+	if errors.As(err, &checksumErr) {
+		open, err := self.checksumPrompt(checksumErr)
+		if err != nil {
+			return err
+		}
+		if !open {
+			self.loadUI()
+			return nil
+		}
+	} else if err != nil {
 		return err
 	}
 
 	// Run the command to open the text file with the specified editor
 	editFile := filepath.Join(self.app.Config.App.NoteDir, "notes", self.app.Notes.GetSelected().Notes[index].S3Path)
+
+	if self.app.ReadOnly {
+		// Only view it, the changes could not be saved
+		b, err := os.ReadFile(editFile)
+		if err != nil {
+			return fmt.Errorf("failed to read file: %s", err)
+		}
+
+		err = openWithLess(b)
+		if err != nil {
+			return err
+		}
+
+		self.loadUI()
+
+		return nil
+	}
 	cmd := exec.Command(self.app.Config.App.Editor, editFile)
 	cmd.Stdout = os.Stdout
 	cmd.Stdin = os.Stdin
@@ -418,6 +578,40 @@ func (self *gui) openNote(index int) error {
 	return nil
 }
 
+// checksumPrompt asks what to do with a note download that did not match its
+// checksum. Returns true if the note can be opened.
+func (self *gui) checksumPrompt(checksumErr *gnotes.ChecksumError) (bool, error) {
+	for attempts := 0; attempts < 10; attempts++ {
+		action := ""
+
+		fmt.Printf(`%s
+The cached note was kept, the download was moved to: %s
+	  r - Retry the download
+	  a - Accept the download anyway
+	  b - Back
+	: `, checksumErr, checksumErr.Quarantined)
+		fmt.Scanln(&action)
+
+		switch action {
+		case "r":
+			err := self.app.RetryQuarantined(checksumErr.S3Path)
+			if errors.As(err, &checksumErr) {
+				// Still does not match
+				continue
+			}
+			return err == nil, err
+		case "a":
+			return true, self.app.AcceptQuarantined(checksumErr.S3Path)
+		case "b":
+			return false, nil
+		default:
+			log.Printf("Unknown input: %s", action)
+		}
+	}
+
+	return false, fmt.Errorf("too many attempts")
+}
+
 func getShortcutForIndex(index int) rune {
 	var s = []rune{'1', '2', '3', '4', '5', '6', '7', '8', '9'}
 
@@ -0,0 +1,475 @@
+//
+//  commands.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"github.com/WestleyR/gnotes"
+	"github.com/spf13/pflag"
+)
+
+// command is a subcommand, like "gnotes revisions NOTE".
+type command struct {
+	usage string
+	run   func(app *gnotes.SelfApp, args []string) error
+}
+
+var commands = map[string]command{
+	"revisions": {
+		usage: "revisions NOTE [diff|restore REVISION]",
+		run:   revisionsCommand,
+	},
+	"compact": {
+		usage: "compact",
+		run:   compactCommand,
+	},
+	"trash": {
+		usage: "trash [restore NOTE|empty]",
+		run:   trashCommand,
+	},
+	"fsck": {
+		usage: "fsck [--repair]",
+		run:   fsckCommand,
+	},
+	"gc": {
+		usage: "gc [--dry-run] [--yes]",
+		run:   gcCommand,
+	},
+	"sync": {
+		usage: "sync [--watch] [--interval SECONDS]",
+		run:   syncCommand,
+	},
+	"reencrypt": {
+		usage: "reencrypt",
+		run:   reencryptCommand,
+	},
+	"quarantine": {
+		usage: "quarantine [retry [PATH]|accept PATH]",
+		run:   quarantineCommand,
+	},
+	"rekey": {
+		usage: "rekey [--passphrase]",
+		run:   rekeyCommand,
+	},
+}
+
+// runCommand loads the notes, runs a subcommand, then uploads any changes.
+func runCommand(app *gnotes.SelfApp, args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+
+	err := app.LoadNotes()
+	if err != nil {
+		return fmt.Errorf("failed to load notes: %w", err)
+	}
+
+	err = cmd.run(app, args[1:])
+	if errors.Is(err, errUsage) {
+		return fmt.Errorf("usage: gnotes %s", cmd.usage)
+	}
+	if err != nil {
+		return err
+	}
+
+	return app.SaveIndexFile()
+}
+
+// errUsage is returned by a command if the args are wrong.
+var errUsage = errors.New("invalid args")
+
+// findNote finds a note by its id, or title.
+func findNote(app *gnotes.SelfApp, query string) (*gnotes.Book, int, error) {
+	// Make sure the titles are up-to-date
+	for _, b := range app.Notes.Books {
+		for _, n := range b.Notes {
+			n.GetTitle(app.Config.App.NoteDir + "/notes")
+		}
+	}
+
+	return app.Notes.FindNote(query)
+}
+
+func revisionsCommand(app *gnotes.SelfApp, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	book, index, err := findNote(app, args[0])
+	if err != nil {
+		return err
+	}
+	n := book.Notes[index]
+
+	if len(args) == 1 {
+		if len(n.Revisions) == 0 {
+			fmt.Printf("No revisions for: %s\n", n.Title)
+			return nil
+		}
+
+		for i := len(n.Revisions) - 1; i >= 0; i-- {
+			r := n.Revisions[i]
+			fmt.Printf("%s  %s\n", r.ID, time.Unix(r.Modified, 0).Format("2006-01-02 15:04:05"))
+		}
+		return nil
+	}
+
+	if len(args) != 3 {
+		return errUsage
+	}
+
+	// Needed for the diff, and to keep the current version as a revision
+	err = n.Download(app.Config.App.NoteDir)
+	if err != nil {
+		return err
+	}
+
+	switch args[1] {
+	case "diff":
+		diff, err := app.DiffRevision(n, args[2])
+		if err != nil {
+			return err
+		}
+		fmt.Print(diff)
+	case "restore":
+		err := book.RestoreRevision(index, args[2])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Restored revision %s of: %s\n", args[2], n.Title)
+	default:
+		return errUsage
+	}
+
+	return nil
+}
+
+func trashCommand(app *gnotes.SelfApp, args []string) error {
+	trash := app.Notes.TrashBook()
+
+	if len(args) == 0 {
+		if trash == nil || len(trash.Notes) == 0 {
+			fmt.Printf("Trash is empty\n")
+			return nil
+		}
+
+		for _, n := range trash.Notes {
+			fmt.Printf("%s  deleted %s from %s: %s\n", filepath.Base(filepath.Dir(n.S3Path)),
+				time.Unix(n.DeletedAt, 0).Format("2006-01-02 15:04:05"), n.OriginalBook, n.GetTitle(app.Config.App.NoteDir+"/notes"))
+		}
+		return nil
+	}
+
+	switch {
+	case args[0] == "empty" && len(args) == 1:
+		return app.Notes.EmptyTrash()
+	case args[0] == "restore" && len(args) == 2:
+		book, index, err := findNote(app, args[1])
+		if err != nil {
+			return err
+		}
+		if !book.IsTrash() {
+			return fmt.Errorf("%w: %s", gnotes.ErrNotInTrash, args[1])
+		}
+
+		fmt.Printf("Restoring to %s: %s\n", book.Notes[index].OriginalBook, book.Notes[index].Title)
+
+		return app.Notes.RestoreNote(index)
+	}
+
+	return errUsage
+}
+
+func compactCommand(app *gnotes.SelfApp, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	compacted, err := app.CompactNotes()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Compacted %d notes\n", compacted)
+
+	return nil
+}
+
+func reencryptCommand(app *gnotes.SelfApp, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	done, err := app.ReencryptObjects()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Re-encrypted %d objects\n", done)
+
+	return nil
+}
+
+func rekeyCommand(app *gnotes.SelfApp, args []string) error {
+	flags := pflag.NewFlagSet("rekey", pflag.ContinueOnError)
+	usePassphrase := flags.BoolP("passphrase", "p", false, "change to a passphrase, instead of a crypt_key.")
+
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+
+	if app.RekeyPending() {
+		fmt.Printf("Resuming a interrupted rekey, use the same key as before\n")
+	}
+
+	cryptKey := ""
+	passphrase := ""
+
+	if *usePassphrase {
+		passphrase, err = readSecret("New passphrase: ")
+		if err != nil {
+			return err
+		}
+
+		again, err := readSecret("New passphrase again: ")
+		if err != nil {
+			return err
+		}
+		if passphrase != again {
+			return errors.New("the passphrases do not match")
+		}
+	} else {
+		cryptKey, err = readSecret("New crypt_key (empty to generate one): ")
+		if err != nil {
+			return err
+		}
+
+		if cryptKey == "" && !app.RekeyPending() {
+			cryptKey, err = ranStr(32)
+			if err != nil {
+				return fmt.Errorf("failed to generate key: %w", err)
+			}
+
+			// Needed to resume, if interrupted
+			fmt.Printf("New crypt_key: %s\n", cryptKey)
+		}
+	}
+
+	report, err := app.Rekey(cryptKey, passphrase)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Re-encrypted %d objects with the new key\n", report.Reencrypted)
+	if !report.ConfigUpdated {
+		fmt.Printf("The key is not in the config file, change it in your credential_cmd, or env\n")
+	}
+	fmt.Printf("Update the key on your other devices before using them\n")
+
+	return nil
+}
+
+func syncCommand(app *gnotes.SelfApp, args []string) error {
+	flags := pflag.NewFlagSet("sync", pflag.ContinueOnError)
+	watch := flags.BoolP("watch", "w", false, "keep syncing until interrupted.")
+	interval := flags.Int("interval", app.Config.App.SyncInterval, "seconds between syncs with --watch.")
+
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() != 0 || *interval <= 0 {
+		return errUsage
+	}
+
+	changed, err := app.Sync()
+	if err != nil {
+		return err
+	}
+	if changed {
+		fmt.Printf("Synced notes\n")
+	}
+
+	if !*watch {
+		return nil
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Printf("Syncing every %ds, press Ctrl+C to stop\n", *interval)
+
+	ticker := time.NewTicker(time.Duration(*interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		changed, err := app.Sync()
+		if err != nil {
+			// Probably offline, try again next time
+			log.Printf("Failed to sync: %s", err)
+			continue
+		}
+		if changed {
+			fmt.Printf("%s: synced notes\n", time.Now().Format("15:04:05"))
+		}
+	}
+}
+
+func fsckCommand(app *gnotes.SelfApp, args []string) error {
+	flags := pflag.NewFlagSet("fsck", pflag.ContinueOnError)
+	repair := flags.Bool("repair", false, "upload broken notes again from a good local copy.")
+
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+
+	report, err := app.Fsck(*repair)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range report.Problems {
+		fmt.Println(p)
+	}
+
+	fmt.Printf("Checked %d notes, and %d objects: %d problems", report.Notes, report.Objects, len(report.Problems))
+	if *repair {
+		fmt.Printf(", %d repaired", len(report.Problems)-report.Unrepaired())
+	}
+	fmt.Printf("\n")
+
+	if report.Unrepaired() == 0 {
+		return nil
+	}
+
+	// Save anything that was repaired, before failing
+	err = app.SaveIndexFile()
+	if err != nil {
+		return err
+	}
+
+	return fmt.Errorf("found %d problems", report.Unrepaired())
+}
+
+func gcCommand(app *gnotes.SelfApp, args []string) error {
+	flags := pflag.NewFlagSet("gc", pflag.ContinueOnError)
+	dryRun := flags.BoolP("dry-run", "n", false, "only list the objects that would be deleted.")
+	yes := flags.BoolP("yes", "y", false, "do not ask before deleting.")
+
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+
+	report, err := app.FindOrphans()
+	if err != nil {
+		return err
+	}
+
+	for _, o := range report.Orphans {
+		fmt.Printf("%s  %s  %d bytes\n", o.Modified.Format("2006-01-02 15:04:05"), o.Key, o.Size)
+	}
+	if report.Skipped > 0 {
+		fmt.Printf("Skipping %d new objects, they may not be in the index yet\n", report.Skipped)
+	}
+
+	if len(report.Orphans) == 0 {
+		fmt.Printf("No orphaned objects\n")
+		return nil
+	}
+
+	fmt.Printf("%d orphaned objects, %s can be reclaimed\n", len(report.Orphans), report.Reclaimable())
+
+	if *dryRun {
+		return nil
+	}
+
+	if !*yes {
+		answer := ""
+		fmt.Printf("Delete them forever? [y/N] ")
+		fmt.Scanln(&answer)
+
+		if answer != "y" && answer != "yes" {
+			fmt.Printf("Not deleting anything\n")
+			return nil
+		}
+	}
+
+	deleted, err := app.GC(report)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Deleted %d objects\n", deleted)
+
+	return nil
+}
+
+func quarantineCommand(app *gnotes.SelfApp, args []string) error {
+	paths, err := app.Quarantined()
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		if len(paths) == 0 {
+			fmt.Printf("Nothing is quarantined\n")
+			return nil
+		}
+
+		for _, p := range paths {
+			fmt.Printf("%s\n", p)
+		}
+		return nil
+	}
+
+	switch {
+	case args[0] == "retry" && len(args) <= 2:
+		if len(args) == 2 {
+			paths = args[1:]
+		}
+
+		failed := 0
+		for _, p := range paths {
+			err := app.RetryQuarantined(p)
+			if err != nil {
+				fmt.Printf("%s: %s\n", p, err)
+				failed++
+				continue
+			}
+			fmt.Printf("%s: ok\n", p)
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("%d downloads still failed", failed)
+		}
+		return nil
+	case args[0] == "accept" && len(args) == 2:
+		return app.AcceptQuarantined(args[1])
+	}
+
+	return errUsage
+}
@@ -14,15 +14,19 @@
 package main
 
 import (
+	"bufio"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"log"
-	"math/rand"
+	"math/big"
 	"os"
-	"time"
+	"strings"
 
 	"github.com/WestleyR/gnotes"
 	"github.com/google/uuid"
 	"github.com/spf13/pflag"
+	"golang.org/x/term"
 )
 
 var Version string = "v0.2.0"
@@ -34,9 +38,12 @@ func main() {
 	skipDownloadFlag := pflag.BoolP("skip-download", "s", false, "skips downloading the note file, used for devs, or if starting notes from scratch.")
 	newNoteFlag := pflag.BoolP("reset", "R", false, "dont fail if local notes dont exist, DANGER: could delete all existing notes!")
 	decryptFlag := pflag.StringP("decrypt", "d", "", "decrypt for devs")
-	genCryptKeyFlag := pflag.BoolP("gen-crypt-key", "", false, "generate an 16 bit encryption key (for first initalization)")
+	genCryptKeyFlag := pflag.BoolP("gen-crypt-key", "", false, "generate a random 32 character encryption key (for first initalization)")
 	genUUIDFlag := pflag.BoolP("gen-uuid", "", false, "generate a uuid for user id (for first initalization)")
+	prefetchFlag := pflag.BoolP("prefetch", "p", false, "download all changed notes before starting, useful after a fresh install.")
 
+	// Flags after a command are for the command
+	pflag.CommandLine.SetInterspersed(false)
 	pflag.Parse()
 
 	switch {
@@ -46,6 +53,10 @@ func main() {
 		fmt.Printf("Source code: https://github.com/WestleyR/gnotes\n")
 		fmt.Printf("\n")
 		pflag.Usage()
+		fmt.Printf("\nCommands:\n")
+		for _, c := range commands {
+			fmt.Printf("  gnotes %s\n", c.usage)
+		}
 		return
 
 	case *versionFlag:
@@ -55,7 +66,11 @@ func main() {
 		}
 
 	case *genCryptKeyFlag:
-		fmt.Println(ranStr(16))
+		key, err := ranStr(32)
+		if err != nil {
+			log.Fatalf("Failed to generate key: %s\n", err)
+		}
+		fmt.Println(key)
 		return
 
 	case *genUUIDFlag:
@@ -69,11 +84,21 @@ func main() {
 
 	{
 		// Init the self app
-		app, err := gnotes.InitApp(gnotes.GetFileFromConfig("config.ini"))
+		configFile := gnotes.GetFileFromConfig("config.ini")
+
+		app, err := gnotes.InitApp(configFile)
+		if errors.Is(err, gnotes.ErrNoCryptKey) && term.IsTerminal(int(os.Stdin.Fd())) {
+			// Ask for the passphrase instead
+			err = askPassphrase()
+			if err == nil {
+				app, err = gnotes.InitApp(configFile)
+			}
+		}
 		if err != nil {
 			log.Fatalf("Failed to init app: %s\n", err)
 		}
 		gui.app = app
+		gui.autoSync = app.Config.App.AutoSync
 	}
 
 	if *decryptFlag != "" {
@@ -94,12 +119,39 @@ func main() {
 	gui.app.CliOpts.SkipDownload = *skipDownloadFlag
 	gui.app.CliOpts.NewNote = *newNoteFlag
 
+	// Only one gnotes can change the notes at a time
+	err := gui.app.AcquireLock()
+	if errors.Is(err, gnotes.ErrLocked) {
+		fmt.Fprintf(os.Stderr, "%s, opening read-only\n", err)
+		gui.app.ReadOnly = true
+	} else if err != nil {
+		log.Fatalf("Failed to lock notes: %s\n", err)
+	}
+	defer gui.app.ReleaseLock()
+
+	if pflag.NArg() > 0 {
+		err := runCommand(gui.app, pflag.Args())
+		if err != nil {
+			gui.app.ReleaseLock()
+			log.Fatalf("%s\n", err)
+		}
+		return
+	}
+
 	// Load the notes either from s3, or local stash
-	err := gui.app.LoadNotes()
+	err = gui.app.LoadNotes()
 	if err != nil {
 		log.Fatalf("Failed to load notes: %s\n", err)
 	}
 
+	if *prefetchFlag || gui.app.Config.App.Prefetch {
+		err := gui.app.PrefetchNotes(gui.app.Config.App.PrefetchWorkers)
+		if err != nil {
+			// Not fatal, the notes will be downloaded when opened
+			log.Printf("Failed to prefetch notes: %s\n", err)
+		}
+	}
+
 	// Before starting the ui, see if theres anything to be done first
 	if *uploadFileFlag != "" {
 		err := gui.app.Notes.Books[0].NewAttachment(gui.app.Config.App.NoteDir, *uploadFileFlag)
@@ -121,7 +173,10 @@ func main() {
 
 	// Always save the notes if needed
 	err = gui.app.SaveIndexFile()
-	if err != nil {
+	if errors.Is(err, gnotes.ErrReadOnly) {
+		fmt.Printf("The notes were open read-only, changes were not saved\n")
+	} else if err != nil {
+		gui.app.ReleaseLock()
 		log.Fatalf("Failed to upload notes: %s", err)
 	}
 
@@ -132,13 +187,50 @@ func main() {
 
 const validKeyChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890"
 
-func ranStr(n int) string {
-	rand.Seed(time.Now().UnixNano())
-
+func ranStr(n int) (string, error) {
 	b := make([]byte, n)
 	for i := range b {
-		b[i] = validKeyChars[rand.Intn(len(validKeyChars))]
+		c, err := rand.Int(rand.Reader, big.NewInt(int64(len(validKeyChars))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = validKeyChars[c.Int64()]
+	}
+
+	return string(b), nil
+}
+
+// askPassphrase reads the passphrase from the terminal, for when theres no
+// crypt_key, or passphrase in the config.
+func askPassphrase() error {
+	passphrase, err := readSecret("Passphrase: ")
+	if err != nil {
+		return err
+	}
+	if passphrase == "" {
+		return gnotes.ErrNoCryptKey
+	}
+
+	return os.Setenv("GNOTES_PASSPHRASE", passphrase)
+}
+
+// readSecret reads a line from stdin, without echoing it if its a terminal.
+func readSecret(prompt string) (string, error) {
+	fmt.Fprintf(os.Stderr, "%s", prompt)
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("failed to read input: %w", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	b, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintf(os.Stderr, "\n")
+	if err != nil {
+		return "", fmt.Errorf("failed to read input: %w", err)
 	}
 
-	return string(b)
+	return string(b), nil
 }
@@ -0,0 +1,95 @@
+//
+//  revisions.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rivo/tview"
+)
+
+// showRevisions shows the list of revisions for a note, selecting one will
+// show the diff, and allow restoring it.
+func (self *gui) showRevisions(noteIndex int) {
+	book := self.app.Notes.GetSelected()
+	n := book.Notes[noteIndex]
+
+	if n.IsAttachment {
+		self.showWarning("Attachments do not have revisions.")
+		return
+	}
+
+	if len(n.Revisions) == 0 {
+		self.showWarning("No revisions for this note.")
+		return
+	}
+
+	err := n.Download(self.app.Config.App.NoteDir)
+	if err != nil {
+		self.showWarning(fmt.Sprintf("Failed to download note: %s", err))
+		return
+	}
+
+	list := tview.NewList()
+	list.SetBorder(true).SetTitle(" Revisions ")
+
+	for i := len(n.Revisions) - 1; i >= 0; i-- {
+		r := n.Revisions[i]
+		list.AddItem(time.Unix(r.Modified, 0).Format("2006-01-02 15:04:05"), r.ID, 0, func() {
+			self.showRevisionDiff(noteIndex, r.ID)
+		})
+	}
+
+	list.AddItem("Back", "", 'q', func() {
+		self.pages.RemovePage("revisions_view")
+	})
+
+	self.pages.AddAndSwitchToPage("revisions_view", list, true)
+}
+
+func (self *gui) showRevisionDiff(noteIndex int, id string) {
+	book := self.app.Notes.GetSelected()
+	n := book.Notes[noteIndex]
+
+	diff, err := self.app.DiffRevision(n, id)
+	if err != nil {
+		self.showWarning(fmt.Sprintf("Failed to load revision: %s", err))
+		return
+	}
+
+	text := tview.NewTextView().SetText(diff)
+	text.SetBorder(true).SetTitle(" Changes since revision (- removed, + added) ")
+
+	buttons := tview.NewForm().
+		AddButton("Restore", func() {
+			err := book.RestoreRevision(noteIndex, id)
+			if err != nil {
+				self.showWarning(fmt.Sprintf("Failed to restore revision: %s", err))
+				return
+			}
+
+			self.pages.RemovePage("revision_diff_view")
+			self.pages.RemovePage("revisions_view")
+			self.app.Notes.Sort()
+			self.reloadNoteList()
+		}).
+		AddButton("Back", func() {
+			self.pages.RemovePage("revision_diff_view")
+		})
+
+	view := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(text, 0, 1, false).
+		AddItem(buttons, 3, 0, true)
+
+	self.pages.AddAndSwitchToPage("revision_diff_view", view, true)
+}
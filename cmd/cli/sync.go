@@ -0,0 +1,182 @@
+//
+//  sync.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package main
+
+import (
+	"time"
+)
+
+// startAutoSync starts a sync every sync_interval seconds, until stopAutoSync
+// is called. The timer only queues syncNow on the ui goroutine, which skips it
+// if a sync is still running, or a dialog is open.
+func (self *gui) startAutoSync() {
+	self.stopAutoSync()
+
+	if !self.autoSync {
+		return
+	}
+
+	interval := time.Duration(self.app.Config.App.SyncInterval) * time.Second
+	if interval <= 0 {
+		return
+	}
+
+	done := make(chan struct{})
+	self.stopSync = done
+
+	// The ui could be replaced when a note is opened
+	ui := self.ui
+
+	self.syncWG.Add(1)
+	go func() {
+		defer self.syncWG.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			// Only start it from the ui goroutine, so the notes are not
+			// being changed by the ui at the same time
+			go ui.QueueUpdate(func() {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				self.syncNow()
+			})
+		}
+	}()
+}
+
+// stopAutoSync stops the auto sync, if its running, and waits for a running
+// sync to finish.
+func (self *gui) stopAutoSync() {
+	if self.stopSync != nil {
+		close(self.stopSync)
+		self.stopSync = nil
+	}
+
+	self.syncWG.Wait()
+
+	// The queued update wont run if the ui was stopped
+	self.applySync()
+	self.syncing = false
+}
+
+// toggleAutoSync turns the auto sync on or off.
+func (self *gui) toggleAutoSync() {
+	self.autoSync = !self.autoSync
+
+	if self.autoSync {
+		uilog.Log("Auto sync on")
+		self.startAutoSync()
+		self.syncNow()
+	} else {
+		uilog.Log("Auto sync off")
+		self.stopAutoSync()
+	}
+}
+
+// syncNow starts a sync in the background, unless one is already running. Must
+// be called from the ui goroutine.
+func (self *gui) syncNow() {
+	if self.syncing {
+		return
+	}
+
+	// Dont change the notes under a open dialog, try again next time
+	if name, _ := self.pages.GetFrontPage(); name != "main_view" {
+		return
+	}
+
+	self.syncing = true
+	ui := self.ui
+
+	self.syncWG.Add(1)
+	go func() {
+		// Only the backend part, the notes are changed on the ui goroutine
+		r, err := self.app.SyncRemote()
+
+		self.syncMu.Lock()
+		self.syncResult = r
+		self.syncErr = err
+		self.syncMu.Unlock()
+
+		self.syncWG.Done()
+
+		// Wont run if the ui was stopped, see stopAutoSync
+		ui.QueueUpdateDraw(self.applySync)
+	}()
+}
+
+// applySync applies the result of the background sync to the notes, if its
+// done. Must be called from the ui goroutine, or after it was stopped.
+func (self *gui) applySync() {
+	self.syncMu.Lock()
+	r, err := self.syncResult, self.syncErr
+	self.syncResult, self.syncErr = nil, nil
+	self.syncMu.Unlock()
+
+	if r == nil {
+		return
+	}
+
+	self.syncing = false
+
+	applyErr := self.app.ApplySync(r)
+	if err == nil {
+		err = applyErr
+	}
+
+	self.syncDone(r.Changed, err)
+
+	if self.quitAfterSync {
+		// The notes are saved at main exit
+		self.quitAfterSync = false
+		self.ui.Stop()
+	}
+}
+
+// syncDone reloads the list if anything changed.
+func (self *gui) syncDone(changed bool, err error) {
+	if self.app.ReadOnly && !self.readOnlyWarned {
+		self.readOnlyWarned = true
+		self.showWarning("Another device took the lock, the notes are now read-only.")
+	}
+
+	if err != nil {
+		uilog.Log("Failed to sync: %s", err)
+		return
+	}
+	if !changed {
+		return
+	}
+
+	selectedIndex := self.noteList.GetCurrentItem()
+
+	if self.currentPage == pageNotes {
+		self.reloadNoteList()
+	} else {
+		self.reloadNoteFolders()
+	}
+
+	if selectedIndex < self.noteList.GetItemCount() {
+		self.noteList.SetCurrentItem(selectedIndex)
+	}
+}
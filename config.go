@@ -25,13 +25,50 @@ import (
 const appID = "gnotes"
 
 type Config struct {
-	App appSettings `ini:"settings"`
-	S3  S3Config    `ini:"s3"`
+	App    appSettings  `ini:"settings"`
+	S3     S3Config     `ini:"s3"`
+	Local  LocalConfig  `ini:"local"`
+	WebDAV WebDAVConfig `ini:"webdav"`
+	Git    GitConfig    `ini:"git"`
 }
 
 type appSettings struct {
 	Editor  string `ini:"editor"`
 	NoteDir string `ini:"notes_dir"`
+
+	// Backend is the storage backend to sync to, "s3", "local", "webdav" or
+	// "git". Defaults to s3, or local if s3 is not active.
+	Backend string `ini:"backend"`
+
+	// Prefetch will download all changed notes on startup, with
+	// PrefetchWorkers downloads at the same time.
+	Prefetch        bool `ini:"prefetch"`
+	PrefetchWorkers int  `ini:"prefetch_workers"`
+
+	// KeepRevisions keeps the older versions of notes, up to MaxRevisions
+	// per note, and no older then MaxRevisionAge days (0 for forever).
+	KeepRevisions  bool `ini:"keep_revisions"`
+	MaxRevisions   int  `ini:"max_revisions"`
+	MaxRevisionAge int  `ini:"max_revision_age"`
+
+	// DeltaUploads will only upload the changed lines of notes, instead of
+	// the whole note every time.
+	DeltaUploads bool `ini:"delta_uploads"`
+
+	// TrashRetention is how many days deleted notes are kept in the trash,
+	// 0 to keep them until the trash is emptied. Defaults to 30.
+	TrashRetention int `ini:"trash_retention"`
+
+	// AutoSync syncs the notes every SyncInterval seconds while the app is
+	// open. SyncInterval is also used by "gnotes sync --watch".
+	AutoSync     bool `ini:"auto_sync"`
+	SyncInterval int  `ini:"sync_interval"`
+
+	// RemoteLock also locks the notes on the backend, so only one device can
+	// change them at a time. The lock expires after LockLease seconds, if not
+	// renewed (like if gnotes crashed).
+	RemoteLock bool `ini:"remote_lock"`
+	LockLease  int  `ini:"lock_lease"`
 }
 
 type S3Config struct {
@@ -43,10 +80,103 @@ type S3Config struct {
 	SecretKey string `ini:"secretkey"`
 	UserID    string `ini:"user_id"`
 	CryptKey  string `ini:"crypt_key"`
+
+	// Passphrase is used to derive the crypt key, instead of setting
+	// crypt_key.
+	Passphrase string `ini:"passphrase"`
+
+	// Profile is a AWS shared credentials profile (~/.aws/credentials) to
+	// use if accesskey and secretkey are not set.
+	Profile string `ini:"profile"`
+
+	// CredentialCmd is a command that prints any secrets that are not set in
+	// the config file, like "pass show gnotes". The output should be in the
+	// form of "accesskey = KEY" lines (accesskey, secretkey, crypt_key and
+	// passphrase).
+	CredentialCmd string `ini:"credential_cmd"`
+
+	// TLS is used if the endpoint has no scheme, defaults to true. A
+	// "http://" or "https://" endpoint always uses that scheme.
+	TLS bool `ini:"tls"`
+
+	// CABundle is a optional PEM file with extra CA certificates to trust,
+	// like for a self-signed server.
+	CABundle string `ini:"ca_bundle"`
+
+	// InsecureSkipVerify disables all certificate checks. Only for lab
+	// setups.
+	InsecureSkipVerify bool `ini:"insecure_skip_verify"`
+
+	// PathStyle uses "endpoint/bucket/key" urls, instead of virtual host
+	// style "bucket.endpoint/key". Defaults to true.
+	PathStyle bool `ini:"path_style"`
+
+	// Timeout is the connect, and response header timeout in seconds. 0 for
+	// no timeout. Defaults to 30.
+	Timeout int `ini:"timeout"`
+}
+
+// LocalConfig is the config for the local filesystem backend.
+type LocalConfig struct {
+	// Path is the dir to store the objects in, defaults to
+	// ${notes_dir}/store.
+	Path string `ini:"path"`
+}
+
+// WebDAVConfig is the config for the WebDAV backend, like Nextcloud or
+// ownCloud.
+type WebDAVConfig struct {
+	// URL is the base url to store the objects under, eg.
+	// https://cloud.example.com/remote.php/dav/files/user/gnotes
+	URL      string `ini:"url"`
+	Username string `ini:"username"`
+	Password string `ini:"password"`
+
+	// Timeout is the same as the s3 timeout setting.
+	Timeout int `ini:"-"`
+
+	// TmpDir is where uploads are buffered before sending them, it should
+	// only be readable by the user.
+	TmpDir string `ini:"-"`
+}
+
+// GitConfig is the config for the git backend.
+type GitConfig struct {
+	// Path is the git repository, defaults to ${notes_dir}/git.
+	Path string `ini:"path"`
+
+	// Bare should be true if Path is a bare repository, the objects are then
+	// checked out to WorkTree (defaults to ${notes_dir}/git-worktree).
+	Bare     bool   `ini:"bare"`
+	WorkTree string `ini:"worktree"`
+
+	// Remote is a optional (bare) repository to push to, and pull from, like
+	// file:///mnt/nas/gnotes.git
+	Remote string `ini:"remote"`
+	Branch string `ini:"branch"`
+}
+
+// defaultConfig returns the config with all the defaults that are not the
+// zero value. Values in the config file will override them.
+func defaultConfig() *Config {
+	return &Config{
+		App: appSettings{
+			MaxRevisions:   defaultMaxRevisions,
+			MaxRevisionAge: defaultMaxRevisionAge,
+			TrashRetention: defaultTrashRetention,
+			SyncInterval:   defaultSyncInterval,
+			LockLease:      defaultLockLease,
+		},
+		S3: S3Config{
+			TLS:       true,
+			PathStyle: true,
+			Timeout:   30,
+		},
+	}
 }
 
 func LoadConfig(configFile string) (*Config, error) {
-	conf := &Config{}
+	conf := defaultConfig()
 
 	iniBytes, err := ioutil.ReadFile(configFile)
 	if err != nil {
@@ -59,6 +189,20 @@ func LoadConfig(configFile string) (*Config, error) {
 	}
 
 	conf.App.NoteDir = os.ExpandEnv(conf.App.NoteDir)
+	conf.Local.Path = os.ExpandEnv(conf.Local.Path)
+	conf.Git.Path = os.ExpandEnv(conf.Git.Path)
+	conf.Git.WorkTree = os.ExpandEnv(conf.Git.WorkTree)
+	conf.S3.CABundle = os.ExpandEnv(conf.S3.CABundle)
+
+	err = conf.S3.loadSecrets()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load secrets: %w", err)
+	}
+
+	err = conf.S3.checkCryptKey()
+	if err != nil {
+		return nil, err
+	}
 
 	return conf, nil
 }
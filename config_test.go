@@ -2,6 +2,7 @@ package gnotes
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -20,6 +21,12 @@ func TestLoadConfig(t *testing.T) {
 		App: appSettings{
 			Editor:  "vim",
 			NoteDir: os.Getenv("HOME") + "/my-dir/.config/gnotes",
+
+			MaxRevisions:   20,
+			MaxRevisionAge: 90,
+			TrashRetention: 30,
+			SyncInterval:   30,
+			LockLease:      300,
 		},
 		S3: S3Config{
 			Active:    true,
@@ -30,6 +37,10 @@ func TestLoadConfig(t *testing.T) {
 			SecretKey: "SECRET_KEY",
 			UserID:    "a8085892-7bf4-11ed-bbd6-a74217c9099d",
 			CryptKey:  "DpiJ1QaSh25O1Kt3",
+
+			TLS:       true,
+			PathStyle: true,
+			Timeout:   30,
 		},
 	}
 
@@ -40,3 +51,77 @@ func TestLoadConfig(t *testing.T) {
 	assert.Error(t, err)
 	assert.Nil(t, c)
 }
+
+func TestLoadConfigCredentials(t *testing.T) {
+	t.Setenv("GNOTES_CRYPT_KEY", "ENV_CRYPT_KEY_16")
+
+	c, err := LoadConfig("testdata/config_credentials.ini")
+	require.NoError(t, err)
+
+	// The config file takes priority
+	assert.Equal(t, "CMD_KEY", c.S3.AccessKey)
+	assert.Equal(t, "CONFIG_SECRET", c.S3.SecretKey)
+	assert.Equal(t, "ENV_CRYPT_KEY_16", c.S3.CryptKey)
+
+	// Fallback to the AWS_* env variables
+	t.Setenv("AWS_ACCESS_KEY_ID", "ENV_KEY")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "ENV_SECRET")
+
+	v, err := S3Config{}.credentials().Get()
+	require.NoError(t, err)
+	assert.Equal(t, "ENV_KEY", v.AccessKeyID)
+	assert.Equal(t, "ENV_SECRET", v.SecretAccessKey)
+
+	// Or a profile
+	credsFile := filepath.Join(t.TempDir(), "credentials")
+	require.NoError(t, os.WriteFile(credsFile, []byte("[gnotes]\naws_access_key_id = PROFILE_KEY\naws_secret_access_key = PROFILE_SECRET\n"), 0600))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credsFile)
+
+	v, err = S3Config{Profile: "gnotes"}.credentials().Get()
+	require.NoError(t, err)
+	assert.Equal(t, "PROFILE_KEY", v.AccessKeyID)
+
+	// A failing command is a error
+	require.NoError(t, os.WriteFile(credsFile, []byte("[s3]\ncredential_cmd = exit 1\n"), 0600))
+	_, err = LoadConfig(credsFile)
+	assert.Error(t, err)
+}
+
+func TestLoadConfigCryptKey(t *testing.T) {
+	t.Setenv("GNOTES_CRYPT_KEY", "")
+	t.Setenv("GNOTES_PASSPHRASE", "")
+
+	load := func(s3 string) (*Config, error) {
+		configFile := filepath.Join(t.TempDir(), "config.ini")
+		require.NoError(t, os.WriteFile(configFile, []byte("[s3]\n"+s3), 0600))
+		return LoadConfig(configFile)
+	}
+
+	// AES-128, 192, and 256
+	for _, key := range []string{"DpiJ1QaSh25O1Kt3", "DpiJ1QaSh25O1Kt3DpiJ1QaS", "DpiJ1QaSh25O1Kt3DpiJ1QaSh25O1Kt3"} {
+		c, err := load("crypt_key = " + key + "\n")
+		require.NoError(t, err)
+		assert.Equal(t, key, c.S3.CryptKey)
+	}
+
+	_, err := load("crypt_key = too-short\n")
+	assert.ErrorContains(t, err, "not 9")
+
+	_, err = load("")
+	assert.ErrorIs(t, err, ErrNoCryptKey)
+
+	_, err = load("crypt_key = DpiJ1QaSh25O1Kt3\npassphrase = hunter2\n")
+	assert.Error(t, err)
+
+	// A passphrase from the env is only used without a crypt_key
+	t.Setenv("GNOTES_PASSPHRASE", "hunter2")
+
+	c, err := load("")
+	require.NoError(t, err)
+	assert.Equal(t, "hunter2", c.S3.Passphrase)
+	assert.Empty(t, c.S3.CryptKey)
+
+	c, err = load("crypt_key = DpiJ1QaSh25O1Kt3\n")
+	require.NoError(t, err)
+	assert.Empty(t, c.S3.Passphrase)
+}
@@ -0,0 +1,128 @@
+//
+//  credentials.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package gnotes
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/wildwest-productions/goini"
+)
+
+// cryptKeyEnv, and passphraseEnv are the env variables to get the crypt key,
+// or passphrase from, if neither is in the config file.
+const (
+	cryptKeyEnv   = "GNOTES_CRYPT_KEY"
+	passphraseEnv = "GNOTES_PASSPHRASE"
+)
+
+// credentialCmdOutput is the output of the credential_cmd, its the same
+// format as the config file (without the section), eg:
+//
+//	accesskey = KEY
+//	secretkey = SECRET
+//	crypt_key = 32-CHAR-KEY
+type credentialCmdOutput struct {
+	AccessKey  string `ini:"accesskey"`
+	SecretKey  string `ini:"secretkey"`
+	CryptKey   string `ini:"crypt_key"`
+	Passphrase string `ini:"passphrase"`
+}
+
+// loadSecrets fills in any secrets that are not set in the config file, from
+// the credential_cmd, or the environment. Secrets in the config file always
+// take priority.
+func (c *S3Config) loadSecrets() error {
+	if c.CredentialCmd != "" && (c.AccessKey == "" || c.SecretKey == "" || !c.hasKey()) {
+		out, err := runCredentialCmd(c.CredentialCmd)
+		if err != nil {
+			return err
+		}
+
+		if c.AccessKey == "" {
+			c.AccessKey = out.AccessKey
+		}
+		if c.SecretKey == "" {
+			c.SecretKey = out.SecretKey
+		}
+		if !c.hasKey() {
+			c.CryptKey = out.CryptKey
+			c.Passphrase = out.Passphrase
+		}
+	}
+
+	if !c.hasKey() {
+		c.CryptKey = os.Getenv(cryptKeyEnv)
+	}
+	if !c.hasKey() {
+		c.Passphrase = os.Getenv(passphraseEnv)
+	}
+
+	return nil
+}
+
+// hasKey returns true if theres a crypt_key, or passphrase.
+func (c *S3Config) hasKey() bool {
+	return c.CryptKey != "" || c.Passphrase != ""
+}
+
+func runCredentialCmd(command string) (*credentialCmdOutput, error) {
+	log.Printf("Running credential_cmd")
+
+	stderr := bytes.NewBuffer(nil)
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = stderr
+
+	stdout, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("credential_cmd failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	out := &credentialCmdOutput{}
+
+	err = goini.Unmarshal(stdout, out)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse credential_cmd output: %w", err)
+	}
+
+	return out, nil
+}
+
+// credentials returns the s3 credentials. The first one found is used, in
+// this order: the config file (or credential_cmd), the profile from the
+// config file, the standard AWS_* env variables, then the default AWS profile.
+func (c S3Config) credentials() *credentials.Credentials {
+	providers := []credentials.Provider{
+		&credentials.StaticProvider{Value: credentials.Value{
+			AccessKeyID:     c.AccessKey,
+			SecretAccessKey: c.SecretKey,
+		}},
+	}
+
+	if c.Profile != "" {
+		providers = append(providers, &credentials.SharedCredentialsProvider{Profile: c.Profile})
+	}
+
+	providers = append(providers,
+		&credentials.EnvProvider{},
+		&credentials.SharedCredentialsProvider{},
+	)
+
+	return credentials.NewChainCredentials(providers)
+}
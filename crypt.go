@@ -3,51 +3,300 @@
 package gnotes
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 )
 
+// Objects are encrypted with AES-GCM, in chunks so they can be streamed:
+//
+//	"GNOTES" | version (1 byte) | nonce prefix (8 bytes) | chunks...
+//
+// Every chunk is up to cryptChunkSize bytes, plus the GCM tag. The nonce is
+// the prefix, and the chunk number, and the header, and if its the last chunk
+// are authenticated too. So a object that was changed, reordered, or truncated
+// fails to decrypt.
+//
+// Objects without the header are in the old AES-CFB format, with no
+// authentication. They can still be read, see ReencryptObjects.
+
+const (
+	cryptMagic   = "GNOTES"
+	cryptVersion = 2
+
+	cryptChunkSize       = 64 * 1024
+	cryptNoncePrefixSize = 8
+	cryptHeaderSize      = len(cryptMagic) + 1 + cryptNoncePrefixSize
+)
+
+// ErrDecrypt is returned when a object was changed, or truncated.
+var ErrDecrypt = errors.New("failed to decrypt, the data was changed or truncated")
+
 func (c *S3Config) Encrypt(data []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+
+	enc, err := c.encryptWriter(buf)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	_, err = enc.Write(data)
+	if err != nil {
+		return []byte{}, fmt.Errorf("could not encrypt: %s", err)
+	}
+
+	err = enc.Close()
+	if err != nil {
+		return []byte{}, fmt.Errorf("could not encrypt: %s", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c *S3Config) Decrypt(data []byte) ([]byte, error) {
+	dec, err := c.decryptReader(bytes.NewReader(data))
+	if err != nil {
+		return []byte{}, err
+	}
+
+	return io.ReadAll(dec)
+}
+
+func (c *S3Config) newGCM() (cipher.AEAD, error) {
 	if c.CryptKey == "" {
-		return []byte{}, fmt.Errorf("need a 16 bit key")
+		return nil, fmt.Errorf("need a 16 bit key")
 	}
 
 	block, err := aes.NewCipher([]byte(c.CryptKey))
 	if err != nil {
-		return []byte{}, fmt.Errorf("could not create new cipher: %s", err)
+		return nil, fmt.Errorf("could not create new cipher: %s", err)
 	}
 
-	encData := make([]byte, aes.BlockSize+len(data))
-	iv := encData[:aes.BlockSize]
+	return cipher.NewGCM(block)
+}
 
-	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
-		return []byte{}, fmt.Errorf("could not encrypt: %s", err)
+// encryptWriter returns a writer that will encrypt everything written to it,
+// and write it to w. It must be closed to write the last chunk.
+func (c *S3Config) encryptWriter(w io.Writer) (io.WriteCloser, error) {
+	aead, err := c.newGCM()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, cryptHeaderSize)
+	copy(header, cryptMagic)
+	header[len(cryptMagic)] = cryptVersion
+
+	if _, err = io.ReadFull(rand.Reader, header[len(cryptMagic)+1:]); err != nil {
+		return nil, fmt.Errorf("could not encrypt: %s", err)
 	}
 
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(encData[aes.BlockSize:], data)
+	if _, err = w.Write(header); err != nil {
+		return nil, err
+	}
 
-	return encData, nil
+	return &gcmWriter{w: w, aead: aead, header: header}, nil
 }
 
-func (c *S3Config) Decrypt(data []byte) ([]byte, error) {
+// decryptReader returns a reader that decrypts everything read from r. The
+// reverse of encryptWriter(), or the old AES-CFB format.
+func (c *S3Config) decryptReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+
+	if !isLegacyEncrypted(br) {
+		return c.gcmReader(br)
+	}
+
+	return c.legacyDecryptReader(br)
+}
+
+// isLegacyEncrypted returns true if the object being read is in the old
+// AES-CFB format.
+func isLegacyEncrypted(br *bufio.Reader) bool {
+	head, err := br.Peek(len(cryptMagic))
+	if err != nil {
+		return true
+	}
+
+	return string(head) != cryptMagic
+}
+
+func (c *S3Config) gcmReader(r *bufio.Reader) (io.Reader, error) {
+	header := make([]byte, cryptHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: invalid header", ErrDecrypt)
+	}
+
+	if v := header[len(cryptMagic)]; v != cryptVersion {
+		return nil, fmt.Errorf("unsupported encryption version: %d", v)
+	}
+
+	aead, err := c.newGCM()
+	if err != nil {
+		return nil, err
+	}
+
+	return &gcmReader{
+		r:      r,
+		aead:   aead,
+		header: header,
+		chunk:  make([]byte, cryptChunkSize+aead.Overhead()),
+	}, nil
+}
+
+// legacyDecryptReader decrypts the old AES-CFB format.
+func (c *S3Config) legacyDecryptReader(r io.Reader) (io.Reader, error) {
 	block, err := aes.NewCipher([]byte(c.CryptKey))
 	if err != nil {
-		return []byte{}, fmt.Errorf("could not create new cipher: %s", err)
+		return nil, fmt.Errorf("could not create new cipher: %s", err)
 	}
 
-	if len(data) < aes.BlockSize {
-		return []byte{}, fmt.Errorf("invalid ciphertext block size")
+	iv := make([]byte, aes.BlockSize)
+	if _, err = io.ReadFull(r, iv); err != nil {
+		return nil, fmt.Errorf("invalid ciphertext block size")
+	}
+
+	return &cipher.StreamReader{S: cipher.NewCFBDecrypter(block, iv), R: r}, nil
+}
+
+// chunkNonce returns the nonce for a chunk.
+func chunkNonce(header []byte, counter uint32) []byte {
+	nonce := make([]byte, cryptNoncePrefixSize+4)
+	copy(nonce, header[len(cryptMagic)+1:])
+	binary.BigEndian.PutUint32(nonce[cryptNoncePrefixSize:], counter)
+
+	return nonce
+}
+
+// chunkAD returns the authenticated data for a chunk.
+func chunkAD(header []byte, last bool) []byte {
+	ad := append([]byte{}, header...)
+	if last {
+		return append(ad, 1)
+	}
+
+	return append(ad, 0)
+}
+
+type gcmWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+
+	counter uint32
+	buf     []byte
+}
+
+func (g *gcmWriter) Write(p []byte) (int, error) {
+	written := len(p)
+
+	for len(p) > 0 {
+		// Only written once theres more, the last chunk is written by Close
+		if len(g.buf) == cryptChunkSize {
+			err := g.seal(false)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		n := cryptChunkSize - len(g.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		g.buf = append(g.buf, p[:n]...)
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+func (g *gcmWriter) Close() error {
+	return g.seal(true)
+}
+
+func (g *gcmWriter) seal(last bool) error {
+	if g.counter == ^uint32(0) {
+		return fmt.Errorf("too much data to encrypt")
 	}
 
-	iv := data[:aes.BlockSize]
-	data = data[aes.BlockSize:]
+	out := g.aead.Seal(nil, chunkNonce(g.header, g.counter), g.buf, chunkAD(g.header, last))
+
+	_, err := g.w.Write(out)
+	if err != nil {
+		return err
+	}
+
+	g.counter++
+	g.buf = g.buf[:0]
+
+	return nil
+}
+
+type gcmReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	header []byte
+
+	counter uint32
+	chunk   []byte
+
+	// buf is the decrypted data not read yet.
+	buf  []byte
+	done bool
+}
+
+func (g *gcmReader) Read(p []byte) (int, error) {
+	for len(g.buf) == 0 {
+		if g.done {
+			return 0, io.EOF
+		}
+
+		err := g.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, g.buf)
+	g.buf = g.buf[n:]
+
+	return n, nil
+}
+
+func (g *gcmReader) open() error {
+	n, err := io.ReadFull(g.r, g.chunk)
+	if err == io.EOF {
+		// The last chunk is missing
+		return fmt.Errorf("%w: chunk %d", ErrDecrypt, g.counter)
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		_, err = g.r.Peek(1)
+		if err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	plain, err := g.aead.Open(g.chunk[:0], chunkNonce(g.header, g.counter), g.chunk[:n], chunkAD(g.header, last))
+	if err != nil {
+		return fmt.Errorf("%w: chunk %d", ErrDecrypt, g.counter)
+	}
 
-	stream := cipher.NewCFBDecrypter(block, iv)
-	stream.XORKeyStream(data, data)
+	g.counter++
+	g.buf = plain
+	g.done = last
 
-	return data, nil
+	return nil
 }
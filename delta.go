@@ -0,0 +1,462 @@
+//
+//  delta.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package gnotes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// deltaSnapshotEvery is the max number of deltas for a note, after that the
+// whole note is uploaded again.
+const deltaSnapshotEvery = 10
+
+// With delta uploads, a note is stored as the full "content" object (the
+// snapshot), then the deltas to apply to it, eg:
+//
+//	catigory/uuid-1/content
+//	catigory/uuid-1/deltas/<id>
+//	catigory/uuid-1/head
+//
+// The head is a small object with the latest hash, and deltas. Its used to
+// check if the note changed, without downloading all of it.
+
+// noteDelta is the line changes from one version of a note to the next.
+type noteDelta struct {
+	// Base is the checksum of the version this applies to.
+	Base string     `json:"base"`
+	Ops  []*deltaOp `json:"ops"`
+}
+
+// deltaOp copies, or skips lines from the base, or inserts new text.
+type deltaOp struct {
+	Copy   int    `json:"c,omitempty"`
+	Skip   int    `json:"s,omitempty"`
+	Insert string `json:"i,omitempty"`
+}
+
+// noteHead is the latest version of a note.
+type noteHead struct {
+	Hash   string   `json:"hash"`
+	Deltas []string `json:"deltas,omitempty"`
+}
+
+var ErrBadDelta = errors.New("delta does not apply")
+
+func (n *Note) deltaPath(id string) string {
+	return filepath.Join(filepath.Dir(n.S3Path), "deltas", id)
+}
+
+func (n *Note) headPath() string {
+	return filepath.Join(filepath.Dir(n.S3Path), "head")
+}
+
+// makeDelta returns the changes from base to target.
+func makeDelta(base, target string) *noteDelta {
+	baseLines := splitLines(base)
+	targetLines := splitLines(target)
+	match := lcsMatch(baseLines, targetLines)
+
+	d := &noteDelta{Base: Sum([]byte(base)).String()}
+
+	add := func(op *deltaOp) {
+		if len(d.Ops) > 0 {
+			last := d.Ops[len(d.Ops)-1]
+			switch {
+			case op.Copy > 0 && last.Copy > 0:
+				last.Copy += op.Copy
+				return
+			case op.Skip > 0 && last.Skip > 0:
+				last.Skip += op.Skip
+				return
+			case op.Insert != "" && last.Insert != "":
+				last.Insert += op.Insert
+				return
+			}
+		}
+		d.Ops = append(d.Ops, op)
+	}
+
+	j := 0
+	for i := range baseLines {
+		if match[i] == -1 {
+			add(&deltaOp{Skip: 1})
+			continue
+		}
+		if j < match[i] {
+			add(&deltaOp{Insert: strings.Join(targetLines[j:match[i]], "")})
+		}
+		add(&deltaOp{Copy: 1})
+		j = match[i] + 1
+	}
+	if j < len(targetLines) {
+		add(&deltaOp{Insert: strings.Join(targetLines[j:], "")})
+	}
+
+	return d
+}
+
+// apply returns the next version from base.
+func (d *noteDelta) apply(base string) (string, error) {
+	if !Sum([]byte(base)).Matches(d.Base) {
+		return "", ErrBadDelta
+	}
+
+	lines := splitLines(base)
+	out := &strings.Builder{}
+
+	i := 0
+	for _, op := range d.Ops {
+		switch {
+		case op.Copy > 0:
+			if i+op.Copy > len(lines) {
+				return "", ErrBadDelta
+			}
+			out.WriteString(strings.Join(lines[i:i+op.Copy], ""))
+			i += op.Copy
+		case op.Skip > 0:
+			i += op.Skip
+		default:
+			out.WriteString(op.Insert)
+		}
+	}
+
+	return out.String(), nil
+}
+
+// uploadBytes will compress, encrypt and upload b.
+func (self *SelfApp) uploadBytes(to string, b []byte) error {
+	buf := bytes.NewBuffer(nil)
+
+	err := self.Config.S3.GzipAndEncrypt(buf, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	return self.Backend.Put(to, buf)
+}
+
+// readVersion downloads the snapshot of a note, and applies the deltas.
+func (self *SelfApp) readVersion(n *Note, deltas []string) ([]byte, error) {
+	b, err := self.downloadBytes(self.remotePath(n.S3Path))
+	if err != nil {
+		return nil, err
+	}
+
+	content := string(b)
+	for _, id := range deltas {
+		b, err := self.downloadBytes(self.remotePath(n.deltaPath(id)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to download delta: %w", err)
+		}
+
+		d := &noteDelta{}
+		err = json.Unmarshal(b, d)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse delta: %s: %w", id, err)
+		}
+
+		content, err = d.apply(content)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", id, err)
+		}
+	}
+
+	return []byte(content), nil
+}
+
+// remoteHead returns the latest version of a note. If there is no head
+// object, the note is downloaded, and returned too.
+func (self *SelfApp) remoteHead(n *Note) (*noteHead, []byte, error) {
+	b, err := self.downloadBytes(self.remotePath(n.headPath()))
+	if err == nil {
+		head := &noteHead{}
+		err = json.Unmarshal(b, head)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse note head: %w", err)
+		}
+		return head, nil, nil
+	}
+	if !errors.Is(err, ErrObjectNotFound) {
+		return nil, nil, err
+	}
+
+	// Uploaded without deltas
+	b, err = self.downloadBytes(self.remotePath(n.S3Path))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &noteHead{Hash: Sum(b).String()}, b, nil
+}
+
+func (self *SelfApp) writeHead(n *Note, hash string) error {
+	b, err := json.Marshal(&noteHead{Hash: hash, Deltas: n.Deltas})
+	if err != nil {
+		return err
+	}
+
+	return self.uploadBytes(self.remotePath(n.headPath()), b)
+}
+
+// uploadNote uploads the local cached note. With delta uploads, only the
+// changes from the last uploaded version are uploaded if possible. Returns the
+// checksum of what was uploaded.
+func (self *SelfApp) uploadNote(n *Note, noteFile string) (string, error) {
+	useDeltas := self.Config.App.DeltaUploads && !n.IsAttachment
+
+	if useDeltas {
+		hash, ok := self.uploadDelta(n, noteFile)
+		if ok {
+			return hash, nil
+		}
+	}
+
+	sum, err := self.uploadFile(noteFile, self.remotePath(n.S3Path))
+	if err != nil {
+		return "", err
+	}
+	hash := sum.String()
+
+	// Compact, the snapshot has all the changes now
+	old := n.Deltas
+	n.Deltas = nil
+	self.deleteDeltas(n, old)
+
+	if useDeltas {
+		err = self.writeHead(n, hash)
+		if err != nil {
+			return "", fmt.Errorf("failed to upload note head: %w", err)
+		}
+	} else if len(old) > 0 {
+		self.deleteHead(n)
+	}
+
+	return hash, nil
+}
+
+// uploadDelta uploads the changes from the last synced copy, if its worth it.
+// Returns false if the whole note should be uploaded instead.
+func (self *SelfApp) uploadDelta(n *Note, noteFile string) (string, bool) {
+	if n.Hash == "" || len(n.Deltas) >= deltaSnapshotEvery {
+		return "", false
+	}
+
+	base, err := os.ReadFile(self.baseFile(n.S3Path))
+	if err != nil || !Sum(base).Matches(n.Hash) {
+		return "", false
+	}
+
+	local, err := os.ReadFile(noteFile)
+	if err != nil {
+		return "", false
+	}
+
+	b, err := json.Marshal(makeDelta(string(base), string(local)))
+	if err != nil {
+		return "", false
+	}
+
+	// Not worth it if most of the note changed
+	if len(b) > len(local)/2 {
+		return "", false
+	}
+
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	err = self.uploadBytes(self.remotePath(n.deltaPath(id)), b)
+	if err != nil {
+		log.Printf("Failed to upload delta: %s", err)
+		return "", false
+	}
+
+	n.Deltas = append(n.Deltas, id)
+
+	hash := Sum(local).String()
+
+	err = self.writeHead(n, hash)
+	if err != nil {
+		log.Printf("Failed to upload note head: %s", err)
+		n.Deltas = n.Deltas[:len(n.Deltas)-1]
+		self.deleteDeltas(n, []string{id})
+		return "", false
+	}
+
+	log.Printf("Uploaded delta %s (%d bytes) for: %s", id, len(b), n.S3Path)
+
+	return hash, true
+}
+
+// deleteDeltas deletes delta objects once the index is saved. The saved
+// remote index still lists them until then, and if the index upload fails (or
+// is queued, or gnotes crashes first) that index is the one left on the
+// remote, so the deltas must still be there to read the note.
+func (self *SelfApp) deleteDeltas(n *Note, ids []string) {
+	for _, id := range ids {
+		self.staleObjects = append(self.staleObjects, self.remotePath(n.deltaPath(id)))
+	}
+}
+
+// deleteStale deletes the objects from deleteDeltas, after the index was
+// saved. If the index upload was queued, the deletes are queued after it.
+func (self *SelfApp) deleteStale(queued bool) error {
+	for _, remote := range self.staleObjects {
+		if queued {
+			err := self.enqueueDelete(remote)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		self.deleteLater(remote)
+	}
+
+	self.staleObjects = nil
+
+	return nil
+}
+
+func (self *SelfApp) deleteHead(n *Note) {
+	self.deleteLater(self.remotePath(n.headPath()))
+}
+
+// deleteLater deletes a object, or queues it if that fails.
+func (self *SelfApp) deleteLater(remote string) {
+	err := self.DeleteFile(remote)
+	if err == nil || errors.Is(err, ErrObjectNotFound) {
+		return
+	}
+
+	log.Printf("Failed to delete %s: %s", remote, err)
+
+	err = self.enqueueDelete(remote)
+	if err != nil {
+		log.Printf("Failed to queue delete: %s", err)
+	}
+}
+
+// CompactNotes uploads the whole note again for all notes with deltas, and
+// deletes the deltas. Returns the number of notes compacted.
+func (self *SelfApp) CompactNotes() (int, error) {
+	err := self.checkWritable()
+	if err != nil {
+		return 0, err
+	}
+
+	compacted := 0
+
+	for _, b := range self.Notes.Books {
+		for _, n := range b.Notes {
+			if len(n.Deltas) == 0 {
+				continue
+			}
+
+			err := n.Download(self.Config.App.NoteDir)
+			if err != nil {
+				return compacted, err
+			}
+
+			noteFile := filepath.Join(self.Config.App.NoteDir, "notes", n.S3Path)
+
+			sum, err := SumFile(noteFile)
+			if err != nil {
+				return compacted, err
+			}
+			if !sum.Matches(n.Hash) {
+				log.Printf("Not compacting note with local changes: %s", n.S3Path)
+				continue
+			}
+
+			_, err = self.uploadFile(noteFile, self.remotePath(n.S3Path))
+			if err != nil {
+				return compacted, err
+			}
+
+			old := n.Deltas
+			n.Deltas = nil
+
+			err = self.writeHead(n, n.Hash)
+			if err != nil {
+				return compacted, err
+			}
+			self.deleteDeltas(n, old)
+
+			compacted++
+			self.IndexNeedsUpdating = true
+		}
+	}
+
+	if compacted > 0 {
+		log.Printf("Compacted %d notes", compacted)
+	}
+
+	return compacted, nil
+}
+
+// downloadDeltas downloads a note with deltas to the local cache. Like
+// downloadVerified, its quarantined if it does not match the note hash.
+func (self *SelfApp) downloadDeltas(n *Note, noteFile string) error {
+	b, err := self.readVersion(n, n.Deltas)
+	if err != nil {
+		return err
+	}
+
+	if !Sum(b).Matches(n.Hash) {
+		return self.quarantineBytes(b, self.remotePath(n.S3Path), n.Hash)
+	}
+
+	err = os.MkdirAll(filepath.Dir(noteFile), 0755)
+	if err != nil {
+		return err
+	}
+
+	// Write to the private tmp dir first, like downloadFile
+	file, err := self.createTemp()
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %s", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	_, err = file.Write(b)
+	if err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+
+	err = os.Chmod(file.Name(), 0664)
+	if err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+
+	err = renameInto(file.Name(), noteFile)
+	if err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+
+	log.Printf("Downloaded note with %d deltas: %s", len(n.Deltas), n.S3Path)
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package gnotes
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelta(t *testing.T) {
+	tests := []struct {
+		base   string
+		target string
+	}{
+		{"a\nb\nc\n", "a\nB\nc\n"},
+		{"", "new\nnote"},
+		{"a\nb\n", ""},
+		{"a\nb", "a\nb\nc"},
+		{"a\nb\nc\nd\n", "x\na\nc\nd\ny\n"},
+	}
+
+	for _, test := range tests {
+		d := makeDelta(test.base, test.target)
+		got, err := d.apply(test.base)
+		require.NoError(t, err)
+		assert.Equal(t, test.target, got)
+	}
+
+	// Only applies to the version it was made from
+	_, err := makeDelta("a\n", "b\n").apply("c\n")
+	assert.ErrorIs(t, err, ErrBadDelta)
+}
+
+func TestDeltaUploads(t *testing.T) {
+	backend := newMemBackend()
+
+	app := newTestApp(t, backend)
+	app.Config.App.DeltaUploads = true
+
+	lines := []string{}
+	for i := 0; i < 200; i++ {
+		lines = append(lines, fmt.Sprintf("line number %d of a large note %s", i, Sha1(fmt.Sprint(i))))
+	}
+	content := strings.Join(lines, "\n") + "\n"
+
+	n := addNote(t, app, content)
+	assert.Empty(t, n.Deltas)
+
+	snapshot, err := backend.Stat(app.remotePath(n.S3Path))
+	require.NoError(t, err)
+
+	// Editing one line only uploads a delta
+	content = strings.Replace(content, "line number 100 ", "line number one hundred ", 1)
+	editNote(t, app, n, content)
+	require.Len(t, n.Deltas, 1)
+
+	delta, err := backend.Stat(app.remotePath(n.deltaPath(n.Deltas[0])))
+	require.NoError(t, err)
+	assert.Less(t, delta.Size, snapshot.Size/4)
+
+	require.NoError(t, app.SaveIndexFile())
+
+	// Another device gets the latest version
+	other := openTestApp(t, backend)
+	assert.Equal(t, content, readNote(t, other, other.Notes.Books[0].Notes[0]))
+
+	// After too many deltas, the whole note is uploaded again
+	for i := 0; i < deltaSnapshotEvery; i++ {
+		content = strings.Replace(content, fmt.Sprintf("line number %d ", i), fmt.Sprintf("line %d ", i), 1)
+		editNote(t, app, n, content)
+	}
+	assert.Empty(t, n.Deltas)
+
+	// The deltas are kept until the index that does not need them is saved
+	objects, err := backend.List(app.remotePath(filepath.Dir(n.S3Path), "deltas"))
+	require.NoError(t, err)
+	assert.Len(t, objects, deltaSnapshotEvery)
+
+	require.NoError(t, app.SaveIndexFile())
+
+	objects, err = backend.List(app.remotePath(filepath.Dir(n.S3Path), "deltas"))
+	require.NoError(t, err)
+	assert.Empty(t, objects)
+
+	content = strings.Replace(content, "line number 150 ", "line 150 ", 1)
+	editNote(t, app, n, content)
+	require.Len(t, n.Deltas, 1)
+
+	b, err := app.readVersion(n, n.Deltas)
+	require.NoError(t, err)
+	assert.Equal(t, content, string(b))
+
+	// Compacting uploads the whole note, and removes the deltas
+	compacted, err := app.CompactNotes()
+	require.NoError(t, err)
+	assert.Equal(t, 1, compacted)
+	assert.Empty(t, n.Deltas)
+
+	objects, err = backend.List(app.remotePath(filepath.Dir(n.S3Path), "deltas"))
+	require.NoError(t, err)
+	assert.Len(t, objects, 1)
+
+	require.NoError(t, app.SaveIndexFile())
+
+	objects, err = backend.List(app.remotePath(filepath.Dir(n.S3Path), "deltas"))
+	require.NoError(t, err)
+	assert.Empty(t, objects)
+
+	b, err = app.readVersion(n, nil)
+	require.NoError(t, err)
+	assert.Equal(t, content, string(b))
+}
+
+func TestDeltaDeletesAfterIndex(t *testing.T) {
+	queueRetryDelay = time.Millisecond
+
+	backend := &offlineBackend{memBackend: newMemBackend()}
+
+	app := newTestApp(t, backend)
+	app.Config.App.DeltaUploads = true
+
+	content := strings.Repeat("a line that is long enough for a delta\n", 50)
+	n := addNote(t, app, content)
+
+	content += "one more line\n"
+	editNote(t, app, n, content)
+	require.Len(t, n.Deltas, 1)
+	require.NoError(t, app.SaveIndexFile())
+	delta := app.remotePath(n.deltaPath(n.Deltas[0]))
+
+	compacted, err := app.CompactNotes()
+	require.NoError(t, err)
+	assert.Equal(t, 1, compacted)
+
+	// The index upload is queued, so the delta must be deleted after it
+	backend.offline = true
+	require.NoError(t, app.SaveIndexFile())
+
+	q, err := app.loadQueue()
+	require.NoError(t, err)
+	require.Len(t, q.Ops, 2)
+	assert.Equal(t, opPut, q.Ops[0].Op)
+	assert.Equal(t, app.remotePath("index.json"), q.Ops[0].Remote)
+	assert.Equal(t, opDelete, q.Ops[1].Op)
+
+	// The remote index still points to it
+	_, err = backend.Stat(delta)
+	require.NoError(t, err)
+
+	// And its deleted once back online
+	self = app
+	backend.offline = false
+	require.NoError(t, app.FlushQueue())
+
+	_, err = backend.Stat(delta)
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+}
@@ -14,9 +14,12 @@ package gnotes
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
-	"io/ioutil"
+	"hash"
+	"io"
+	"os"
 )
 
 func Sha1(s string) string {
@@ -26,15 +29,73 @@ func Sha1(s string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-func Sha1File(file string) (string, error) {
-	b, err := ioutil.ReadFile(file)
+// Checksum is the checksum of a note, or index. New checksums are SHA-256,
+// but the SHA-1 checksum is kept too, so it can still be compared with the
+// checksums from older versions of gnotes.
+type Checksum struct {
+	sha256 string
+	sha1   string
+}
+
+// String returns the SHA-256 checksum, its what is stored for new checksums.
+func (c Checksum) String() string {
+	return c.sha256
+}
+
+// Matches returns true if hash is the SHA-256, or the older SHA-1 checksum of
+// the same data.
+func (c Checksum) Matches(hash string) bool {
+	return hash != "" && (hash == c.sha256 || hash == c.sha1)
+}
+
+// checksumWriter calculates a Checksum of everything written to it.
+type checksumWriter struct {
+	h256 hash.Hash
+	h1   hash.Hash
+}
+
+func newChecksumWriter() *checksumWriter {
+	return &checksumWriter{h256: sha256.New(), h1: sha1.New()}
+}
+
+func (w *checksumWriter) Write(p []byte) (int, error) {
+	w.h256.Write(p)
+	w.h1.Write(p)
+
+	return len(p), nil
+}
+
+func (w *checksumWriter) Sum() Checksum {
+	return Checksum{
+		sha256: hex.EncodeToString(w.h256.Sum(nil)),
+		sha1:   hex.EncodeToString(w.h1.Sum(nil)),
+	}
+}
+
+// Sum returns the checksum of b.
+func Sum(b []byte) Checksum {
+	w := newChecksumWriter()
+	w.Write(b)
+
+	return w.Sum()
+}
+
+// SumFile returns the checksum of a file.
+func SumFile(file string) (Checksum, error) {
+	f, err := os.Open(file)
 	if err != nil {
-		return "", fmt.Errorf("failed to read file: %w", err)
+		return Checksum{}, fmt.Errorf("failed to read file: %w", err)
 	}
+	defer f.Close()
+
+	w := newChecksumWriter()
 
-	sha1 := Sha1(string(b))
+	_, err = io.Copy(w, f)
+	if err != nil {
+		return Checksum{}, fmt.Errorf("failed to read file: %w", err)
+	}
 
-	return sha1, nil
+	return w.Sum(), nil
 }
 
 func formatBytes(bytes int64) string {
@@ -0,0 +1,426 @@
+//
+//  fsck.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package gnotes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FsckKind is the kind of problem found by Fsck.
+type FsckKind string
+
+const (
+	// FsckMissing is a object in the index, that is not on the backend.
+	FsckMissing FsckKind = "missing"
+
+	// FsckOrphaned is a object on the backend, that is not in the index.
+	FsckOrphaned FsckKind = "orphaned"
+
+	// FsckHashMismatch is a object that does not match the checksum in the
+	// index.
+	FsckHashMismatch FsckKind = "hash mismatch"
+
+	// FsckUndecryptable is a object that could not be decrypted, or
+	// decompressed.
+	FsckUndecryptable FsckKind = "undecryptable"
+
+	// FsckStaleCache is a cached note that does not match the index, and has
+	// no local changes.
+	FsckStaleCache FsckKind = "stale cache"
+)
+
+// ErrNoGoodCopy is returned when repairing a note, if there is no local copy
+// that matches the index.
+var ErrNoGoodCopy = errors.New("no good local copy")
+
+// errUndecryptable is returned by remoteChecksum if the object could not be
+// decrypted.
+var errUndecryptable = errors.New("failed to decrypt")
+
+// FsckProblem is a single problem found by Fsck.
+type FsckProblem struct {
+	Kind FsckKind
+
+	// Key is the backend key of the object.
+	Key string
+
+	// Note is the note the object belongs to, nil for the index, or orphaned
+	// objects.
+	Note *Note
+
+	// Repaired is true if the problem was fixed, otherwise Err may have why
+	// it could not be.
+	Repaired bool
+	Err      error
+}
+
+func (p *FsckProblem) String() string {
+	s := fmt.Sprintf("%s: %s", p.Kind, p.Key)
+	if p.Note != nil && p.Note.Title != "" {
+		s += fmt.Sprintf(" (%s)", p.Note.Title)
+	}
+
+	switch {
+	case p.Repaired:
+		s += " [repaired]"
+	case p.Err != nil:
+		s += fmt.Sprintf(" [not repaired: %s]", p.Err)
+	}
+
+	return s
+}
+
+// FsckReport is the result of Fsck.
+type FsckReport struct {
+	// Objects is the number of objects on the backend.
+	Objects int
+	// Notes is the number of notes in the index.
+	Notes int
+
+	Problems []*FsckProblem
+}
+
+// Unrepaired returns the number of problems that were not repaired.
+func (r *FsckReport) Unrepaired() int {
+	count := 0
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			count++
+		}
+	}
+
+	return count
+}
+
+// fsckState is what is shared while checking all the notes.
+type fsckState struct {
+	report *FsckReport
+	repair bool
+
+	// found are all the keys on the backend.
+	found map[string]bool
+}
+
+func (s *fsckState) add(kind FsckKind, key string, n *Note) *FsckProblem {
+	p := &FsckProblem{Kind: kind, Key: key, Note: n}
+	s.report.Problems = append(s.report.Problems, p)
+
+	return p
+}
+
+// Fsck checks that every object in the index is on the backend, can be
+// decrypted and matches its checksum, and that the cached notes match the
+// index. With repair, broken notes are uploaded again from a good local copy,
+// stale cached notes are downloaded again, and broken revisions are removed
+// from the index. Orphaned objects are only reported.
+func (self *SelfApp) Fsck(repair bool) (*FsckReport, error) {
+	if repair && self.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
+	pending, err := self.PendingOps()
+	if err != nil {
+		return nil, err
+	}
+	if pending > 0 {
+		log.Printf("There are %d pending operations, some objects may not be uploaded yet", pending)
+	}
+
+	objects, err := self.Backend.List(self.remotePath() + "/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	s := &fsckState{
+		report: &FsckReport{Objects: len(objects)},
+		repair: repair,
+		found:  map[string]bool{},
+	}
+	for _, o := range objects {
+		s.found[o.Key] = true
+	}
+
+	err = self.fsckIndex(s)
+	if err != nil {
+		return s.report, err
+	}
+
+	for _, b := range self.Notes.Books {
+		for _, n := range b.Notes {
+			s.report.Notes++
+
+			err = self.fsckNote(s, n)
+			if err != nil {
+				return s.report, err
+			}
+		}
+	}
+
+	known := self.referencedKeys()
+	for _, o := range objects {
+		if !known[o.Key] {
+			s.add(FsckOrphaned, o.Key, nil)
+		}
+	}
+
+	return s.report, nil
+}
+
+// remoteChecksum downloads, and decrypts a object, and returns the checksum of
+// its contents.
+func (self *SelfApp) remoteChecksum(key string) (Checksum, error) {
+	r, err := self.Backend.Get(key)
+	if err != nil {
+		return Checksum{}, err
+	}
+	defer r.Close()
+
+	h := newChecksumWriter()
+
+	err = self.Config.S3.DecryptAndDeGzip(h, r)
+	if err != nil {
+		return Checksum{}, fmt.Errorf("%w: %s", errUndecryptable, err)
+	}
+
+	return h.Sum(), nil
+}
+
+// fsckObject checks that a object exists, and can be decrypted. Returns the
+// checksum, or a empty checksum if there was a problem.
+func (self *SelfApp) fsckObject(s *fsckState, key string, n *Note) (Checksum, *FsckProblem, error) {
+	if !s.found[key] {
+		return Checksum{}, s.add(FsckMissing, key, n), nil
+	}
+
+	sum, err := self.remoteChecksum(key)
+	if errors.Is(err, errUndecryptable) {
+		log.Printf("Failed to decrypt %s: %s", key, err)
+		return Checksum{}, s.add(FsckUndecryptable, key, n), nil
+	}
+	if err != nil {
+		return Checksum{}, nil, fmt.Errorf("failed to check %s: %w", key, err)
+	}
+
+	return sum, nil, nil
+}
+
+func (self *SelfApp) fsckIndex(s *fsckState) error {
+	indexKey := self.remotePath("index.json")
+	shaKey := self.remotePath("index.json.sha256")
+
+	sum, p, err := self.fsckObject(s, indexKey, nil)
+	if err != nil {
+		return err
+	}
+
+	var shaProblem *FsckProblem
+	if p == nil {
+		if !s.found[shaKey] {
+			shaProblem = s.add(FsckMissing, shaKey, nil)
+		} else {
+			b, err := self.downloadBytes(shaKey)
+			if err != nil {
+				return fmt.Errorf("failed to check %s: %w", shaKey, err)
+			}
+			if !sum.Matches(strings.TrimSpace(string(b))) {
+				shaProblem = s.add(FsckHashMismatch, indexKey, nil)
+			}
+		}
+	}
+
+	for _, p := range []*FsckProblem{p, shaProblem} {
+		// The local index can only replace a missing, or mismatched index,
+		// a undecryptable one could not be merged with it.
+		if p == nil || !s.repair || p.Kind == FsckUndecryptable {
+			continue
+		}
+
+		// Will be uploaded with the index
+		self.IndexNeedsUpdating = true
+		p.Repaired = true
+	}
+
+	return nil
+}
+
+func (self *SelfApp) fsckNote(s *fsckState, n *Note) error {
+	if n.Hash == "" {
+		// Never uploaded
+		return nil
+	}
+
+	// The note, and all its deltas
+	var problems []*FsckProblem
+
+	sum, p, err := self.fsckObject(s, self.remotePath(n.S3Path), n)
+	if err != nil {
+		return err
+	}
+	if p != nil {
+		problems = append(problems, p)
+	}
+
+	for _, id := range n.Deltas {
+		_, p, err := self.fsckObject(s, self.remotePath(n.deltaPath(id)), n)
+		if err != nil {
+			return err
+		}
+		if p != nil {
+			problems = append(problems, p)
+		}
+	}
+
+	if len(problems) == 0 && len(n.Deltas) > 0 {
+		b, err := self.readVersion(n, n.Deltas)
+		if err != nil && !errors.Is(err, ErrBadDelta) {
+			return err
+		}
+		sum = Sum(b)
+		if err != nil {
+			sum = Checksum{}
+		}
+	}
+	if len(problems) == 0 && !sum.Matches(n.Hash) {
+		problems = append(problems, s.add(FsckHashMismatch, self.remotePath(n.S3Path), n))
+	}
+
+	if len(problems) > 0 && s.repair {
+		err := self.repairNote(n, s.found[self.remotePath(n.headPath())])
+		for _, p := range problems {
+			p.Repaired = err == nil
+			p.Err = err
+		}
+	}
+
+	err = self.fsckRevisions(s, n)
+	if err != nil {
+		return err
+	}
+
+	// Only check the cache if the remote note is good, so it could be
+	// downloaded again
+	for _, p := range problems {
+		if !p.Repaired {
+			return nil
+		}
+	}
+
+	return self.fsckCache(s, n)
+}
+
+// fsckRevisions checks all the revisions of a note, broken ones are removed
+// from the index with repair.
+func (self *SelfApp) fsckRevisions(s *fsckState, n *Note) error {
+	keep := []*Revision{}
+
+	for _, r := range n.Revisions {
+		key := self.remotePath(n.revisionPath(r.ID))
+
+		sum, p, err := self.fsckObject(s, key, n)
+		if err != nil {
+			return err
+		}
+		if p == nil && !sum.Matches(r.Hash) {
+			p = s.add(FsckHashMismatch, key, n)
+		}
+
+		if p != nil && s.repair {
+			log.Printf("Removing broken revision %s of %s", r.ID, n.S3Path)
+			p.Repaired = true
+			self.IndexNeedsUpdating = true
+			continue
+		}
+
+		keep = append(keep, r)
+	}
+
+	if len(keep) != len(n.Revisions) {
+		n.Revisions = keep
+	}
+
+	return nil
+}
+
+// fsckCache checks that the cached note matches the index. A cached note with
+// local changes that were not uploaded yet is not a problem.
+func (self *SelfApp) fsckCache(s *fsckState, n *Note) error {
+	noteFile := filepath.Join(self.Config.App.NoteDir, "notes", n.S3Path)
+
+	sum, err := SumFile(noteFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if sum.Matches(n.Hash) {
+		return nil
+	}
+
+	base := self.baseSum(n.S3Path)
+	if !n.IsAttachment && base != (Checksum{}) && base != sum {
+		log.Printf("Cached note has local changes: %s", n.S3Path)
+		return nil
+	}
+
+	p := s.add(FsckStaleCache, noteFile, n)
+	if !s.repair {
+		return nil
+	}
+
+	p.Err = n.Download(self.Config.App.NoteDir)
+	p.Repaired = p.Err == nil
+
+	return nil
+}
+
+// repairNote uploads the note again from the cached note, or the last synced
+// copy if they match the index.
+func (self *SelfApp) repairNote(n *Note, hasHead bool) error {
+	good := filepath.Join(self.Config.App.NoteDir, "notes", n.S3Path)
+
+	sum, err := SumFile(good)
+	if err != nil || !sum.Matches(n.Hash) {
+		good = self.baseFile(n.S3Path)
+		if !self.baseSum(n.S3Path).Matches(n.Hash) {
+			return ErrNoGoodCopy
+		}
+	}
+
+	log.Printf("Repairing note from %s: %s", good, n.S3Path)
+
+	sum, err = self.uploadFile(good, self.remotePath(n.S3Path))
+	if err != nil {
+		return fmt.Errorf("failed to upload note: %w", err)
+	}
+
+	// The whole note was uploaded, so the deltas are not needed
+	old := n.Deltas
+	n.Deltas = nil
+	self.deleteDeltas(n, old)
+
+	if hasHead || len(old) > 0 {
+		err = self.writeHead(n, n.Hash)
+		if err != nil {
+			return fmt.Errorf("failed to upload note head: %w", err)
+		}
+	}
+
+	self.IndexNeedsUpdating = true
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package gnotes
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fsckKinds(r *FsckReport) []string {
+	kinds := []string{}
+	for _, p := range r.Problems {
+		kinds = append(kinds, string(p.Kind))
+	}
+	return kinds
+}
+
+func TestFsck(t *testing.T) {
+	backend := newMemBackend()
+
+	app := newTestApp(t, backend)
+	one := addNote(t, app, "one\n")
+	two := addNote(t, app, "two\n")
+	three := addNote(t, app, "three\n")
+
+	report, err := app.Fsck(false)
+	require.NoError(t, err)
+	assert.Empty(t, report.Problems)
+	assert.Equal(t, 3, report.Notes)
+
+	// Break everything
+	require.NoError(t, backend.Put(app.remotePath(one.S3Path), strings.NewReader("garbage")))
+	require.NoError(t, backend.Delete(app.remotePath(two.S3Path)))
+	require.NoError(t, backend.Put(app.remotePath("old/uuid/content"), strings.NewReader("orphan")))
+	require.NoError(t, os.WriteFile(notePath(app, three), []byte("stale\n"), 0664))
+	require.NoError(t, os.Remove(app.baseFile(three.S3Path)))
+
+	report, err = app.Fsck(false)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"undecryptable", "missing", "stale cache", "orphaned"}, fsckKinds(report))
+	assert.Equal(t, 4, report.Unrepaired())
+
+	// Then repair it, all but the orphan
+	report, err = app.Fsck(true)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Unrepaired())
+	assert.True(t, app.IndexNeedsUpdating)
+
+	b, err := app.downloadBytes(app.remotePath(one.S3Path))
+	require.NoError(t, err)
+	assert.Equal(t, "one\n", string(b))
+
+	b, err = os.ReadFile(notePath(app, three))
+	require.NoError(t, err)
+	assert.Equal(t, "three\n", string(b))
+
+	report, err = app.Fsck(false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"orphaned"}, fsckKinds(report))
+
+	// Without a good local copy, it can not be repaired
+	require.NoError(t, os.Remove(notePath(app, two)))
+	require.NoError(t, os.Remove(app.baseFile(two.S3Path)))
+	require.NoError(t, backend.Delete(app.remotePath(two.S3Path)))
+
+	report, err = app.Fsck(true)
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 2)
+	assert.ErrorIs(t, report.Problems[0].Err, ErrNoGoodCopy)
+}
@@ -0,0 +1,122 @@
+//
+//  gc.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package gnotes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// gcGracePeriod is how old a orphaned object must be before its deleted.
+// Another device uploads its notes before the index that points to them, so
+// new objects may not be in the index yet.
+var gcGracePeriod = 24 * time.Hour
+
+// GCReport is the orphaned objects found by FindOrphans.
+type GCReport struct {
+	Orphans []ObjectInfo
+
+	// Size is the total size of the orphans, in bytes.
+	Size int64
+
+	// Skipped is the number of orphans that are too new to be deleted.
+	Skipped int
+}
+
+// Reclaimable returns the size of the orphans, like "1.2 MB".
+func (r *GCReport) Reclaimable() string {
+	return formatBytes(r.Size)
+}
+
+// referencedKeys returns all the backend keys that the index points to, the
+// notes (including the trash), their deltas, heads and revisions.
+func (self *SelfApp) referencedKeys() map[string]bool {
+	keys := map[string]bool{
+		self.remotePath("index.json"):        true,
+		self.remotePath("index.json.sha256"): true,
+		self.leasePath():                     true,
+		self.kdfPath():                       true,
+	}
+
+	for _, b := range self.Notes.Books {
+		for _, n := range b.Notes {
+			keys[self.remotePath(n.S3Path)] = true
+			keys[self.remotePath(n.headPath())] = true
+
+			for _, id := range n.Deltas {
+				keys[self.remotePath(n.deltaPath(id))] = true
+			}
+			for _, r := range n.Revisions {
+				keys[self.remotePath(n.revisionPath(r.ID))] = true
+			}
+		}
+	}
+
+	return keys
+}
+
+// FindOrphans lists all the objects on the backend that are not in the index,
+// like the notes from a deleted book, or uploads from a failed run. The index
+// should be up-to-date (with LoadNotes) first.
+func (self *SelfApp) FindOrphans() (*GCReport, error) {
+	if self.indexPending() {
+		return nil, errors.New("the index has not been uploaded yet, try again when online")
+	}
+
+	objects, err := self.Backend.List(self.remotePath() + "/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	keys := self.referencedKeys()
+	report := &GCReport{}
+
+	for _, o := range objects {
+		if keys[o.Key] {
+			continue
+		}
+		if time.Since(o.Modified) < gcGracePeriod {
+			report.Skipped++
+			continue
+		}
+
+		report.Orphans = append(report.Orphans, o)
+		report.Size += o.Size
+	}
+
+	return report, nil
+}
+
+// GC deletes the orphaned objects found by FindOrphans. Returns the number of
+// objects deleted.
+func (self *SelfApp) GC(report *GCReport) (int, error) {
+	err := self.checkWritable()
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+
+	for _, o := range report.Orphans {
+		err := self.DeleteFile(o.Key)
+		if err != nil && !errors.Is(err, ErrObjectNotFound) {
+			return deleted, fmt.Errorf("failed to delete %s: %w", o.Key, err)
+		}
+		deleted++
+	}
+
+	log.Printf("Deleted %d orphaned objects (%s)", deleted, report.Reclaimable())
+
+	return deleted, nil
+}
@@ -0,0 +1,51 @@
+package gnotes
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGC(t *testing.T) {
+	backend := newMemBackend()
+
+	app := newTestApp(t, backend)
+	app.Config.App.KeepRevisions = true
+	n := addNote(t, app, "v1\n")
+	editNote(t, app, n, "v2\n")
+	require.NoError(t, app.SaveIndexFile())
+
+	orphan := app.remotePath("old", "uuid", "content")
+	require.NoError(t, backend.Put(orphan, strings.NewReader("orphaned")))
+
+	// New objects are kept
+	report, err := app.FindOrphans()
+	require.NoError(t, err)
+	assert.Empty(t, report.Orphans)
+	assert.Equal(t, 1, report.Skipped)
+
+	gcGracePeriod = 0
+	defer func() { gcGracePeriod = 24 * time.Hour }()
+
+	report, err = app.FindOrphans()
+	require.NoError(t, err)
+	require.Len(t, report.Orphans, 1)
+	assert.Equal(t, orphan, report.Orphans[0].Key)
+	assert.Equal(t, int64(len("orphaned")), report.Size)
+
+	deleted, err := app.GC(report)
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+
+	_, err = backend.Stat(orphan)
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+
+	// The note, and its revision are still there
+	_, err = backend.Stat(app.remotePath(n.S3Path))
+	assert.NoError(t, err)
+	_, err = backend.Stat(app.remotePath(n.revisionPath(n.Revisions[0].ID)))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,430 @@
+//
+//  git.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package gnotes
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrDiverged is returned when the local and remote branch both changed the
+// same objects, and they can not be merged.
+var ErrDiverged = errors.New("local and remote git branch diverged")
+
+// IndexMergeFunc merges the (encrypted) index.json objects of two diverged
+// branches. base is from the commit they both started from, and is nil if it
+// did not have one. Returns the new index.json, and index.json.sha256 objects.
+type IndexMergeFunc func(base, local, remote []byte) (index, sha []byte, err error)
+
+// GitBackend stores all the (encrypted) objects in a git repository, and
+// commits them every time the index is saved. This gives the history for
+// free, and can optionally push/pull to a remote like file:///mnt/nas/notes.git
+type GitBackend struct {
+	config GitConfig
+
+	// files is used for reading/writing the objects in the work tree.
+	files *LocalBackend
+
+	// MergeIndex resolves a conflict of the index when another device pushed
+	// since the last pull. If nil, it is a ErrDiverged.
+	MergeIndex IndexMergeFunc
+}
+
+func NewGitBackend(c GitConfig) (*GitBackend, error) {
+	if c.Path == "" {
+		return nil, fmt.Errorf("git: path cannot be empty")
+	}
+	if c.Bare && c.WorkTree == "" {
+		return nil, fmt.Errorf("git: worktree cannot be empty for a bare repository")
+	}
+	if c.Branch == "" {
+		c.Branch = "main"
+	}
+
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, fmt.Errorf("git: %w", err)
+	}
+
+	workTree := c.Path
+	if c.Bare {
+		workTree = c.WorkTree
+	}
+
+	files, err := NewLocalBackend(LocalConfig{Path: workTree})
+	if err != nil {
+		return nil, err
+	}
+
+	b := &GitBackend{
+		config: c,
+		files:  files,
+	}
+
+	err = b.init()
+	if err != nil {
+		return nil, fmt.Errorf("git: failed to init repository: %w", err)
+	}
+
+	return b, nil
+}
+
+// git runs a git command for the repository, and returns its stdout.
+func (b *GitBackend) git(args ...string) (string, error) {
+	// The command name for errors, after any -c options
+	name := args[0]
+	for i := 0; i+2 < len(args) && args[i] == "-c"; i += 2 {
+		name = args[i+2]
+	}
+
+	if b.config.Bare {
+		args = append([]string{"--git-dir", b.config.Path, "--work-tree", b.config.WorkTree}, args...)
+	} else {
+		args = append([]string{"-C", b.config.Path}, args...)
+	}
+
+	stdout := bytes.NewBuffer(nil)
+	stderr := bytes.NewBuffer(nil)
+
+	cmd := exec.Command("git", args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return stdout.String(), fmt.Errorf("git %s: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
+
+func (b *GitBackend) init() error {
+	gitDir := filepath.Join(b.config.Path, ".git")
+	if b.config.Bare {
+		gitDir = b.config.Path
+	}
+
+	if _, err := os.Stat(filepath.Join(gitDir, "HEAD")); errors.Is(err, os.ErrNotExist) {
+		log.Printf("Creating new git repository: %s", b.config.Path)
+
+		args := []string{"init", "-q"}
+		if b.config.Bare {
+			args = append(args, "--bare")
+		}
+
+		out, err := exec.Command("git", append(args, b.config.Path)...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, out)
+		}
+
+		_, err = b.git("symbolic-ref", "HEAD", "refs/heads/"+b.config.Branch)
+		if err != nil {
+			return err
+		}
+	}
+
+	if b.config.Remote != "" {
+		current, err := b.git("remote", "get-url", "origin")
+		if err != nil {
+			_, err = b.git("remote", "add", "origin", b.config.Remote)
+		} else if strings.TrimSpace(current) != b.config.Remote {
+			_, err = b.git("remote", "set-url", "origin", b.config.Remote)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *GitBackend) Put(key string, r io.Reader) error {
+	err := b.files.Put(key, r)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.git("add", "--", filepath.FromSlash(key))
+
+	return err
+}
+
+func (b *GitBackend) Get(key string) (io.ReadCloser, error) {
+	return b.files.Get(key)
+}
+
+func (b *GitBackend) Delete(key string) error {
+	_, err := b.git("rm", "-q", "--cached", "--ignore-unmatch", "--", filepath.FromSlash(key))
+	if err != nil {
+		return err
+	}
+
+	return b.files.Delete(key)
+}
+
+func (b *GitBackend) List(prefix string) ([]ObjectInfo, error) {
+	objects, err := b.files.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// Never list the (non-bare) git dir itself
+	ret := objects[:0]
+	for _, o := range objects {
+		if !strings.HasPrefix(o.Key, ".git/") {
+			ret = append(ret, o)
+		}
+	}
+
+	return ret, nil
+}
+
+func (b *GitBackend) Stat(key string) (*ObjectInfo, error) {
+	return b.files.Stat(key)
+}
+
+// identity returns the options to commit as gnotes, if the user has not set a
+// name and email. Commits fail without them.
+func (b *GitBackend) identity() []string {
+	email, err := b.git("config", "user.email")
+	if err == nil && strings.TrimSpace(email) != "" {
+		return nil
+	}
+
+	return []string{"-c", "user.name=gnotes", "-c", "user.email=gnotes@localhost"}
+}
+
+// Commit will commit all the changes, and push them if a remote is set. Any
+// changes from other devices are merged first. If the remote can not be
+// reached (like when offline), the commits are pushed next time.
+func (b *GitBackend) Commit(message string) error {
+	// Exits with 1 if there are staged changes
+	_, err := b.git("diff", "--cached", "--quiet")
+	if err == nil {
+		log.Printf("git: nothing to commit")
+	} else {
+		_, err = b.git(append(b.identity(), "commit", "-q", "-m", message)...)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("git: committed: %s", message)
+	}
+
+	if b.config.Remote == "" {
+		return nil
+	}
+
+	fetched, err := b.fetch()
+	if err != nil {
+		log.Printf("git: remote unreachable, will push next time: %s", err)
+		return nil
+	}
+
+	if fetched {
+		err = b.merge()
+		if err != nil {
+			return err
+		}
+
+		// Nothing to push
+		_, err = b.git("merge-base", "--is-ancestor", "HEAD", "FETCH_HEAD")
+		if err == nil {
+			return nil
+		}
+	}
+
+	_, err = b.git("push", "-q", "origin", "HEAD:refs/heads/"+b.config.Branch)
+	if err != nil {
+		return fmt.Errorf("failed to push: %w", err)
+	}
+
+	return nil
+}
+
+// Pull will fetch and merge the remote, if theres one. If the remote can not
+// be reached (like when offline), the local checkout is used.
+func (b *GitBackend) Pull() error {
+	if b.config.Remote == "" {
+		return nil
+	}
+
+	_, err := b.git("rev-parse", "--git-dir")
+	if err != nil {
+		return fmt.Errorf("failed to open repository: %w", err)
+	}
+
+	fetched, err := b.fetch()
+	if err != nil {
+		log.Printf("git: remote unreachable, using the local checkout: %s", err)
+		return nil
+	}
+	if !fetched {
+		return nil
+	}
+
+	return b.merge()
+}
+
+// fetch will fetch the remote branch to FETCH_HEAD. Returns false if nothing
+// has been pushed yet.
+func (b *GitBackend) fetch() (bool, error) {
+	out, err := b.git("ls-remote", "--heads", "origin", b.config.Branch)
+	if err != nil {
+		return false, err
+	}
+	if strings.TrimSpace(out) == "" {
+		return false, nil
+	}
+
+	_, err = b.git("fetch", "-q", "origin", b.config.Branch)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// merge will merge FETCH_HEAD, fast-forwarding if it can. If both branches
+// changed the index, its merged with MergeIndex. Any other conflict is a
+// ErrDiverged, and the merge is aborted.
+func (b *GitBackend) merge() error {
+	_, err := b.git("rev-parse", "-q", "--verify", "HEAD")
+	if err != nil {
+		// Nothing committed yet, like a new device
+		_, err = b.git("merge", "-q", "--ff-only", "FETCH_HEAD")
+		return err
+	}
+
+	_, err = b.git("merge-base", "--is-ancestor", "FETCH_HEAD", "HEAD")
+	if err == nil {
+		// Already up to date
+		return nil
+	}
+
+	_, err = b.git("merge-base", "--is-ancestor", "HEAD", "FETCH_HEAD")
+	if err == nil {
+		_, err = b.git("merge", "-q", "--ff-only", "FETCH_HEAD")
+		return err
+	}
+
+	log.Printf("git: local and remote branch diverged, merging")
+
+	_, mergeErr := b.git(append(b.identity(), "merge", "-q", "--no-edit", "FETCH_HEAD")...)
+	if mergeErr == nil {
+		return nil
+	}
+
+	err = b.resolveConflicts()
+	if err != nil {
+		b.git("merge", "--abort")
+		return fmt.Errorf("failed to merge remote: %w", err)
+	}
+
+	_, err = b.git(append(b.identity(), "commit", "-q", "--no-edit")...)
+
+	return err
+}
+
+// resolveConflicts resolves the conflicts of a failed merge. The index is
+// merged, and the lock is taken from the remote (the lease is only for
+// a short time). Other objects can not be merged since they are encrypted.
+func (b *GitBackend) resolveConflicts() error {
+	out, err := b.git("diff", "-z", "--name-only", "--diff-filter=U")
+	if err != nil {
+		return err
+	}
+
+	var conflicts []string
+	indexDirs := map[string]bool{}
+
+	for _, key := range strings.Split(strings.TrimRight(out, "\x00"), "\x00") {
+		switch path.Base(key) {
+		case "":
+			continue
+		case "index.json", "index.json.sha256":
+			indexDirs[path.Dir(key)] = true
+		case "lock":
+			_, err = b.git("checkout", "--theirs", "--", filepath.FromSlash(key))
+			if err != nil {
+				return err
+			}
+			_, err = b.git("add", "--", filepath.FromSlash(key))
+			if err != nil {
+				return err
+			}
+		default:
+			conflicts = append(conflicts, key)
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%w: %s", ErrDiverged, strings.Join(conflicts, ", "))
+	}
+	if len(indexDirs) == 0 {
+		return fmt.Errorf("merge failed without conflicts")
+	}
+	if b.MergeIndex == nil {
+		return fmt.Errorf("%w: index.json", ErrDiverged)
+	}
+
+	for dir := range indexDirs {
+		err = b.mergeIndex(path.Join(dir, "index.json"))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeIndex merges the index at key from HEAD and MERGE_HEAD, and adds the
+// result.
+func (b *GitBackend) mergeIndex(key string) error {
+	show := func(rev string) []byte {
+		out, err := b.git("show", rev+":"+key)
+		if err != nil {
+			return nil
+		}
+		return []byte(out)
+	}
+
+	var base []byte
+	if out, err := b.git("merge-base", "HEAD", "MERGE_HEAD"); err == nil {
+		base = show(strings.TrimSpace(out))
+	}
+
+	local := show("HEAD")
+	remote := show("MERGE_HEAD")
+	if local == nil || remote == nil {
+		return fmt.Errorf("%w: %s", ErrDiverged, key)
+	}
+
+	index, sha, err := b.MergeIndex(base, local, remote)
+	if err != nil {
+		return fmt.Errorf("failed to merge index: %w", err)
+	}
+
+	err = b.Put(key, bytes.NewReader(index))
+	if err != nil {
+		return err
+	}
+
+	return b.Put(key+".sha256", bytes.NewReader(sha))
+}
@@ -0,0 +1,159 @@
+package gnotes
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gitLog(t *testing.T, gitDir string) []string {
+	out, err := exec.Command("git", "--git-dir", gitDir, "log", "--format=%s", "main").CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	return strings.Split(strings.TrimSpace(string(out)), "\n")
+}
+
+func TestGitBackend(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	remote := filepath.Join(dir, "remote.git")
+
+	// First device uses a normal repository
+	b, err := NewGitBackend(GitConfig{
+		Path:   filepath.Join(dir, "repo"),
+		Remote: "file://" + remote,
+	})
+	require.NoError(t, err)
+
+	// The remote must already exist
+	require.NoError(t, exec.Command("git", "init", "-q", "--bare", remote).Run())
+
+	// Nothing has been pushed yet
+	require.NoError(t, b.Pull())
+
+	app := newTestApp(t, b)
+	addNote(t, app, "git note\n")
+
+	assert.Equal(t, []string{"Update index (1 books)"}, gitLog(t, filepath.Join(dir, "repo", ".git")))
+	assert.Len(t, gitLog(t, remote), 1)
+
+	objects, err := b.List("test-user/")
+	require.NoError(t, err)
+	assert.Len(t, objects, 3)
+
+	// Nothing changed, so no new commit
+	require.NoError(t, b.Commit("empty"))
+	assert.Len(t, gitLog(t, remote), 1)
+
+	// Second device uses a bare repository, and pulls from the remote
+	other, err := NewGitBackend(GitConfig{
+		Path:     filepath.Join(dir, "other.git"),
+		Bare:     true,
+		WorkTree: filepath.Join(dir, "other-worktree"),
+		Remote:   "file://" + remote,
+	})
+	require.NoError(t, err)
+
+	otherApp := openTestApp(t, other)
+	require.Len(t, otherApp.Notes.Books[0].Notes, 1)
+	assert.Equal(t, "git note\n", readNote(t, otherApp, otherApp.Notes.Books[0].Notes[0]))
+
+	// Deleting is also a commit
+	require.NoError(t, otherApp.Notes.Books[0].DeleteNote(0))
+	require.NoError(t, otherApp.SaveIndexFile())
+	assert.Len(t, gitLog(t, remote), 2)
+	assert.Len(t, gitLog(t, filepath.Join(dir, "other.git")), 2)
+
+	// The local checkout is used if the remote can not be reached
+	require.NoError(t, os.Rename(remote, remote+".moved"))
+
+	self = app
+	require.NoError(t, app.LoadNotes())
+	assert.Len(t, app.Notes.Books[0].Notes, 1)
+
+	// But not if the repository is gone
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "other.git")))
+	assert.Error(t, other.Pull())
+}
+
+func TestGitDiverged(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	remote := filepath.Join(dir, "remote.git")
+	require.NoError(t, exec.Command("git", "init", "-q", "--bare", remote).Run())
+
+	newDevice := func(name string, open func(*testing.T, Backend) *SelfApp) *SelfApp {
+		b, err := NewGitBackend(GitConfig{
+			Path:   filepath.Join(dir, name),
+			Remote: "file://" + remote,
+		})
+		require.NoError(t, err)
+
+		app := open(t, b)
+		b.MergeIndex = app.mergeIndexObjects
+
+		return app
+	}
+
+	laptop := newDevice("laptop", newTestApp)
+	n := addNote(t, laptop, "one\n")
+
+	desktop := newDevice("desktop", openTestApp)
+	require.Len(t, desktop.Notes.Books[0].Notes, 1)
+
+	// The laptop saves while offline, so it is only committed locally
+	require.NoError(t, os.Rename(remote, remote+".moved"))
+	addNote(t, laptop, "from the laptop\n")
+	require.NoError(t, os.Rename(remote+".moved", remote))
+
+	// Then the desktop pushes, without knowing about the laptop
+	addNote(t, desktop, "from the desktop\n")
+
+	// The index is merged when pulling
+	self = laptop
+	require.NoError(t, laptop.LoadNotes())
+	assert.Len(t, laptop.Notes.Books[0].Notes, 3)
+
+	// And before pushing
+	addNote(t, desktop, "again from the desktop\n")
+	addNote(t, laptop, "again from the laptop\n")
+
+	self = desktop
+	require.NoError(t, desktop.LoadNotes())
+	assert.Len(t, desktop.Notes.Books[0].Notes, 5)
+	assert.Len(t, gitLog(t, remote), len(gitLog(t, filepath.Join(dir, "laptop", ".git"))))
+
+	// The same note changed on both can not be merged, they are encrypted
+	find := func(app *SelfApp) *Note {
+		for _, o := range app.Notes.Books[0].Notes {
+			if o.S3Path == n.S3Path {
+				return o
+			}
+		}
+		t.Fatalf("note not found: %s", n.S3Path)
+		return nil
+	}
+
+	require.NoError(t, os.Rename(remote, remote+".moved"))
+	editNote(t, laptop, find(laptop), "one from the laptop\n")
+	require.NoError(t, laptop.SaveIndexFile())
+	require.NoError(t, os.Rename(remote+".moved", remote))
+
+	readNote(t, desktop, find(desktop))
+	editNote(t, desktop, find(desktop), "one from the desktop\n")
+	require.NoError(t, desktop.SaveIndexFile())
+
+	self = laptop
+	assert.ErrorIs(t, laptop.LoadNotes(), ErrDiverged)
+}
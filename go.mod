@@ -5,24 +5,27 @@ go 1.18
 require (
 	github.com/aws/aws-sdk-go v1.38.45
 	github.com/fvbommel/sortorder v1.0.2
+	github.com/gdamore/tcell/v2 v2.6.0
 	github.com/google/uuid v1.3.0
 	github.com/rivo/tview v0.0.0-20230330183452-5796b0cd5c1f
 	github.com/spf13/pflag v1.0.5
 	github.com/stretchr/testify v1.8.1
 	github.com/wildwest-productions/goini v0.0.0-20211212231729-5862de93cb20
+	golang.org/x/crypto v0.6.0
+	golang.org/x/crypto v0.6.0
+	golang.org/x/net v0.7.0
+	golang.org/x/term v0.5.0
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/gdamore/encoding v1.0.0 // indirect
-	github.com/gdamore/tcell/v2 v2.6.0 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
 	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
 	github.com/mattn/go-runewidth v0.0.14 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/rivo/uniseg v0.4.3 // indirect
 	golang.org/x/sys v0.5.0 // indirect
-	golang.org/x/term v0.5.0 // indirect
 	golang.org/x/text v0.7.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,184 @@
+package gnotes
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memBackend is a in-memory backend used for testing.
+type memBackend struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{objects: map[string][]byte{}}
+}
+
+func (m *memBackend) Put(key string, r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = b
+
+	return nil
+}
+
+func (m *memBackend) Get(key string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+	}
+
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (m *memBackend) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+
+	return nil
+}
+
+func (m *memBackend) List(prefix string) ([]ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var objects []ObjectInfo
+	for k, b := range m.objects {
+		if strings.HasPrefix(k, prefix) {
+			objects = append(objects, ObjectInfo{Key: k, Size: int64(len(b)), Modified: time.Now()})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+
+	return objects, nil
+}
+
+func (m *memBackend) Stat(key string) (*ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+	}
+
+	return &ObjectInfo{Key: key, Size: int64(len(b)), Modified: time.Now()}, nil
+}
+
+// newTestApp returns a app with its own notes dir, and sets it as the global
+// app.
+func newTestApp(t *testing.T, backend Backend) *SelfApp {
+	app := &SelfApp{
+		Config: &Config{
+			App: appSettings{
+				NoteDir: t.TempDir(),
+			},
+			S3: S3Config{
+				UserID:   "test-user",
+				CryptKey: "DpiJ1QaSh25O1Kt3",
+			},
+		},
+		Backend: backend,
+		Notes: &NoteBook{
+			Books: []*Book{{Name: "Notes", Notes: []*Note{}, Selected: true}},
+		},
+	}
+
+	self = app
+
+	return app
+}
+
+// notePath returns the cached file of a note.
+func notePath(app *SelfApp, n *Note) string {
+	return filepath.Join(app.Config.App.NoteDir, "notes", n.S3Path)
+}
+
+// addNote creates a new note with content in the selected book, and uploads
+// it with the index.
+func addNote(t *testing.T, app *SelfApp, content string) *Note {
+	self = app
+
+	book := app.Notes.GetSelected()
+	require.NoError(t, book.NewNote(app.Config.App.NoteDir, nil))
+
+	i := len(book.Notes) - 1
+	require.NoError(t, os.WriteFile(notePath(app, book.Notes[i]), []byte(content), 0664))
+	require.NoError(t, book.SaveNoteIndex(i))
+	require.NoError(t, app.SaveIndexFile())
+
+	return book.Notes[i]
+}
+
+// editNote changes the content of a note, and uploads it. The index is not
+// saved.
+func editNote(t *testing.T, app *SelfApp, n *Note, content string) {
+	self = app
+
+	require.NoError(t, os.WriteFile(notePath(app, n), []byte(content), 0664))
+
+	for _, b := range app.Notes.Books {
+		for i, o := range b.Notes {
+			if o == n {
+				require.NoError(t, b.SaveNoteIndex(i))
+				return
+			}
+		}
+	}
+
+	t.Fatalf("note not found: %s", n.S3Path)
+}
+
+// openTestApp is newTestApp, with the index loaded from the backend, like a
+// second device.
+func openTestApp(t *testing.T, backend Backend) *SelfApp {
+	app := newTestApp(t, backend)
+	require.NoError(t, app.LoadNotes())
+
+	return app
+}
+
+// readNote downloads a note if needed, and returns its content.
+func readNote(t *testing.T, app *SelfApp, n *Note) string {
+	self = app
+
+	require.NoError(t, n.Download(app.Config.App.NoteDir))
+
+	b, err := os.ReadFile(notePath(app, n))
+	require.NoError(t, err)
+
+	return string(b)
+}
+
+// testSync creates a note on one device, and checks that a second device on
+// the same backend can read it. Returns both.
+func testSync(t *testing.T, backend Backend, content string) (*SelfApp, *SelfApp) {
+	app := newTestApp(t, backend)
+	addNote(t, app, content)
+
+	other := openTestApp(t, backend)
+	require.Len(t, other.Notes.Books[0].Notes, 1)
+	require.Equal(t, content, readNote(t, other, other.Notes.Books[0].Notes[0]))
+
+	return app, other
+}
@@ -0,0 +1,402 @@
+//
+//  index.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package gnotes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// indexFile returns the local index path.
+func (self *SelfApp) indexFile() string {
+	return filepath.Join(self.Config.App.NoteDir, "notes", "index.json")
+}
+
+// baseIndexFile returns the path to a copy of the last index that was
+// downloaded, or uploaded. Its what the local changes are based on, and is used
+// to tell what changed on each side when merging.
+func (self *SelfApp) baseIndexFile() string {
+	return filepath.Join(self.Config.App.NoteDir, "notes", "index.base.json")
+}
+
+// saveBaseIndex will remember b as the last known remote index.
+func (self *SelfApp) saveBaseIndex(b []byte) error {
+	err := writeFileAtomic(self.baseIndexFile(), b, 0664)
+	if err != nil {
+		return fmt.Errorf("failed to write base index: %w", err)
+	}
+
+	return nil
+}
+
+// loadBaseIndex reads the base index, upgraded like the local and remote ones
+// so they can be merged. Its missing on the first sync, then its empty, the
+// same as a merge with nothing deleted. The json is returned for its checksum.
+func (self *SelfApp) loadBaseIndex() (*NoteBook, []byte, error) {
+	b, err := os.ReadFile(self.baseIndexFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return &NoteBook{}, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read base index: %w", err)
+	}
+
+	base, err := self.parseIndex(b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read base index: %w", err)
+	}
+
+	return base, b, nil
+}
+
+// syncIndex uploads the local index file. If another device uploaded a index
+// since this one was downloaded, its downloaded and merged first, instead of
+// overwriting it. Returns true if the local index file was changed by a merge.
+func (self *SelfApp) syncIndex() (bool, error) {
+	noteIndex := self.indexFile()
+
+	localJson, err := os.ReadFile(noteIndex)
+	if err != nil {
+		return false, fmt.Errorf("failed to read index: %w", err)
+	}
+
+	local := &NoteBook{}
+	err = json.Unmarshal(localJson, local)
+	if err != nil {
+		return false, fmt.Errorf("failed to unmarshal index: %w", err)
+	}
+
+	base, baseJson, err := self.loadBaseIndex()
+	if err != nil {
+		return false, err
+	}
+
+	merged := false
+
+	remoteSha, err := self.downloadBytes(self.remotePath("index.json.sha256"))
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return false, fmt.Errorf("failed to check remote index: %w", err)
+	}
+
+	sha := strings.TrimSpace(string(remoteSha))
+	if err == nil && !Sum(baseJson).Matches(sha) {
+		// Someone else uploaded a index since we last synced
+		remoteJson, err := self.downloadBytes(self.remotePath("index.json"))
+		if err != nil {
+			return false, fmt.Errorf("failed to download remote index: %w", err)
+		}
+		if !Sum(remoteJson).Matches(sha) {
+			return false, self.quarantineBytes(remoteJson, self.remotePath("index.json"), sha)
+		}
+
+		remote, err := self.parseIndex(remoteJson)
+		if err != nil {
+			return false, fmt.Errorf("failed to read remote index: %w", err)
+		}
+
+		log.Printf("Remote index changed (generation %d -> %d), merging", base.Generation, remote.Generation)
+
+		local = mergeIndex(base, local, remote)
+		merged = true
+
+		if remote.Generation > local.Generation {
+			local.Generation = remote.Generation
+		}
+	}
+
+	return merged, self.uploadIndex(local)
+}
+
+// uploadIndex writes nb as the local index, and uploads it with its checksum.
+func (self *SelfApp) uploadIndex(nb *NoteBook) error {
+	noteIndex := self.indexFile()
+
+	nb.Generation++
+	nb.Version = indexVersion
+
+	b, err := json.Marshal(nb)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(noteIndex, b, 0664)
+	if err != nil {
+		return err
+	}
+
+	sha := Sum(b).String()
+	err = writeFileAtomic(noteIndex+".sha256", []byte(sha), 0664)
+	if err != nil {
+		return err
+	}
+
+	// There is still a small window where another device could upload between
+	// the check and here, but its much better then always overwriting.
+	err = self.UploadFile(noteIndex, self.remotePath("index.json"))
+	if err != nil {
+		return err
+	}
+	err = self.UploadFile(noteIndex+".sha256", self.remotePath("index.json.sha256"))
+	if err != nil {
+		return err
+	}
+
+	return self.saveBaseIndex(b)
+}
+
+// downloadBytes will download, and decrypt a small object into memory.
+func (self *SelfApp) downloadBytes(remote string) ([]byte, error) {
+	r, err := self.Backend.Get(remote)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	buf := bytes.NewBuffer(nil)
+
+	err = self.Config.S3.DecryptAndDeGzip(buf, r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt and de-gzip data: %s: %w", remote, err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// mergeIndexObjects is the IndexMergeFunc for the git backend. It decrypts the
+// index objects, and merges them the same as syncIndex.
+func (self *SelfApp) mergeIndexObjects(base, local, remote []byte) ([]byte, []byte, error) {
+	parse := func(b []byte) (*NoteBook, error) {
+		if b == nil {
+			return &NoteBook{}, nil
+		}
+
+		buf := bytes.NewBuffer(nil)
+		err := self.Config.S3.DecryptAndDeGzip(buf, bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+
+		return self.parseIndex(buf.Bytes())
+	}
+
+	encrypt := func(b []byte) ([]byte, error) {
+		buf := bytes.NewBuffer(nil)
+		err := self.Config.S3.GzipAndEncrypt(buf, bytes.NewReader(b))
+		return buf.Bytes(), err
+	}
+
+	var books [3]*NoteBook
+	for i, b := range [][]byte{base, local, remote} {
+		nb, err := parse(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		books[i] = nb
+	}
+
+	merged := mergeIndex(books[0], books[1], books[2])
+	if books[2].Generation > merged.Generation {
+		merged.Generation = books[2].Generation
+	}
+	merged.Generation++
+	merged.Version = indexVersion
+
+	b, err := json.Marshal(merged)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	index, err := encrypt(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sha, err := encrypt([]byte(Sum(b).String()))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return index, sha, nil
+}
+
+// mergeIndex does a three way merge of the local and remote index, base is the
+// index they both started from. Notes are matched by their path:
+//
+//   - Changed on both sides, the newest one is kept.
+//   - Only on one side, and not in the base, its new so its kept.
+//   - Only on one side, but in the base, it was deleted on the other side. It is
+//     only kept if it was changed since (so edits are never lost).
+//
+// Books are matched by name, and the local selection is kept.
+func mergeIndex(base, local, remote *NoteBook) *NoteBook {
+	type placed struct {
+		book string
+		note *Note
+	}
+
+	notesByPath := func(nb *NoteBook) map[string]placed {
+		m := map[string]placed{}
+		for _, b := range nb.Books {
+			for _, n := range b.Notes {
+				m[n.S3Path] = placed{book: b.Name, note: n}
+			}
+		}
+		return m
+	}
+
+	baseNotes := notesByPath(base)
+	localNotes := notesByPath(local)
+	remoteNotes := notesByPath(remote)
+
+	booksByName := func(nb *NoteBook) map[string]*Book {
+		m := map[string]*Book{}
+		for _, b := range nb.Books {
+			m[b.Name] = b
+		}
+		return m
+	}
+
+	baseBooks := booksByName(base)
+	localBooks := booksByName(local)
+	remoteBooks := booksByName(remote)
+
+	// Pick which version of every note to keep
+	keep := []placed{}
+
+	for _, b := range local.Books {
+		for _, n := range b.Notes {
+			l := localNotes[n.S3Path]
+			r, inRemote := remoteNotes[n.S3Path]
+			o, inBase := baseNotes[n.S3Path]
+
+			switch {
+			case inRemote:
+				if r.note.Modified > l.note.Modified {
+					keep = append(keep, r)
+				} else {
+					keep = append(keep, l)
+				}
+				keep[len(keep)-1].note.Revisions = mergeRevisions(l.note.Revisions, r.note.Revisions)
+			case !inBase || l.note.Modified > o.note.Modified:
+				// New, or edited here after being deleted remotely
+				keep = append(keep, l)
+			default:
+				log.Printf("Note was deleted remotely: %s", n.S3Path)
+			}
+		}
+	}
+
+	for _, b := range remote.Books {
+		for _, n := range b.Notes {
+			if _, ok := localNotes[n.S3Path]; ok {
+				continue
+			}
+
+			r := remoteNotes[n.S3Path]
+			o, inBase := baseNotes[n.S3Path]
+
+			if !inBase || r.note.Modified > o.note.Modified {
+				// New, or edited remotely after being deleted here
+				keep = append(keep, r)
+			}
+		}
+	}
+
+	// Now build the books, local ones first
+	merged := &NoteBook{Generation: local.Generation}
+	books := map[string]*Book{}
+
+	addBook := func(from *Book) *Book {
+		b := &Book{
+			Name:     from.Name,
+			Notes:    []*Note{},
+			Modified: from.Modified,
+			Selected: from.Selected,
+			Trash:    from.Trash,
+		}
+		if r, ok := remoteBooks[from.Name]; ok && r.Modified > b.Modified {
+			b.Modified = r.Modified
+		}
+		merged.Books = append(merged.Books, b)
+		books[b.Name] = b
+		return b
+	}
+
+	for _, b := range local.Books {
+		_, inBase := baseBooks[b.Name]
+		_, inRemote := remoteBooks[b.Name]
+		if inBase && !inRemote {
+			// Deleted remotely, only keep it if it will still have notes
+			continue
+		}
+		addBook(b)
+	}
+
+	for _, b := range remote.Books {
+		_, inBase := baseBooks[b.Name]
+		_, inLocal := localBooks[b.Name]
+		if inLocal || inBase {
+			continue
+		}
+		nb := addBook(b)
+		nb.Selected = false
+	}
+
+	for _, p := range keep {
+		b, ok := books[p.book]
+		if !ok {
+			// The book was deleted on one side, but still has new notes
+			from := localBooks[p.book]
+			if from == nil {
+				from = remoteBooks[p.book]
+			}
+			b = addBook(from)
+			b.Selected = false
+		}
+		b.Notes = append(b.Notes, p.note)
+	}
+
+	merged.Sort()
+
+	return merged
+}
+
+// mergeRevisions returns all the revisions from both a and b, oldest first.
+func mergeRevisions(a, b []*Revision) []*Revision {
+	seen := map[string]bool{}
+	merged := []*Revision{}
+
+	for _, r := range append(append([]*Revision{}, a...), b...) {
+		if seen[r.ID] {
+			continue
+		}
+		seen[r.ID] = true
+		merged = append(merged, r)
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].ID < merged[j].ID
+	})
+
+	if len(merged) == 0 {
+		return nil
+	}
+
+	return merged
+}
@@ -0,0 +1,92 @@
+package gnotes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func notePaths(nb *NoteBook) []string {
+	paths := []string{}
+	for _, b := range nb.Books {
+		for _, n := range b.Notes {
+			paths = append(paths, b.Name+"/"+n.S3Path)
+		}
+	}
+	return paths
+}
+
+func TestMergeIndex(t *testing.T) {
+	base := &NoteBook{Books: []*Book{
+		{Name: "Notes", Notes: []*Note{
+			{S3Path: "a", Modified: 1},
+			{S3Path: "b", Modified: 1},
+			{S3Path: "c", Modified: 1},
+		}},
+		{Name: "Old"},
+	}}
+
+	local := &NoteBook{Books: []*Book{
+		{Name: "Notes", Selected: true, Notes: []*Note{
+			{S3Path: "a", Modified: 3, Title: "local"},
+			{S3Path: "c", Modified: 1},
+			{S3Path: "local-new", Modified: 2},
+		}},
+		{Name: "Old"},
+	}}
+
+	remote := &NoteBook{Books: []*Book{
+		{Name: "Notes", Notes: []*Note{
+			{S3Path: "a", Modified: 2, Title: "remote"},
+			{S3Path: "b", Modified: 1},
+			{S3Path: "remote-new", Modified: 2},
+		}},
+		{Name: "Work", Notes: []*Note{
+			{S3Path: "work", Modified: 2},
+		}},
+	}}
+
+	merged := mergeIndex(base, local, remote)
+
+	// b was deleted locally, c remotely, and the "Old" book remotely
+	assert.ElementsMatch(t, []string{"Notes/a", "Notes/local-new", "Notes/remote-new", "Work/work"}, notePaths(merged))
+	assert.Len(t, merged.Books, 2)
+	assert.Equal(t, "Notes", merged.GetSelected().Name)
+
+	for _, n := range merged.Books[0].Notes {
+		if n.S3Path == "a" {
+			assert.Equal(t, "local", n.Title)
+		}
+	}
+
+	// A note edited after it was deleted on the other side is kept
+	local.Books[0].Notes[1].Modified = 5
+	merged = mergeIndex(base, local, remote)
+	assert.Contains(t, notePaths(merged), "Notes/c")
+}
+
+func TestSaveIndexFileMerges(t *testing.T) {
+	backend := newMemBackend()
+
+	laptop := newTestApp(t, backend)
+	require.NoError(t, laptop.Notes.GetSelected().NewNote(laptop.Config.App.NoteDir, nil))
+	require.NoError(t, laptop.SaveIndexFile())
+
+	desktop := openTestApp(t, backend)
+	laptop = openTestApp(t, backend)
+
+	// Both create a note at the same time
+	fromDesktop := addNote(t, desktop, "desktop\n").S3Path
+	fromLaptop := addNote(t, laptop, "laptop\n").S3Path
+
+	// The laptop saved last, so it should have merged the desktop note
+	assert.Len(t, laptop.Notes.GetSelected().Notes, 3)
+
+	other := openTestApp(t, backend)
+	paths := notePaths(other.Notes)
+	assert.Contains(t, paths, "Notes/"+fromDesktop)
+	assert.Contains(t, paths, "Notes/"+fromLaptop)
+	assert.Len(t, paths, 3)
+	assert.Equal(t, int64(3), other.Notes.Generation)
+}
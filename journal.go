@@ -0,0 +1,295 @@
+//
+//  journal.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package gnotes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The journal records the note uploads, and index upload that are in flight.
+// A note is uploaded before the index that points to it, so if gnotes crashes
+// in between, the next start can finish the save (add the uploaded version to
+// the index), or roll it back (keep the local changes to upload again).
+
+// journalMu protects the journal file, since notes can be saved concurrently.
+var journalMu sync.Mutex
+
+type journal struct {
+	// Notes are the notes uploaded since the local index was last written.
+	Notes []*journalNote `json:"notes,omitempty"`
+
+	// Index is true while the index is being written, and uploaded.
+	Index bool `json:"index,omitempty"`
+}
+
+type journalNote struct {
+	// Book is the book the note was in.
+	Book string `json:"book"`
+
+	// Note is a copy of the note, with the hash of what is being uploaded.
+	Note *Note `json:"note"`
+}
+
+func (self *SelfApp) journalFile() string {
+	return filepath.Join(self.Config.App.NoteDir, "journal.json")
+}
+
+func (self *SelfApp) loadJournal() (*journal, error) {
+	j := &journal{}
+
+	b, err := os.ReadFile(self.journalFile())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return j, nil
+		}
+		return nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+
+	err = json.Unmarshal(b, j)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse journal: %w", err)
+	}
+
+	return j, nil
+}
+
+func (self *SelfApp) saveJournal(j *journal) error {
+	if len(j.Notes) == 0 && !j.Index {
+		err := os.Remove(self.journalFile())
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove journal: %w", err)
+		}
+		return nil
+	}
+
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(self.journalFile(), b, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+
+	return nil
+}
+
+// updateJournal loads the journal, calls fn to change it, then saves it.
+func (self *SelfApp) updateJournal(fn func(j *journal)) error {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+
+	j, err := self.loadJournal()
+	if err != nil {
+		return err
+	}
+
+	fn(j)
+
+	return self.saveJournal(j)
+}
+
+// journalUpload records that a note is being uploaded, with the checksum of
+// the new version.
+func (self *SelfApp) journalUpload(n *Note, hash string) error {
+	entry := &journalNote{Note: &Note{}}
+	*entry.Note = *n
+	entry.Note.Hash = hash
+
+	if b := self.Notes.bookOf(n); b != nil {
+		entry.Book = b.Name
+	}
+
+	return self.updateJournal(func(j *journal) {
+		notes := j.Notes[:0]
+		for _, e := range j.Notes {
+			if e.Note.S3Path != n.S3Path {
+				notes = append(notes, e)
+			}
+		}
+		j.Notes = append(notes, entry)
+	})
+}
+
+// recoverIndex queues the local index to be uploaded again, if it was being
+// uploaded when gnotes crashed. Must be called before the index is
+// downloaded, so the local index is used instead.
+func (self *SelfApp) recoverIndex() error {
+	j, err := self.loadJournal()
+	if err != nil {
+		return err
+	}
+
+	if !j.Index {
+		return nil
+	}
+
+	_, err = os.Stat(self.indexFile())
+	if err == nil {
+		log.Printf("Index upload was interrupted, uploading it again")
+
+		err = self.enqueuePut(self.indexFile(), self.remotePath("index.json"), false)
+		if err != nil {
+			return err
+		}
+	}
+
+	return self.updateJournal(func(j *journal) {
+		j.Index = false
+	})
+}
+
+// recoverJournal finishes, or rolls back the note uploads that were
+// interrupted. Must be called after the index is loaded.
+func (self *SelfApp) recoverJournal() error {
+	j, err := self.loadJournal()
+	if err != nil {
+		return err
+	}
+
+	if len(j.Notes) == 0 {
+		return nil
+	}
+
+	keep := []*journalNote{}
+	for _, e := range j.Notes {
+		done, err := self.recoverNote(e)
+		if err != nil {
+			// Probably offline, try again next time
+			log.Printf("Failed to recover interrupted upload of %s: %s", e.Note.S3Path, err)
+			keep = append(keep, e)
+			continue
+		}
+		if !done {
+			keep = append(keep, e)
+		}
+	}
+
+	return self.updateJournal(func(j *journal) {
+		j.Notes = keep
+	})
+}
+
+// recoverNote finishes, or rolls back a interrupted note upload. Returns true
+// if the journal entry is not needed anymore, otherwise its kept until the
+// index is saved.
+func (self *SelfApp) recoverNote(e *journalNote) (bool, error) {
+	var n *Note
+	var book *Book
+	for _, b := range self.Notes.Books {
+		for _, o := range b.Notes {
+			if o.S3Path == e.Note.S3Path {
+				n, book = o, b
+			}
+		}
+	}
+
+	if n != nil && n.Hash == e.Note.Hash {
+		// The index was saved
+		return true, nil
+	}
+
+	uploaded := false
+	var deltas []string
+
+	if self.putPending(self.remotePath(e.Note.S3Path)) {
+		// Will be uploaded by the queue, as a whole note
+		uploaded = true
+	} else {
+		head, _, err := self.remoteHead(e.Note)
+		if err != nil && !errors.Is(err, ErrObjectNotFound) {
+			return false, err
+		}
+		if err == nil && head.Hash == e.Note.Hash {
+			uploaded = true
+			deltas = head.Deltas
+		}
+	}
+
+	if !uploaded {
+		if n != nil {
+			// The remote note did not change, the local changes are still in
+			// the cache, and will be uploaded next time
+			log.Printf("Rolled back interrupted upload of: %s", e.Note.S3Path)
+			return true, nil
+		}
+
+		// A new note that was never uploaded, add it back so its uploaded
+		// next time
+		n = e.Note
+		n.Hash = ""
+		n.Deltas = nil
+	} else if n == nil {
+		n = e.Note
+		n.Deltas = deltas
+	} else {
+		n.Hash = e.Note.Hash
+		n.Deltas = deltas
+		n.Revisions = e.Note.Revisions
+		n.Modified = e.Note.Modified
+	}
+
+	if book == nil {
+		book = self.Notes.findBook(e.Book)
+		book.Notes = append(book.Notes, n)
+	}
+	book.Changed(-1)
+
+	if uploaded && !n.IsAttachment && self.cachedSum(n).Matches(n.Hash) {
+		err := self.saveBaseFromCache(n.S3Path)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	log.Printf("Recovered interrupted upload of: %s", n.S3Path)
+
+	self.IndexNeedsUpdating = true
+
+	return false, nil
+}
+
+// findBook returns the book with the name, creating it if needed.
+func (nb *NoteBook) findBook(name string) *Book {
+	if name == "" {
+		name = "Notes"
+	}
+
+	for _, b := range nb.Books {
+		if b.Name == name {
+			return b
+		}
+	}
+
+	b := &Book{Name: name, Notes: []*Note{}}
+	nb.Books = append(nb.Books, b)
+
+	return b
+}
+
+// cachedSum returns the checksum of the cached note, or a empty checksum if
+// its not cached.
+func (self *SelfApp) cachedSum(n *Note) Checksum {
+	sum, err := SumFile(filepath.Join(self.Config.App.NoteDir, "notes", n.S3Path))
+	if err != nil {
+		return Checksum{}
+	}
+
+	return sum
+}
@@ -0,0 +1,82 @@
+package gnotes
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.json")
+
+	require.NoError(t, writeFileAtomic(path, []byte("one"), 0600))
+	require.NoError(t, writeFileAtomic(path, []byte("two"), 0600))
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "two", string(b))
+
+	// No tmp files are left
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestJournalRecovery(t *testing.T) {
+	backend := newMemBackend()
+
+	app := newTestApp(t, backend)
+	edited := addNote(t, app, "v1\n")
+	assert.NoFileExists(t, app.journalFile())
+
+	// Edit a note, and create a new one, then "crash" before the index is
+	// saved
+	editNote(t, app, edited, "v2\n")
+	book := app.Notes.GetSelected()
+	require.NoError(t, book.NewNote(app.Config.App.NoteDir, nil))
+	created := book.Notes[1]
+	editNote(t, app, created, "new\n")
+	assert.FileExists(t, app.journalFile())
+
+	restarted := newTestApp(t, backend)
+	restarted.Config.App.NoteDir = app.Config.App.NoteDir
+	require.NoError(t, restarted.LoadNotes())
+
+	notes := restarted.Notes.Books[0].Notes
+	require.Len(t, notes, 2)
+	for _, n := range notes {
+		switch n.S3Path {
+		case edited.S3Path:
+			assert.Equal(t, Sum([]byte("v2\n")).String(), n.Hash)
+		case created.S3Path:
+			assert.Equal(t, Sum([]byte("new\n")).String(), n.Hash)
+		}
+	}
+	assert.True(t, restarted.IndexNeedsUpdating)
+
+	require.NoError(t, restarted.SaveIndexFile())
+	assert.NoFileExists(t, restarted.journalFile())
+
+	// A interrupted index upload is done again
+	restarted.Notes.NewBook("Work")
+	b, err := json.Marshal(restarted.Notes)
+	require.NoError(t, err)
+	require.NoError(t, writeFileAtomic(restarted.indexFile(), b, 0664))
+	require.NoError(t, restarted.updateJournal(func(j *journal) { j.Index = true }))
+
+	other := openTestApp(t, backend)
+	assert.Len(t, other.Notes.Books, 1)
+
+	self = restarted
+	require.NoError(t, restarted.LoadNotes())
+	assert.Len(t, restarted.Notes.Books, 2)
+
+	self = other
+	require.NoError(t, os.Remove(other.indexFile()))
+	require.NoError(t, other.LoadNotes())
+	assert.Len(t, other.Notes.Books, 2)
+}
@@ -0,0 +1,179 @@
+//
+//  local.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package gnotes
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// localTmpPrefix is the prefix for partially written objects, they are
+// ignored when listing.
+const localTmpPrefix = ".gnotes-tmp-"
+
+// LocalBackend stores all the objects in a local directory, like a NAS mount
+// or a Syncthing/Dropbox folder. The objects are the exact same (encrypted)
+// objects that would be uploaded to S3.
+type LocalBackend struct {
+	root string
+}
+
+func NewLocalBackend(c LocalConfig) (*LocalBackend, error) {
+	if c.Path == "" {
+		return nil, fmt.Errorf("local: path cannot be empty")
+	}
+
+	err := os.MkdirAll(c.Path, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create local backend dir: %w", err)
+	}
+
+	return &LocalBackend{root: c.Path}, nil
+}
+
+func (b *LocalBackend) path(key string) string {
+	return filepath.Join(b.root, filepath.FromSlash(key))
+}
+
+func (b *LocalBackend) Put(key string, r io.Reader) error {
+	file := b.path(key)
+
+	err := os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create dir: %w", err)
+	}
+
+	// Write to a tmp file first, so other programs syncing this dir never see
+	// a partial object.
+	tmp, err := os.CreateTemp(filepath.Dir(file), localTmpPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to create tmp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write object: %s: %w", key, err)
+	}
+
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync object: %s: %w", key, err)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), file)
+	if err != nil {
+		return fmt.Errorf("failed to write object: %s: %w", key, err)
+	}
+
+	return nil
+}
+
+func (b *LocalBackend) Get(key string) (io.ReadCloser, error) {
+	f, err := os.Open(b.path(key))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+		}
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (b *LocalBackend) Delete(key string) error {
+	file := b.path(key)
+
+	err := os.Remove(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete object: %s: %w", key, err)
+	}
+
+	// Cleanup any empty parent dirs, like S3 would. Remove fails for non-empty
+	// dirs, so stop there.
+	for dir := filepath.Dir(file); dir != b.root && strings.HasPrefix(dir, b.root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (b *LocalBackend) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	err := filepath.WalkDir(b.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), localTmpPrefix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(b.root, path)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		objects = append(objects, ObjectInfo{
+			Key:      key,
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %s: %w", prefix, err)
+	}
+
+	return objects, nil
+}
+
+func (b *LocalBackend) Stat(key string) (*ObjectInfo, error) {
+	info, err := os.Stat(b.path(key))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+		}
+		return nil, err
+	}
+
+	return &ObjectInfo{
+		Key:      key,
+		Size:     info.Size(),
+		Modified: info.ModTime(),
+	}, nil
+}
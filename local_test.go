@@ -0,0 +1,66 @@
+package gnotes
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalBackend(t *testing.T) {
+	dir := t.TempDir()
+
+	b, err := NewLocalBackend(LocalConfig{Path: dir})
+	require.NoError(t, err)
+
+	key := "user/notes/Notes/uuid-1/content"
+
+	require.NoError(t, b.Put(key, strings.NewReader("foo bar")))
+	require.NoError(t, b.Put("user/notes/index.json", strings.NewReader("{}")))
+
+	assert.FileExists(t, filepath.Join(dir, "user", "notes", "Notes", "uuid-1", "content"))
+
+	r, err := b.Get(key)
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "foo bar", string(data))
+
+	info, err := b.Stat(key)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), info.Size)
+
+	objects, err := b.List("user/notes/Notes/")
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+	assert.Equal(t, key, objects[0].Key)
+
+	require.NoError(t, b.Delete(key))
+
+	_, err = b.Get(key)
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+	_, err = b.Stat(key)
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+
+	// Empty dirs should be cleaned up, but not the root
+	assert.NoDirExists(t, filepath.Join(dir, "user", "notes", "Notes"))
+	assert.FileExists(t, filepath.Join(dir, "user", "notes", "index.json"))
+
+	// Deleting a missing object is not a error
+	assert.NoError(t, b.Delete(key))
+
+	_, err = os.Stat(dir)
+	assert.NoError(t, err)
+}
+
+func TestLocalBackendSync(t *testing.T) {
+	b, err := NewLocalBackend(LocalConfig{Path: t.TempDir()})
+	require.NoError(t, err)
+
+	testSync(t, b, "offline note\n")
+}
@@ -0,0 +1,365 @@
+//
+//  lock.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package gnotes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// defaultLockLease is how many seconds the remote lock is held for, if not set
+// in the config file. Its renewed every third of that while the lock is held.
+const defaultLockLease = 300
+
+// ErrLocked is returned by AcquireLock if another gnotes has the notes open.
+var ErrLocked = errors.New("notes are open in another gnotes")
+
+// ErrReadOnly is returned when changing the notes, if they were opened
+// read-only (because another gnotes has them open).
+var ErrReadOnly = errors.New("notes are open read-only")
+
+// lockInfo is who has the lock, its stored in the local lock file, and the
+// remote lease object.
+type lockInfo struct {
+	PID     int    `json:"pid"`
+	Host    string `json:"host"`
+	Token   string `json:"token"`
+	Started int64  `json:"started"`
+
+	// Expires is only used for the remote lease.
+	Expires int64 `json:"expires,omitempty"`
+}
+
+func (l *lockInfo) String() string {
+	return fmt.Sprintf("pid %d on %s, since %s", l.PID, l.Host, time.Unix(l.Started, 0).Format("2006-01-02 15:04:05"))
+}
+
+// LockedError is returned by AcquireLock, with who has the lock.
+type LockedError struct {
+	holder *lockInfo
+	remote bool
+}
+
+func (e *LockedError) Error() string {
+	if e.remote {
+		return fmt.Sprintf("%s (remote lock held by %s)", ErrLocked, e.holder)
+	}
+	return fmt.Sprintf("%s (%s)", ErrLocked, e.holder)
+}
+
+func (e *LockedError) Unwrap() error {
+	return ErrLocked
+}
+
+func (self *SelfApp) lockFile() string {
+	return filepath.Join(self.Config.App.NoteDir, "gnotes.lock")
+}
+
+// AcquireLock locks the notes dir, so only one gnotes can change the notes at
+// a time. With remote_lock, a lease object is also put on the backend, for
+// other devices. Returns a ErrLocked error if another gnotes has the lock, the
+// notes should then be opened read-only.
+func (self *SelfApp) AcquireLock() error {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	info := &lockInfo{
+		PID:     os.Getpid(),
+		Host:    host,
+		Token:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Started: time.Now().Unix(),
+	}
+
+	err = self.acquireLocalLock(info)
+	if err != nil {
+		return err
+	}
+
+	if self.Config.App.RemoteLock {
+		err = self.acquireLease(info)
+		if err != nil {
+			os.Remove(self.lockFile())
+			return err
+		}
+	}
+
+	self.lock = info
+
+	if self.Config.App.RemoteLock {
+		self.startLeaseRenewal(info)
+	}
+
+	return nil
+}
+
+// ReleaseLock releases the locks from AcquireLock.
+func (self *SelfApp) ReleaseLock() {
+	if self.lock == nil {
+		return
+	}
+
+	if self.stopRenew != nil {
+		close(self.stopRenew)
+		self.stopRenew = nil
+		self.renewWG.Wait()
+	}
+
+	if self.Config.App.RemoteLock {
+		holder, err := self.readLease()
+		if err == nil && holder.Token == self.lock.Token {
+			err = self.DeleteFile(self.leasePath())
+			if err != nil {
+				log.Printf("Failed to release remote lock: %s", err)
+			}
+		}
+	}
+
+	err := os.Remove(self.lockFile())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Failed to remove lock file: %s", err)
+	}
+
+	self.lock = nil
+}
+
+func (self *SelfApp) acquireLocalLock(info *lockInfo) error {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(self.Config.App.NoteDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	// Try twice, incase there is a stale lock to remove
+	for i := 0; i < 2; i++ {
+		f, err := os.OpenFile(self.lockFile(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.Write(b)
+			closeErr := f.Close()
+			if err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(self.lockFile())
+				return fmt.Errorf("failed to write lock file: %w", err)
+			}
+			return nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("failed to create lock file: %w", err)
+		}
+
+		holder := &lockInfo{}
+		b, err := os.ReadFile(self.lockFile())
+		if err == nil {
+			err = json.Unmarshal(b, holder)
+		}
+		if err == nil && !holder.stale(info.Host) {
+			return &LockedError{holder: holder}
+		}
+
+		// Left over from a crash
+		log.Printf("Removing stale lock file: %s", holder)
+
+		err = os.Remove(self.lockFile())
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove stale lock file: %w", err)
+		}
+	}
+
+	return fmt.Errorf("failed to create lock file: %w", os.ErrExist)
+}
+
+// stale returns true if the process that has the lock is not running anymore.
+// A lock from another host is never stale, since it can not be checked.
+func (l *lockInfo) stale(host string) bool {
+	if l.Host != host {
+		return false
+	}
+	if l.PID == os.Getpid() {
+		// Can only be from a older process with the same pid
+		return true
+	}
+
+	return !processAlive(l.PID)
+}
+
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	err = p.Signal(syscall.Signal(0))
+
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+func (self *SelfApp) leasePath() string {
+	return self.remotePath("lock")
+}
+
+func (self *SelfApp) leaseDuration() time.Duration {
+	lease := self.Config.App.LockLease
+	if lease <= 0 {
+		lease = defaultLockLease
+	}
+
+	return time.Duration(lease) * time.Second
+}
+
+func (self *SelfApp) readLease() (*lockInfo, error) {
+	b, err := self.downloadBytes(self.leasePath())
+	if err != nil {
+		return nil, err
+	}
+
+	holder := &lockInfo{}
+	err = json.Unmarshal(b, holder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse remote lock: %w", err)
+	}
+
+	return holder, nil
+}
+
+func (self *SelfApp) writeLease(info *lockInfo) error {
+	lease := *info
+	lease.Expires = time.Now().Add(self.leaseDuration()).Unix()
+
+	b, err := json.Marshal(&lease)
+	if err != nil {
+		return err
+	}
+
+	err = self.uploadBytes(self.leasePath(), b)
+	if err != nil {
+		return fmt.Errorf("failed to write remote lock: %w", err)
+	}
+
+	return nil
+}
+
+// acquireLease puts the remote lease object, if no other device has it.
+func (self *SelfApp) acquireLease(info *lockInfo) error {
+	holder, err := self.readLease()
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		// Probably offline, the local lock is enough
+		log.Printf("Failed to check remote lock: %s", err)
+		return nil
+	}
+	if err == nil && holder.Token != info.Token && holder.Expires > time.Now().Unix() {
+		return &LockedError{holder: holder, remote: true}
+	}
+
+	err = self.writeLease(info)
+	if err != nil {
+		log.Printf("%s", err)
+		return nil
+	}
+
+	// The backend has no compare-and-swap, so make sure another device did
+	// not take it at the same time.
+	holder, err = self.readLease()
+	if err == nil && holder.Token != info.Token {
+		return &LockedError{holder: holder, remote: true}
+	}
+
+	return nil
+}
+
+// startLeaseRenewal renews the remote lease every third of the lease, until
+// ReleaseLock is called.
+func (self *SelfApp) startLeaseRenewal(info *lockInfo) {
+	done := make(chan struct{})
+	self.stopRenew = done
+
+	interval := self.leaseDuration() / 3
+
+	self.renewWG.Add(1)
+	go func() {
+		defer self.renewWG.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			if !self.renewLease(info) {
+				return
+			}
+		}
+	}()
+}
+
+// renewLease renews the remote lease. Returns false if another device took it
+// (like if this one was offline for longer then the lease), the notes are then
+// changed to read-only, see checkLease.
+func (self *SelfApp) renewLease(info *lockInfo) bool {
+	self.leaseMu.Lock()
+	defer self.leaseMu.Unlock()
+
+	holder, err := self.readLease()
+	if err == nil && holder.Token != info.Token {
+		log.Printf("WARNING: remote lock was taken by %s, changing to read-only", holder)
+		atomic.StoreInt32(&self.leaseLost, 1)
+		return false
+	}
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		// Probably offline, try again next time
+		log.Printf("Failed to renew remote lock: %s", err)
+		return true
+	}
+
+	err = self.writeLease(info)
+	if err != nil {
+		log.Printf("%s", err)
+	}
+
+	return true
+}
+
+// checkLease changes to read-only if the remote lease was lost.
+func (self *SelfApp) checkLease() {
+	if atomic.LoadInt32(&self.leaseLost) == 1 && !self.ReadOnly {
+		self.ReadOnly = true
+	}
+}
+
+// checkWritable returns ErrReadOnly if the notes were opened read-only.
+func (self *SelfApp) checkWritable() error {
+	self.checkLease()
+
+	if self.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package gnotes
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalLock(t *testing.T) {
+	app := newTestApp(t, newMemBackend())
+	lockFile := filepath.Join(app.Config.App.NoteDir, "gnotes.lock")
+
+	host, err := os.Hostname()
+	require.NoError(t, err)
+	writeLock := func(pid int) {
+		b, err := json.Marshal(&lockInfo{PID: pid, Host: host})
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(lockFile, b, 0644))
+	}
+
+	require.NoError(t, app.AcquireLock())
+	assert.FileExists(t, lockFile)
+	app.ReleaseLock()
+	assert.NoFileExists(t, lockFile)
+
+	// Another gnotes that is still running, like the parent process
+	writeLock(os.Getppid())
+	err = app.AcquireLock()
+	assert.ErrorIs(t, err, ErrLocked)
+
+	// A lock from a process that is not running anymore is removed
+	cmd := exec.Command("true")
+	require.NoError(t, cmd.Run())
+	writeLock(cmd.Process.Pid)
+
+	require.NoError(t, app.AcquireLock())
+	app.ReleaseLock()
+}
+
+func TestRemoteLock(t *testing.T) {
+	backend := newMemBackend()
+
+	laptop := newTestApp(t, backend)
+	laptop.Config.App.RemoteLock = true
+	require.NoError(t, laptop.AcquireLock())
+
+	desktop := newTestApp(t, backend)
+	desktop.Config.App.RemoteLock = true
+	err := desktop.AcquireLock()
+	assert.ErrorIs(t, err, ErrLocked)
+
+	// Its released on exit
+	self = laptop
+	laptop.ReleaseLock()
+	self = desktop
+	require.NoError(t, desktop.AcquireLock())
+
+	// Or expires if gnotes crashed
+	desktop.ReleaseLock()
+	desktop.Config.App.LockLease = 1
+	require.NoError(t, desktop.writeLease(&lockInfo{PID: 1, Host: "desktop", Token: "old"}))
+	assert.ErrorIs(t, laptop.AcquireLock(), ErrLocked)
+
+	time.Sleep(1100 * time.Millisecond)
+	require.NoError(t, laptop.AcquireLock())
+	laptop.ReleaseLock()
+}
+
+func TestLeaseRenewal(t *testing.T) {
+	backend := newMemBackend()
+
+	laptop := newTestApp(t, backend)
+	laptop.Config.App.RemoteLock = true
+	laptop.Config.App.LockLease = 2
+	require.NoError(t, laptop.AcquireLock())
+	defer laptop.ReleaseLock()
+
+	// Still held after the lease, while idle
+	time.Sleep(2500 * time.Millisecond)
+
+	desktop := newTestApp(t, backend)
+	desktop.Config.App.RemoteLock = true
+	desktop.Config.App.LockLease = 2
+	assert.ErrorIs(t, desktop.AcquireLock(), ErrLocked)
+
+	// Another device takes it, like if the laptop was offline for too long
+	require.NoError(t, desktop.writeLease(&lockInfo{PID: 1, Host: "desktop", Token: "desktop"}))
+	time.Sleep(1 * time.Second)
+
+	self = laptop
+	assert.ErrorIs(t, laptop.checkWritable(), ErrReadOnly)
+	assert.True(t, laptop.ReadOnly)
+
+	// The lease is not taken back
+	holder, err := laptop.readLease()
+	require.NoError(t, err)
+	assert.Equal(t, "desktop", holder.Token)
+}
+
+func TestReadOnly(t *testing.T) {
+	backend := newMemBackend()
+
+	app := newTestApp(t, backend)
+	n := addNote(t, app, "hello\n")
+
+	indexBefore, err := os.ReadFile(app.indexFile())
+	require.NoError(t, err)
+
+	// Open the same notes dir read-only
+	ro := newTestApp(t, backend)
+	ro.Config.App.NoteDir = app.Config.App.NoteDir
+	ro.ReadOnly = true
+	require.NoError(t, ro.LoadNotes())
+	require.Len(t, ro.Notes.Books[0].Notes, 1)
+
+	require.NoError(t, os.WriteFile(notePath(app, n), []byte("changed\n"), 0664))
+	assert.ErrorIs(t, ro.Notes.Books[0].SaveNoteIndex(0), ErrReadOnly)
+	assert.ErrorIs(t, ro.Notes.Books[0].DeleteNote(0), ErrReadOnly)
+
+	ro.IndexNeedsUpdating = true
+	assert.ErrorIs(t, ro.SaveIndexFile(), ErrReadOnly)
+
+	// The local index was not touched
+	indexAfter, err := os.ReadFile(app.indexFile())
+	require.NoError(t, err)
+	assert.Equal(t, indexBefore, indexAfter)
+}
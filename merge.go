@@ -0,0 +1,398 @@
+//
+//  merge.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package gnotes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// noteConflict is a note that was changed differently on both sides, see
+// resolveConflict.
+type noteConflict struct {
+	n      *Note
+	local  []byte
+	remote []byte
+}
+
+// baseFile returns the path to the last synced copy of a note. Its what the
+// local edits are based on, and is used to merge them with remote edits.
+func (self *SelfApp) baseFile(s3Path string) string {
+	return filepath.Join(self.Config.App.NoteDir, "base", s3Path)
+}
+
+// baseSum returns the checksum of the last synced copy of a note, or a empty
+// checksum if there is none.
+func (self *SelfApp) baseSum(s3Path string) Checksum {
+	sum, err := SumFile(self.baseFile(s3Path))
+	if err != nil {
+		return Checksum{}
+	}
+
+	return sum
+}
+
+// saveBase will remember the contents of a note as the last synced copy.
+func (self *SelfApp) saveBase(s3Path string, b []byte) error {
+	path := self.baseFile(s3Path)
+
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create base dir: %w", err)
+	}
+
+	err = os.WriteFile(path, b, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write base copy: %w", err)
+	}
+
+	return nil
+}
+
+// saveBaseFromCache will copy the local cached note as the last synced copy.
+func (self *SelfApp) saveBaseFromCache(s3Path string) error {
+	b, err := os.ReadFile(filepath.Join(self.Config.App.NoteDir, "notes", s3Path))
+	if err != nil {
+		return err
+	}
+
+	return self.saveBase(s3Path, b)
+}
+
+// removeBase removes the last synced copy of a note, like when its deleted.
+func (self *SelfApp) removeBase(s3Path string) error {
+	err := os.RemoveAll(filepath.Dir(self.baseFile(s3Path)))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// mergeNote merges the remote version of a note into the local cached note,
+// when both changed since the last sync. If they can not be merged, the local
+// version is saved as a new "conflict copy" note in the same book, and the
+// note is set to the remote version. Returns true if the local note needs to
+// be uploaded.
+func (self *SelfApp) mergeNote(n *Note, remote []byte) (bool, error) {
+	upload, conflict, err := self.tryMergeNote(n, remote)
+	if err != nil || conflict == nil {
+		return upload, err
+	}
+
+	return false, self.resolveConflict(conflict)
+}
+
+// tryMergeNote is the same as mergeNote, but only changes the note itself. If
+// they can not be merged, the conflict is returned, and nothing is changed.
+// Its safe to call for different notes at the same time.
+func (self *SelfApp) tryMergeNote(n *Note, remote []byte) (bool, *noteConflict, error) {
+	noteFile := filepath.Join(self.Config.App.NoteDir, "notes", n.S3Path)
+
+	local, err := os.ReadFile(noteFile)
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to read local note: %w", err)
+	}
+
+	// A missing base is the same as the note being empty
+	base, err := os.ReadFile(self.baseFile(n.S3Path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, nil, fmt.Errorf("failed to read base note: %w", err)
+	}
+
+	merged, ok := merge3(string(base), string(local), string(remote))
+	if !ok {
+		return false, &noteConflict{n: n, local: local, remote: remote}, nil
+	}
+
+	log.Printf("Merged local and remote changes: %s", n.S3Path)
+
+	err = os.WriteFile(noteFile, []byte(merged), 0664)
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to write merged note: %w", err)
+	}
+
+	n.Hash = Sum(remote).String()
+
+	return true, nil, self.saveBase(n.S3Path, remote)
+}
+
+// resolveConflict saves the local version of a conflicting note as a new
+// "conflict copy" note, and sets the note to the remote version. This changes
+// the index, so its never called for more then one note at a time.
+func (self *SelfApp) resolveConflict(c *noteConflict) error {
+	n := c.n
+	noteFile := filepath.Join(self.Config.App.NoteDir, "notes", n.S3Path)
+
+	log.Printf("Conflicting changes, creating a conflict copy: %s", n.S3Path)
+
+	err := self.newConflictCopy(n, c.local)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(noteFile, c.remote, 0664)
+	if err != nil {
+		return fmt.Errorf("failed to write remote note: %w", err)
+	}
+
+	n.Hash = Sum(c.remote).String()
+
+	return self.saveBase(n.S3Path, c.remote)
+}
+
+// resolveConflicts resolves the conflicts from downloading notes in the
+// background, one at a time since they change the index.
+func (self *SelfApp) resolveConflicts(conflicts []*noteConflict) error {
+	var failed []error
+	for _, c := range conflicts {
+		err := self.resolveConflict(c)
+		if err != nil {
+			log.Printf("Failed to resolve conflict: %s: %s", c.n.S3Path, err)
+			failed = append(failed, err)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to resolve %d conflicts: %w", len(failed), failed[0])
+	}
+
+	return nil
+}
+
+// newConflictCopy creates a new note in the same book as n, with the local
+// contents.
+func (self *SelfApp) newConflictCopy(n *Note, local []byte) error {
+	book := self.Notes.bookOf(n)
+	if book == nil {
+		return fmt.Errorf("no book for note: %s", n.S3Path)
+	}
+
+	tmp, err := self.createTemp()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	header := fmt.Sprintf("Conflict copy from %s\n\n", time.Now().Format("2006-01-02 15:04"))
+
+	_, err = tmp.WriteString(header + string(local))
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write conflict copy: %w", err)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write conflict copy: %w", err)
+	}
+
+	err = book.NewNoteWithContentsOfFile(self.Config.App.NoteDir, tmp.Name(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create conflict copy: %w", err)
+	}
+
+	index := len(book.Notes) - 1
+
+	// Will upload it
+	return book.SaveNoteIndex(index)
+}
+
+// bookOf returns the book that has the note, or nil.
+func (nb *NoteBook) bookOf(n *Note) *Book {
+	for _, b := range nb.Books {
+		for _, o := range b.Notes {
+			if o == n {
+				return b
+			}
+		}
+	}
+
+	return nil
+}
+
+// splitLines splits s into lines, keeping the newlines.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
+
+// lcsMatch returns for every line in a, the index of the matching line in b
+// (or -1), from the longest common subsequence. Uses Hirschberg's algorithm, so
+// it only needs memory for a few rows, not len(a)*len(b).
+func lcsMatch(a, b []string) []int {
+	match := make([]int, len(a))
+	for i := range match {
+		match[i] = -1
+	}
+
+	lcsSplit(a, b, 0, 0, match)
+
+	return match
+}
+
+// lcsSplit fills in match for a, and b, which start at aOff, and bOff.
+func lcsSplit(a, b []string, aOff, bOff int, match []int) {
+	// A common prefix, and suffix are always part of the lcs
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		match[aOff] = bOff
+		a, b = a[1:], b[1:]
+		aOff++
+		bOff++
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		match[aOff+len(a)-1] = bOff + len(b) - 1
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+
+	if len(a) == 0 || len(b) == 0 {
+		return
+	}
+
+	if len(a) == 1 {
+		for j := range b {
+			if b[j] == a[0] {
+				match[aOff] = bOff + j
+				return
+			}
+		}
+		return
+	}
+
+	// Split a in half, and find where to split b so the lcs of both halves
+	// is the longest
+	mid := len(a) / 2
+	left := lcsLengths(a[:mid], b, false)
+	right := lcsLengths(a[mid:], b, true)
+
+	split := 0
+	best := -1
+	for j := 0; j <= len(b); j++ {
+		if l := left[j] + right[len(b)-j]; l > best {
+			best = l
+			split = j
+		}
+	}
+
+	lcsSplit(a[:mid], b[:split], aOff, bOff, match)
+	lcsSplit(a[mid:], b[split:], aOff+mid, bOff+split, match)
+}
+
+// lcsLengths returns the lcs length of a, and every prefix of b, eg. the
+// lengths[j] is the lcs of a, and b[:j]. If reverse is set, its for the
+// suffixes instead, lengths[j] is the lcs of a, and the last j lines of b.
+func lcsLengths(a, b []string, reverse bool) []int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+
+	for i := range a {
+		ai := a[i]
+		if reverse {
+			ai = a[len(a)-1-i]
+		}
+
+		for j := 1; j <= len(b); j++ {
+			bj := b[j-1]
+			if reverse {
+				bj = b[len(b)-j]
+			}
+
+			switch {
+			case ai == bj:
+				cur[j] = prev[j-1] + 1
+			case prev[j] >= cur[j-1]:
+				cur[j] = prev[j]
+			default:
+				cur[j] = cur[j-1]
+			}
+		}
+
+		prev, cur = cur, prev
+	}
+
+	return prev
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// merge3 does a line based three way merge, of two versions (local and
+// remote) that were both changed from base. Returns false if the same lines
+// were changed differently on both sides.
+func merge3(base, local, remote string) (string, bool) {
+	baseLines := splitLines(base)
+	localLines := splitLines(local)
+	remoteLines := splitLines(remote)
+
+	toLocal := lcsMatch(baseLines, localLines)
+	toRemote := lcsMatch(baseLines, remoteLines)
+
+	var out []string
+
+	// Walk the base, from one line that did not change on either side to the
+	// next, and merge the chunks between them.
+	i, l, r := 0, 0, 0
+	for {
+		next := i
+		for next < len(baseLines) && (toLocal[next] == -1 || toRemote[next] == -1) {
+			next++
+		}
+
+		var baseChunk, localChunk, remoteChunk []string
+		if next < len(baseLines) {
+			baseChunk = baseLines[i:next]
+			localChunk = localLines[l:toLocal[next]]
+			remoteChunk = remoteLines[r:toRemote[next]]
+		} else {
+			baseChunk = baseLines[i:]
+			localChunk = localLines[l:]
+			remoteChunk = remoteLines[r:]
+		}
+
+		switch {
+		case equalLines(localChunk, baseChunk):
+			out = append(out, remoteChunk...)
+		case equalLines(remoteChunk, baseChunk), equalLines(localChunk, remoteChunk):
+			out = append(out, localChunk...)
+		default:
+			return "", false
+		}
+
+		if next >= len(baseLines) {
+			break
+		}
+
+		out = append(out, baseLines[next])
+		i, l, r = next+1, toLocal[next]+1, toRemote[next]+1
+	}
+
+	return strings.Join(out, ""), true
+}
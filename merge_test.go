@@ -0,0 +1,232 @@
+package gnotes
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMerge3(t *testing.T) {
+	tests := []struct {
+		name   string
+		base   string
+		local  string
+		remote string
+		want   string
+		ok     bool
+	}{
+		{
+			name:   "different lines",
+			base:   "a\nb\nc\nd\n",
+			local:  "a\nB\nc\nd\n",
+			remote: "a\nb\nc\nD\n",
+			want:   "a\nB\nc\nD\n",
+			ok:     true,
+		},
+		{
+			name:   "both append",
+			base:   "title\n",
+			local:  "title\nlocal\n",
+			remote: "title\nremote\n",
+			ok:     false,
+		},
+		{
+			name:   "same change",
+			base:   "a\nb\n",
+			local:  "a\nc\n",
+			remote: "a\nc\n",
+			want:   "a\nc\n",
+			ok:     true,
+		},
+		{
+			name:   "insert and delete",
+			base:   "a\nb\nc\n",
+			local:  "new\na\nb\nc\n",
+			remote: "a\nc\n",
+			want:   "new\na\nc\n",
+			ok:     true,
+		},
+		{
+			name:   "same line",
+			base:   "a\nb\nc\n",
+			local:  "a\nx\nc\n",
+			remote: "a\ny\nc\n",
+			ok:     false,
+		},
+		{
+			name:   "empty base",
+			base:   "",
+			local:  "a\n",
+			remote: "",
+			want:   "a\n",
+			ok:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := merge3(test.base, test.local, test.remote)
+			assert.Equal(t, test.ok, ok)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestLCSMatch(t *testing.T) {
+	// lcsLength is the simple, but quadratic memory version
+	lcsLength := func(a, b []string) int {
+		lengths := make([][]int, len(a)+1)
+		for i := range lengths {
+			lengths[i] = make([]int, len(b)+1)
+		}
+		for i := len(a) - 1; i >= 0; i-- {
+			for j := len(b) - 1; j >= 0; j-- {
+				if a[i] == b[j] {
+					lengths[i][j] = lengths[i+1][j+1] + 1
+				} else if lengths[i+1][j] > lengths[i][j+1] {
+					lengths[i][j] = lengths[i+1][j]
+				} else {
+					lengths[i][j] = lengths[i][j+1]
+				}
+			}
+		}
+		return lengths[0][0]
+	}
+
+	randLines := func(r *rand.Rand, n int) []string {
+		lines := make([]string, n)
+		for i := range lines {
+			lines[i] = string(rune('a' + r.Intn(4)))
+		}
+		return lines
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		a := randLines(r, r.Intn(20))
+		b := randLines(r, r.Intn(20))
+		match := lcsMatch(a, b)
+
+		// The matches are in order, and the longest
+		found := 0
+		last := -1
+		for i, j := range match {
+			if j == -1 {
+				continue
+			}
+			require.Equal(t, a[i], b[j])
+			require.Greater(t, j, last)
+			last = j
+			found++
+		}
+		require.Equal(t, lcsLength(a, b), found, "a=%v b=%v", a, b)
+	}
+
+	// Large notes do not need len(a)*len(b) memory
+	a := make([]string, 10000)
+	b := make([]string, 10000)
+	for i := range a {
+		a[i] = fmt.Sprintf("line %d", i)
+		b[i] = fmt.Sprintf("line %d", i*2)
+	}
+	match := lcsMatch(a, b)
+	assert.Equal(t, 0, match[0])
+	assert.Equal(t, 1, match[2])
+	assert.Equal(t, -1, match[1])
+}
+
+func TestConcurrentNoteEdits(t *testing.T) {
+	t.Run("whole notes", func(t *testing.T) { testConcurrentNoteEdits(t, false) })
+	t.Run("deltas", func(t *testing.T) { testConcurrentNoteEdits(t, true) })
+}
+
+func testConcurrentNoteEdits(t *testing.T, deltas bool) {
+	backend := newMemBackend()
+
+	laptop := newTestApp(t, backend)
+	laptop.Config.App.DeltaUploads = deltas
+	n := addNote(t, laptop, "title\none\ntwo\nthree\n")
+
+	desktop := openTestApp(t, backend)
+	desktop.Config.App.DeltaUploads = deltas
+	dn := desktop.Notes.Books[0].Notes[0]
+	readNote(t, desktop, dn)
+
+	read := func(app *SelfApp, n *Note) string {
+		b, err := os.ReadFile(notePath(app, n))
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	// Edits to different lines are merged
+	editNote(t, desktop, dn, "title\none\ntwo\nthree from desktop\n")
+	editNote(t, laptop, n, "title\none from laptop\ntwo\nthree\n")
+	assert.Equal(t, "title\none from laptop\ntwo\nthree from desktop\n", read(laptop, n))
+	require.Len(t, laptop.Notes.Books[0].Notes, 1)
+
+	// Then the desktop downloads the merged note
+	dn.Hash = n.Hash
+	dn.Deltas = n.Deltas
+	assert.Equal(t, "title\none from laptop\ntwo\nthree from desktop\n", readNote(t, desktop, dn))
+
+	// Edits to the same line make a conflict copy
+	editNote(t, desktop, dn, "title\none from desktop\ntwo\nthree from desktop\n")
+	editNote(t, laptop, n, "title\none from laptop again\ntwo\nthree from desktop\n")
+
+	assert.Equal(t, "title\none from desktop\ntwo\nthree from desktop\n", read(laptop, n))
+
+	notes := laptop.Notes.Books[0].Notes
+	require.Len(t, notes, 2)
+	conflict := read(laptop, notes[1])
+	assert.True(t, strings.HasPrefix(conflict, "Conflict copy from "))
+	assert.Contains(t, conflict, "one from laptop again\n")
+
+	// And the conflict copy was uploaded
+	_, err := backend.Stat(laptop.remotePath(notes[1].S3Path))
+	assert.NoError(t, err)
+}
+
+func TestPrefetchConflicts(t *testing.T) {
+	backend := newMemBackend()
+
+	laptop := newTestApp(t, backend)
+	for i := 0; i < 8; i++ {
+		addNote(t, laptop, "title\none\n")
+	}
+
+	desktop := openTestApp(t, backend)
+	require.NoError(t, desktop.PrefetchNotes(4))
+
+	// Both change the same line of every note, the desktop is offline
+	for _, n := range desktop.Notes.Books[0].Notes {
+		require.NoError(t, os.WriteFile(notePath(desktop, n), []byte("title\none from desktop\n"), 0664))
+	}
+	for _, n := range laptop.Notes.Books[0].Notes {
+		editNote(t, laptop, n, "title\none from laptop\n")
+	}
+	require.NoError(t, laptop.SaveIndexFile())
+
+	self = desktop
+	require.NoError(t, desktop.LoadNotes())
+	require.NoError(t, desktop.PrefetchNotes(4))
+
+	copies := 0
+	for _, n := range desktop.Notes.Books[0].Notes {
+		b, err := os.ReadFile(notePath(desktop, n))
+		require.NoError(t, err)
+
+		if strings.HasPrefix(string(b), "Conflict copy from ") {
+			assert.Contains(t, string(b), "one from desktop\n")
+			copies++
+		} else {
+			assert.Equal(t, "title\none from laptop\n", string(b))
+		}
+	}
+	assert.Equal(t, 8, copies)
+	assert.Len(t, desktop.Notes.Books[0].Notes, 16)
+}
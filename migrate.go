@@ -0,0 +1,142 @@
+//
+//  migrate.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package gnotes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// indexVersion is the newest index format this gnotes understands. Its stored
+// in the index, so a older gnotes will not change a index it does not
+// understand.
+//
+//	1: the first version (with no version field), SHA-1 checksums
+//	2: SHA-256 checksums, SHA-1 checksums are still accepted
+//	3: the trash book is marked with the trash flag
+const indexVersion = 3
+
+// ErrIndexTooNew is returned when the index is from a newer version of gnotes.
+// It can still be read, but must never be written.
+var ErrIndexTooNew = errors.New("index is from a newer version of gnotes")
+
+// indexMigrations upgrade the index from one version to the next, the first
+// one upgrades version 1 to 2.
+var indexMigrations = []func(self *SelfApp, nb *NoteBook) error{
+	migrateSHA256,
+	migrateTrash,
+}
+
+// version returns the version of the index, a missing version is version 1.
+func (nb *NoteBook) version() int {
+	if nb.Version == 0 {
+		return 1
+	}
+
+	return nb.Version
+}
+
+// parseIndex parses a index, and upgrades it to the current version. If the
+// index is newer then this gnotes understands, its still returned but with a
+// ErrIndexTooNew error.
+func (self *SelfApp) parseIndex(b []byte) (*NoteBook, error) {
+	nb := &NoteBook{}
+
+	err := json.Unmarshal(b, nb)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal json into notes: %w", err)
+	}
+
+	if nb.version() > indexVersion {
+		return nb, fmt.Errorf("%w (version %d, this gnotes only understands up to %d)", ErrIndexTooNew, nb.version(), indexVersion)
+	}
+
+	err = self.migrateIndex(nb)
+	if err != nil {
+		return nil, err
+	}
+
+	return nb, nil
+}
+
+// migrateIndex runs all the migrations the index needs.
+func (self *SelfApp) migrateIndex(nb *NoteBook) error {
+	for v := nb.version(); v < indexVersion; v++ {
+		log.Printf("Upgrading index from version %d to %d", v, v+1)
+
+		err := indexMigrations[v-1](self, nb)
+		if err != nil {
+			return fmt.Errorf("failed to upgrade index to version %d: %w", v+1, err)
+		}
+		nb.Version = v + 1
+	}
+
+	return nil
+}
+
+// setIndexTooNew opens the notes read-only, since the index can not be written.
+func (self *SelfApp) setIndexTooNew(err error) {
+	if !self.IndexTooNew {
+		log.Printf("%s, opening read-only", err)
+	}
+
+	self.IndexTooNew = true
+	self.ReadOnly = true
+}
+
+// migrateSHA256 replaces the SHA-1 checksums of the notes with SHA-256 ones,
+// if the last synced copy matches. The other notes keep their SHA-1 checksum
+// until they are uploaded again.
+func migrateSHA256(self *SelfApp, nb *NoteBook) error {
+	for _, b := range nb.Books {
+		for _, n := range b.Notes {
+			if n.Hash == "" || n.IsAttachment {
+				continue
+			}
+
+			sum := self.baseSum(n.S3Path)
+			if sum.Matches(n.Hash) {
+				n.Hash = sum.String()
+			}
+		}
+	}
+
+	return nil
+}
+
+// migrateTrash marks the trash book with the trash flag, it was only known by
+// its name before. A book that only has deleted notes is the trash, any other
+// book with the same name was made by the user, so its renamed.
+func migrateTrash(self *SelfApp, nb *NoteBook) error {
+	for _, b := range nb.Books {
+		if b.Name != TrashBookName {
+			continue
+		}
+
+		b.Trash = true
+		for _, n := range b.Notes {
+			if n.DeletedAt == 0 {
+				b.Trash = false
+				break
+			}
+		}
+
+		if !b.Trash {
+			b.Name = TrashBookName + " (book)"
+			log.Printf("Renamed book %s to %s, the name is used for the deleted notes", TrashBookName, b.Name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+package gnotes
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// putIndex uploads a index, like a older or newer gnotes would.
+func putIndex(t *testing.T, app *SelfApp, nb *NoteBook, sha string) {
+	b, err := json.Marshal(nb)
+	require.NoError(t, err)
+	if sha == "" {
+		sha = Sum(b).String()
+	}
+
+	require.NoError(t, app.uploadBytes(app.remotePath("index.json"), b))
+	require.NoError(t, app.uploadBytes(app.remotePath("index.json.sha256"), []byte(sha)))
+}
+
+func TestChecksum(t *testing.T) {
+	sum := Sum([]byte("hello\n"))
+
+	assert.Len(t, sum.String(), 64)
+	assert.True(t, sum.Matches(sum.String()))
+	assert.True(t, sum.Matches(Sha1("hello\n")))
+	assert.False(t, sum.Matches(Sha1("hello")))
+	assert.False(t, sum.Matches(""))
+	assert.False(t, Checksum{}.Matches(""))
+}
+
+func TestIndexMigration(t *testing.T) {
+	backend := newMemBackend()
+	app := newTestApp(t, backend)
+
+	// A index from before versions, with SHA-1 checksums
+	s3Path := "Notes/old-note/content"
+	require.NoError(t, app.uploadBytes(app.remotePath(s3Path), []byte("old note\n")))
+
+	old := &NoteBook{Books: []*Book{{Name: "Notes", Notes: []*Note{{Title: "old", S3Path: s3Path, Hash: Sha1("old note\n")}}}}}
+	b, err := json.Marshal(old)
+	require.NoError(t, err)
+	putIndex(t, app, old, Sha1(string(b)))
+
+	require.NoError(t, app.LoadNotes())
+	assert.Equal(t, indexVersion, app.Notes.Version)
+	assert.False(t, app.ReadOnly)
+
+	// The SHA-1 checksum is still accepted
+	n := app.Notes.Books[0].Notes[0]
+	require.NoError(t, n.Download(app.Config.App.NoteDir))
+	assert.Equal(t, Sha1("old note\n"), n.Hash)
+
+	changed, err := app.Sync()
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	// Now that there is a synced copy, the next upgrade uses SHA-256
+	nb, err := app.parseIndex(b)
+	require.NoError(t, err)
+	assert.Equal(t, Sum([]byte("old note\n")).String(), nb.Books[0].Notes[0].Hash)
+
+	// Saving writes the new version
+	app.IndexNeedsUpdating = true
+	require.NoError(t, app.SaveIndexFile())
+
+	remote, err := app.downloadBytes(app.remotePath("index.json"))
+	require.NoError(t, err)
+	saved := &NoteBook{}
+	require.NoError(t, json.Unmarshal(remote, saved))
+	assert.Equal(t, indexVersion, saved.Version)
+}
+
+func TestTrashMigration(t *testing.T) {
+	app := newTestApp(t, newMemBackend())
+
+	deleted := &Note{S3Path: "Notes/deleted/content", DeletedAt: 1}
+	nb := &NoteBook{Version: 2, Books: []*Book{{Name: "Notes"}, {Name: TrashBookName, Notes: []*Note{deleted}}}}
+	b, err := json.Marshal(nb)
+	require.NoError(t, err)
+
+	nb, err = app.parseIndex(b)
+	require.NoError(t, err)
+	assert.True(t, nb.Books[1].IsTrash())
+	assert.Equal(t, TrashBookName, nb.Books[1].Name)
+
+	// A book the user named like the trash
+	mine := &Note{S3Path: "Trash/mine/content"}
+	nb = &NoteBook{Version: 2, Books: []*Book{{Name: TrashBookName, Notes: []*Note{mine}}}}
+	b, err = json.Marshal(nb)
+	require.NoError(t, err)
+
+	nb, err = app.parseIndex(b)
+	require.NoError(t, err)
+	assert.False(t, nb.Books[0].IsTrash())
+	assert.Equal(t, "Trash (book)", nb.Books[0].Name)
+	assert.Nil(t, nb.TrashBook())
+
+	// And the name can not be used again
+	assert.ErrorIs(t, nb.NewBook(TrashBookName), ErrBookExists)
+}
+
+func TestBaseIndexMigration(t *testing.T) {
+	app := newTestApp(t, newMemBackend())
+
+	// Last synced by a older gnotes, so the merge sees the same trash book
+	deleted := &Note{S3Path: "Notes/deleted/content", DeletedAt: 1}
+	nb := &NoteBook{Version: 2, Books: []*Book{{Name: "Notes"}, {Name: TrashBookName, Notes: []*Note{deleted}}}}
+	b, err := json.Marshal(nb)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Dir(app.baseIndexFile()), 0700))
+	require.NoError(t, app.saveBaseIndex(b))
+
+	base, baseJson, err := app.loadBaseIndex()
+	require.NoError(t, err)
+	assert.Equal(t, b, baseJson)
+	assert.Equal(t, indexVersion, base.Version)
+	assert.True(t, base.Books[1].IsTrash())
+}
+
+func TestIndexTooNew(t *testing.T) {
+	backend := newMemBackend()
+
+	laptop := newTestApp(t, backend)
+	addNote(t, laptop, "hello\n")
+
+	// A newer gnotes upgrades the index
+	newer := &NoteBook{Version: indexVersion + 1, Books: laptop.Notes.Books}
+	putIndex(t, laptop, newer, "")
+
+	// Its refused when uploading, and not queued
+	laptop.Notes.NewBook("Work")
+	laptop.IndexNeedsUpdating = true
+	assert.ErrorIs(t, laptop.SaveIndexFile(), ErrIndexTooNew)
+	assert.True(t, laptop.IndexTooNew)
+	assert.True(t, laptop.ReadOnly)
+
+	pending, err := laptop.PendingOps()
+	require.NoError(t, err)
+	assert.Equal(t, 0, pending)
+
+	remote, err := laptop.downloadBytes(laptop.remotePath("index.json"))
+	require.NoError(t, err)
+	nb := &NoteBook{}
+	require.NoError(t, json.Unmarshal(remote, nb))
+	assert.Equal(t, indexVersion+1, nb.Version)
+
+	// Another device can still read it, but only read-only
+	desktop := openTestApp(t, backend)
+	assert.True(t, desktop.IndexTooNew)
+	assert.True(t, desktop.ReadOnly)
+	require.Len(t, desktop.Notes.Books[0].Notes, 1)
+
+	desktop.IndexNeedsUpdating = true
+	assert.ErrorIs(t, desktop.SaveIndexFile(), ErrReadOnly)
+}
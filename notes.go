@@ -22,6 +22,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -35,10 +36,44 @@ type SelfApp struct {
 	// like if a new note was created.
 	IndexNeedsUpdating bool
 
+	// staleObjects are deleted after the index is saved, since the saved
+	// remote index still lists them until then. See deleteDeltas.
+	staleObjects []string
+
 	// CLI opts
 	CliOpts CliOpts
 
 	Config *Config
+
+	// configFile is where the Config was loaded from.
+	configFile string
+
+	// Backend is where all the notes are synced to.
+	Backend Backend
+
+	// ReadOnly is set if another gnotes has the notes open (see AcquireLock),
+	// or the index is too new. Nothing is uploaded, and the local index is not
+	// changed.
+	ReadOnly bool
+
+	// IndexTooNew is set if the index is from a newer version of gnotes, the
+	// notes are then opened read-only.
+	IndexTooNew bool
+
+	// lock is set while the lock from AcquireLock is held.
+	lock *lockInfo
+
+	// stopRenew stops renewing the remote lease, renewWG waits for it.
+	// leaseMu is held while the lease is written. leaseLost is set (with
+	// atomic) if another device took the remote lease.
+	stopRenew chan struct{}
+	renewWG   sync.WaitGroup
+	leaseMu   sync.Mutex
+	leaseLost int32
+
+	// readOnlyIndexSum is the checksum of the index that was last read, when
+	// read-only.
+	readOnlyIndexSum Checksum
 }
 
 type CliOpts struct {
@@ -52,7 +87,13 @@ var self *SelfApp
 
 // NoteBook is the collection of all sub-categroies.
 type NoteBook struct {
+	// Version is the index format, see indexVersion.
+	Version int `json:"version,omitempty"`
+
 	Books []*Book `json:"folders"`
+
+	// Generation is increased every time the index is uploaded.
+	Generation int64 `json:"generation"`
 	//LastSelected int     `json:"last_selected"`
 }
 
@@ -64,6 +105,9 @@ type Book struct {
 	Notes    []*Note `json:"notes"`
 	Modified int64   `json:"modified"`
 	Selected bool    `json:"selected"`
+
+	// Trash is true for the book that deleted notes are moved to.
+	Trash bool `json:"trash,omitempty"`
 }
 
 // Note is all the data for a specific note.
@@ -80,6 +124,18 @@ type Note struct {
 	IsAttachment    bool   `json:"attachment"`
 	AttachmentTitle string `json:"attachment_title"`
 	Size            int64  `json:"size"`
+
+	// Revisions are the older versions of the note, oldest first. Only kept if
+	// keep_revisions is set.
+	Revisions []*Revision `json:"revisions,omitempty"`
+
+	// Deltas are applied in order to the uploaded note, to get the latest
+	// version. Only used with delta_uploads.
+	Deltas []string `json:"deltas,omitempty"`
+
+	// For notes in the trash, when it was deleted and the book it was in.
+	DeletedAt    int64  `json:"deleted_at,omitempty"`
+	OriginalBook string `json:"original_book,omitempty"`
 }
 
 func InitApp(configPath string) (*SelfApp, error) {
@@ -91,6 +147,27 @@ func InitApp(configPath string) (*SelfApp, error) {
 		return nil, fmt.Errorf("failed loading config: %w", err)
 	}
 
+	app.configFile = configPath
+
+	app.Backend, err = NewBackend(app.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup backend: %w", err)
+	}
+
+	if g, ok := app.Backend.(*GitBackend); ok {
+		g.MergeIndex = app.mergeIndexObjects
+	}
+
+	err = app.unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to unlock notes: %w", err)
+	}
+
+	err = app.cleanTmpDir()
+	if err != nil {
+		return nil, err
+	}
+
 	app.Notes = &NoteBook{
 		Books: []*Book{
 			{
@@ -132,79 +209,91 @@ func (b *NoteBook) deselectAll() {
 	}
 }
 
-// Download will download the note if needed based on hash.
-func (n *Note) Download(noteDir string, s3Config S3Config) error {
+// Download will download the note if needed based on hash. If the cached note
+// has local changes that were never uploaded, they are merged with the remote
+// changes instead of being overwritten. If the download does not match the
+// hash, the cached note is kept, and a ChecksumError is returned.
+func (n *Note) Download(noteDir string) error {
+	conflict, err := n.download(noteDir)
+	if err != nil || conflict == nil {
+		return err
+	}
+
+	return self.resolveConflict(conflict)
+}
+
+// download is the same as Download, but if the local, and remote changes can
+// not be merged, the conflict is returned instead of changing the index. Its
+// safe to call for different notes at the same time.
+func (n *Note) download(noteDir string) (*noteConflict, error) {
 	// Skip if theres no hash (like for a newly created note).
 	if n.Hash == "" {
-		return nil
+		return nil, nil
 	}
 
 	noteFile := filepath.Join(noteDir, "notes", n.S3Path)
 
-	currentHash, err := Sha1File(noteFile)
+	current, err := SumFile(noteFile)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		return err
+		return nil, err
 	}
 
-	if n.Hash == currentHash {
+	if current.Matches(n.Hash) {
 		log.Printf("Using cached note\n")
-		return nil
+		return nil, nil
 	}
 
-	// Download the note
+	base := self.baseSum(n.S3Path)
+	if !n.IsAttachment && current != (Checksum{}) && base != (Checksum{}) && current != base {
+		// Changed locally since it was last synced
+		if base.Matches(n.Hash) || self.ReadOnly {
+			log.Printf("Keeping local changes, remote did not change\n")
+			return nil, nil
+		}
 
-	err = s3Config.DownloadFileFrom(filepath.Join(s3Config.UserID, "notes", n.S3Path), noteFile)
-	if err != nil {
-		return fmt.Errorf("failed to download file: %w", err)
+		remote, err := self.readVersion(n, n.Deltas)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download file: %w", err)
+		}
+
+		if !Sum(remote).Matches(n.Hash) {
+			return nil, self.quarantineBytes(remote, self.remotePath(n.S3Path), n.Hash)
+		}
+
+		_, conflict, err := self.tryMergeNote(n, remote)
+		return conflict, err
 	}
 
-	// Verify the checksum again
+	// Download the note
 
-	currentHash, err = Sha1File(noteFile)
+	if len(n.Deltas) > 0 {
+		err = self.downloadDeltas(n, noteFile)
+	} else {
+		// The checksum is checked while downloading
+		_, err = self.downloadVerified(self.remotePath(n.S3Path), noteFile, n.Hash)
+	}
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to download file: %w", err)
 	}
 
-	if n.Hash != currentHash {
-		fmt.Printf("WARNING!!! hash not the same!\n")
+	if !n.IsAttachment {
+		return nil, self.saveBaseFromCache(n.S3Path)
 	}
 
-	return nil
+	return nil, nil
 }
 
 // SaveNoteIndex does the same thing as Note.Save(), but also updates the
 // modified timestamp for the book.
 func (b *Book) SaveNoteIndex(noteIndex int) error {
-	n := b.Notes[noteIndex]
-
-	noteFile := filepath.Join(self.Config.App.NoteDir, "notes", n.S3Path)
-
-	currentHash, err := Sha1File(noteFile)
+	changed, err := self.saveNote(b.Notes[noteIndex])
 	if err != nil {
-		return fmt.Errorf("failed to get checksum for local cached file: %w", err)
+		return err
 	}
 
-	// Double check to make sure current hash is not empty
-	if currentHash != "" && n.Hash != currentHash {
-		// Upload the note that changed
-		err := self.Config.S3.UploadFile(
-			noteFile,
-			filepath.Join(self.Config.S3.UserID, "notes", n.S3Path),
-		)
-		if err != nil {
-			return err
-		}
-
-		// After uploading, update the hash tracker
-		n.Hash = currentHash
-		n.Changed()
-
-		self.IndexNeedsUpdating = true
+	if changed {
 		b.Changed(noteIndex)
-
-		return nil
 	}
-	log.Printf("Not uploading note since it has not changed")
 
 	return nil
 }
@@ -214,74 +303,176 @@ func (b *Book) SaveNoteIndex(noteIndex int) error {
 // change.
 // Depercated: use Book.SaveNoteIndex() instead (MAYBE...)
 func (n *Note) Save() error {
+	_, err := self.saveNote(n)
+	return err
+}
+
+// remoteChanged returns true if the remote note changed since it was last
+// synced. remote is the remote note if it has no head object.
+func (self *SelfApp) remoteChanged(n *Note, head *noteHead, remote []byte) bool {
+	base := self.baseSum(n.S3Path)
+
+	switch {
+	case base != (Checksum{}):
+		return !base.Matches(head.Hash)
+	case remote != nil:
+		return !Sum(remote).Matches(n.Hash)
+	default:
+		return head.Hash != n.Hash
+	}
+}
+
+// saveNote uploads a note if it changed. If the remote note was also changed
+// since it was last synced, both changes are merged first. Returns true if the
+// note changed.
+func (self *SelfApp) saveNote(n *Note) (bool, error) {
 	noteFile := filepath.Join(self.Config.App.NoteDir, "notes", n.S3Path)
 
-	currentHash, err := Sha1File(noteFile)
+	current, err := SumFile(noteFile)
 	if err != nil {
-		return fmt.Errorf("failed to get checksum for local cached file: %w", err)
+		return false, fmt.Errorf("failed to get checksum for local cached file: %w", err)
 	}
 
-	// Double check to make sure current hash is not empty
-	if currentHash != "" && n.Hash != currentHash {
-		// Upload the note that changed
-		err := self.Config.S3.UploadFile(
-			noteFile,
-			filepath.Join(self.Config.S3.UserID, "notes", n.S3Path),
-		)
-		if err != nil {
-			return err
+	if current.Matches(n.Hash) {
+		log.Printf("Not uploading note since it has not changed")
+		return false, nil
+	}
+
+	err = self.checkWritable()
+	if err != nil {
+		return false, err
+	}
+
+	// Make sure no one else changed the note since it was last synced
+	if !n.IsAttachment && n.Hash != "" {
+		head, remote, err := self.remoteHead(n)
+		if err != nil && !errors.Is(err, ErrObjectNotFound) {
+			// Probably offline, the upload will be queued below
+			log.Printf("Failed to check remote note: %s", err)
 		}
 
-		// After uploading, update the hash tracker
-		n.Hash = currentHash
-		n.Changed()
+		if err == nil && self.remoteChanged(n, head, remote) && !current.Matches(head.Hash) {
+			if remote == nil {
+				remote, err = self.readVersion(n, head.Deltas)
+				if err != nil {
+					return false, fmt.Errorf("failed to download remote note: %w", err)
+				}
+			}
+
+			upload, err := self.mergeNote(n, remote)
+			if err != nil {
+				return false, err
+			}
+			n.Deltas = head.Deltas
+
+			self.IndexNeedsUpdating = true
 
-		self.IndexNeedsUpdating = true
-		return nil
+			if !upload {
+				// A conflict copy was made instead
+				n.Changed()
+				return true, nil
+			}
+		}
 	}
-	log.Printf("Not uploading note since it has not changed")
 
-	return nil
-}
+	// Keep the current remote version before replacing it
+	if self.Config.App.KeepRevisions && !n.IsAttachment && n.Hash != "" {
+		err = self.saveRevision(n)
+		if err != nil {
+			// Not fatal, like when offline
+			log.Printf("Failed to save revision: %s", err)
+		}
+	}
 
-func (n *NoteBook) DeleteBook(index int) error {
-	n.Books = append(n.Books[:index], n.Books[index+1:]...)
-	self.IndexNeedsUpdating = true
+	// Incase gnotes crashes before the index is saved
+	err = self.journalUpload(n, current.String())
+	if err != nil {
+		return false, err
+	}
 
-	return nil
-}
+	// Upload the note that changed
+	// Use the checksum of what was actually uploaded, incase the file
+	// changed since.
+	uploadedHash, err := self.uploadNote(n, noteFile)
+	if err != nil {
+		// Probably offline, so upload it later
+		log.Printf("Failed to upload note: %s", err)
 
-// DeleteNote will delete a specific note. Will delete the note from s3 imetitly,
-// and reupload the index files.
-func (b *Book) DeleteNote(noteIndex int) error {
-	notePath := filepath.Dir(filepath.Join(self.Config.App.NoteDir, "notes", b.Notes[noteIndex].S3Path))
+		err = self.enqueuePut(noteFile, self.remotePath(n.S3Path), true)
+		if err != nil {
+			return false, err
+		}
 
-	log.Printf("Removing/deleting note: %s", notePath)
+		// The whole note will be uploaded, so the deltas are no longer needed.
+		// Only after the upload, so the note can still be read until then.
+		if len(n.Deltas) > 0 || self.Config.App.DeltaUploads {
+			for _, id := range n.Deltas {
+				err = self.enqueueDelete(self.remotePath(n.deltaPath(id)))
+				if err != nil {
+					return false, err
+				}
+			}
+			err = self.enqueueDelete(self.remotePath(n.headPath()))
+			if err != nil {
+				return false, err
+			}
+			n.Deltas = nil
+		}
 
-	err := os.RemoveAll(notePath)
-	if err != nil {
-		return fmt.Errorf("failed to delete note: %w", err)
+		sum, err := SumFile(noteFile)
+		if err != nil {
+			return false, err
+		}
+		uploadedHash = sum.String()
+	} else if !n.IsAttachment {
+		err = self.saveBaseFromCache(n.S3Path)
+		if err != nil {
+			return false, err
+		}
 	}
 
-	// Delete it from s3
-	err = self.Config.S3.Delete(filepath.Join(self.Config.S3.UserID, "notes", b.Notes[noteIndex].S3Path))
+	// After uploading, update the hash tracker
+	n.Hash = uploadedHash
+	n.Changed()
+
+	self.IndexNeedsUpdating = true
+
+	return true, nil
+}
+
+// DeleteBook will delete a book, all its notes are moved to the trash.
+// Deleting the trash book will empty it.
+func (n *NoteBook) DeleteBook(index int) error {
+	err := self.checkWritable()
 	if err != nil {
-		return fmt.Errorf("failed to delete note from s3: %w", err)
+		return err
 	}
 
-	b.Notes = append(b.Notes[:noteIndex], b.Notes[noteIndex+1:]...)
+	b := n.Books[index]
 
+	for len(b.Notes) > 0 {
+		err := b.DeleteNote(0)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Find it again, incase the trash book was just created
+	for i, o := range n.Books {
+		if o == b {
+			n.Books = append(n.Books[:i], n.Books[i+1:]...)
+			break
+		}
+	}
 	self.IndexNeedsUpdating = true
-	b.Changed(-1)
 
 	return nil
 }
 
-// DeleteNote will delete a specific note. Will delete the note from s3 imetitly,
-// and reupload the index files.
-// Depercated: use Book.DeleteNote()
-func (self *SelfApp) DeleteNote(bookIndex, noteIndex int) error {
-	notePath := filepath.Dir(filepath.Join(self.Config.App.NoteDir, "notes", self.Notes.Books[bookIndex].Notes[noteIndex].S3Path))
+// purgeNote will delete a specific note forever. Will delete the note from s3
+// imetitly, and reupload the index files.
+func (b *Book) purgeNote(noteIndex int) error {
+	notePath := filepath.Dir(filepath.Join(self.Config.App.NoteDir, "notes", b.Notes[noteIndex].S3Path))
 
 	log.Printf("Removing/deleting note: %s", notePath)
 
@@ -290,19 +481,40 @@ func (self *SelfApp) DeleteNote(bookIndex, noteIndex int) error {
 		return fmt.Errorf("failed to delete note: %w", err)
 	}
 
-	// Delete it from s3
-	err = self.Config.S3.Delete(filepath.Join(self.Config.S3.UserID, "notes", self.Notes.Books[bookIndex].Notes[noteIndex].S3Path))
+	// Delete it from the backend, or later if offline
+	err = self.DeleteFile(self.remotePath(b.Notes[noteIndex].S3Path))
+	if err != nil {
+		log.Printf("Failed to delete note: %s", err)
+
+		err = self.enqueueDelete(self.remotePath(b.Notes[noteIndex].S3Path))
+		if err != nil {
+			return err
+		}
+	}
+
+	self.deleteRevisions(b.Notes[noteIndex])
+	self.deleteDeltas(b.Notes[noteIndex], b.Notes[noteIndex].Deltas)
+	self.deleteHead(b.Notes[noteIndex])
+
+	err = self.removeBase(b.Notes[noteIndex].S3Path)
 	if err != nil {
-		return fmt.Errorf("failed to delete note from s3: %w", err)
+		return fmt.Errorf("failed to delete note: %w", err)
 	}
 
-	self.Notes.Books[bookIndex].Notes = append(self.Notes.Books[bookIndex].Notes[:noteIndex], self.Notes.Books[bookIndex].Notes[noteIndex+1:]...)
+	b.Notes = append(b.Notes[:noteIndex], b.Notes[noteIndex+1:]...)
 
 	self.IndexNeedsUpdating = true
+	b.Changed(-1)
 
 	return nil
 }
 
+// DeleteNote will move a specific note to the trash.
+// Depercated: use Book.DeleteNote()
+func (self *SelfApp) DeleteNote(bookIndex, noteIndex int) error {
+	return self.Notes.Books[bookIndex].DeleteNote(noteIndex)
+}
+
 // GetTitle returns a title for a note. Requires the local cache path.
 // Should be ~/.cache/gnotes/notes
 func (n *Note) GetTitle(noteDir string) string {
@@ -387,12 +599,6 @@ func (book *Book) NewAttachment(noteDir, path string) error {
 	uuidP := uuid.NewString()
 	createdTime := time.Now().Unix()
 
-	// TODO: dont read the whole file into memory
-	//fileContents, err := os.ReadFile(path)
-	//if err != nil {
-	//	return fmt.Errorf("failed to read file: %s", err)
-	//}
-
 	// TODO: add back later...
 	//	if util.IsText(fileContents) {
 	//		// Its a text file, so it needs to be added to notes, not attachments
@@ -491,8 +697,6 @@ func (book *Book) NewNoteWithContentsOfFile(noteDir, path string, completion fun
 
 	book.Notes = append(book.Notes, newNote)
 
-	fmt.Printf("NEW NOTES: %+v\n", book)
-
 	self.IndexNeedsUpdating = true
 
 	// Open the new note
@@ -520,6 +724,9 @@ func (noteBook *NoteBook) NewBook(name string) error {
 			return ErrBookExists
 		}
 	}
+	if name == TrashBookName {
+		return fmt.Errorf("%w: %s is used for the deleted notes", ErrBookExists, name)
+	}
 
 	newBook := &Book{
 		Name:     name,
@@ -19,54 +19,41 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 func (self *SelfApp) downloadIndexIfNeeded() error {
 	noteSha := filepath.Join(self.Config.App.NoteDir, "notes", "index.json.sha256")
 
-	err := self.Config.S3.DownloadFileFrom(
-		filepath.Join(self.Config.S3.UserID, "notes", "index.json.sha256"),
-		noteSha,
-	)
+	err := self.DownloadFileFrom(self.remotePath("index.json.sha256"), noteSha)
 	if err != nil {
 		return fmt.Errorf("failed to download file: %w", err)
 	}
 
-	oldSha, err := Sha1File(filepath.Join(self.Config.App.NoteDir, "notes", "index.json"))
+	oldSum, err := SumFile(filepath.Join(self.Config.App.NoteDir, "notes", "index.json"))
 	if err != nil {
 		if !errors.Is(err, os.ErrNotExist) {
 			return fmt.Errorf("failed to read index.json file: %w", err)
 		}
 	}
 
-	newSha, err := os.ReadFile(noteSha)
+	b, err := os.ReadFile(noteSha)
 	if err != nil {
 		if !errors.Is(err, os.ErrNotExist) {
 			return fmt.Errorf("failed to read note sha file: %w", err)
 		}
 	}
+	newSha := strings.TrimSpace(string(b))
 
-	if string(newSha) != oldSha || oldSha == "" {
+	if !oldSum.Matches(newSha) {
 		log.Printf("Downloading note index...\n")
 		noteIndex := filepath.Join(self.Config.App.NoteDir, "notes", "index.json")
 
-		err := self.Config.S3.DownloadFileFrom(
-			filepath.Join(self.Config.S3.UserID, "notes", "index.json"),
-			noteIndex,
-		)
+		// The old index is kept if the new one does not match the sha
+		_, err := self.downloadVerified(self.remotePath("index.json"), noteIndex, newSha)
 		if err != nil {
 			return err
 		}
-
-		// Verify sha after download
-		currentSha, err := Sha1File(noteIndex)
-		if err != nil {
-			return fmt.Errorf("failed to get current sha: %w", err)
-		}
-		if currentSha != string(newSha) {
-			fmt.Printf("WARNING!!! Sha does not match!\n")
-			// TODO: probaly abort...
-		}
 	}
 
 	return nil
@@ -78,25 +65,60 @@ func (self *SelfApp) LoadNotes() error {
 		return nil
 	}
 
-	err := self.downloadIndexIfNeeded()
-	if err != nil {
-		return err
+	if p, ok := self.Backend.(Puller); ok {
+		err := p.Pull()
+		if err != nil {
+			return err
+		}
 	}
 
-	// Now read the downloaded file
-	downloadedJson, err := os.ReadFile(filepath.Join(self.Config.App.NoteDir, "notes", "index.json"))
-	if err != nil {
-		return fmt.Errorf("failed to read json: %s", err)
+	var downloadedJson []byte
+	var err error
+
+	if self.ReadOnly {
+		downloadedJson, err = self.readIndexReadOnly()
+		if err != nil {
+			return err
+		}
+	} else {
+		// Finish anything that was interrupted by a crash
+		err = self.recoverIndex()
+		if err != nil {
+			return err
+		}
+
+		downloadedJson, err = self.downloadIndex()
+		if err != nil {
+			return err
+		}
 	}
 
-	err = json.Unmarshal(downloadedJson, &self.Notes)
-	if err != nil {
-		return fmt.Errorf("failed to unmarshal json into notes: %w", err)
+	notes, err := self.parseIndex(downloadedJson)
+	if errors.Is(err, ErrIndexTooNew) {
+		// Can still be read, but not changed
+		self.setIndexTooNew(err)
+	} else if err != nil {
+		return err
 	}
+	self.Notes = notes
 
 	// Now sort the notes by mod time
 	self.Notes.Sort()
 
+	// Cleanup anything left over from a crash, the other gnotes may still be
+	// using them if read-only
+	if !self.ReadOnly {
+		err = self.recoverJournal()
+		if err != nil {
+			return err
+		}
+
+		err = self.sweepStaleFiles()
+		if err != nil {
+			log.Printf("Failed to cleanup notes dir: %s", err)
+		}
+	}
+
 	// Make sure last selected book index is not out-of-range, could happen when deleting book
 	//	if self.Notes.LastSelected >= len(self.Notes.Books) || self.Notes.LastSelected == -1 {
 	//		self.Notes.LastSelected = len(self.Notes.Books) - 1
@@ -105,6 +127,15 @@ func (self *SelfApp) LoadNotes() error {
 	//		}
 	//	}
 
+	// Delete anything that was in the trash for too long
+	purged, err := self.PurgeTrash()
+	if err != nil {
+		log.Printf("Failed to purge trash: %s", err)
+	}
+	if purged > 0 {
+		self.IndexNeedsUpdating = true
+	}
+
 	// Make sure theres at lease one note folder
 	if len(self.Notes.Books) == 0 {
 		self.Notes.NewBook("Notes")
@@ -113,65 +144,227 @@ func (self *SelfApp) LoadNotes() error {
 	return nil
 }
 
-func (self *SelfApp) SaveIndexFile() error {
-	if !self.IndexNeedsUpdating {
-		log.Printf("Not uploading any changes\n")
-		return nil
+// downloadIndex downloads the index if it changed, and returns it.
+func (self *SelfApp) downloadIndex() ([]byte, error) {
+	// Queued notes are merged with any remote changes, which needs the local
+	// index
+	if pending, _ := self.PendingOps(); pending > 0 {
+		b, err := os.ReadFile(self.indexFile())
+		if err == nil {
+			notes, err := self.parseIndex(b)
+			if err == nil {
+				self.Notes = notes
+			}
+		}
+	}
+
+	// Retry anything that failed last time first
+	err := self.FlushQueue()
+	if err != nil {
+		log.Printf("Failed to retry pending operations: %s", err)
 	}
 
-	// Create, and upload the index.json.sha256 and index.json
+	if self.indexPending() {
+		// Still offline, and the local index has not been uploaded yet, so its
+		// newer then the remote one.
+		log.Printf("Using local index, it has not been uploaded yet")
+	} else {
+		err = self.downloadIndexIfNeeded()
+		if errors.Is(err, ErrChecksumMismatch) {
+			_, statErr := os.Stat(self.indexFile())
+			if statErr != nil {
+				return nil, err
+			}
 
-	noteIndex := filepath.Join(self.Config.App.NoteDir, "notes", "index.json")
+			// Keep using the last good index
+			log.Printf("%s, using the cached index", err)
+		} else if err != nil {
+			return nil, err
+		}
+	}
 
-	b, err := json.Marshal(self.Notes)
+	// Now read the downloaded file
+	downloadedJson, err := os.ReadFile(self.indexFile())
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to read json: %s", err)
+	}
+
+	if !self.indexPending() {
+		// The local changes will be based on this index
+		err = self.saveBaseIndex(downloadedJson)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return downloadedJson, nil
+}
+
+// readIndexReadOnly returns the remote index, without changing the local one
+// which belongs to the gnotes that has the lock. Uses the local index if it
+// has not been uploaded yet, or if offline.
+func (self *SelfApp) readIndexReadOnly() ([]byte, error) {
+	if !self.indexPending() {
+		b, err := self.downloadBytes(self.remotePath("index.json"))
+		if err == nil {
+			self.readOnlyIndexSum = Sum(b)
+			return b, nil
+		}
+		log.Printf("Failed to download index, using local index: %s", err)
 	}
-	err = os.WriteFile(noteIndex, b, 0664)
+
+	b, err := os.ReadFile(self.indexFile())
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to read json: %s", err)
 	}
 
-	err = self.Config.S3.UploadFile(
-		noteIndex,
-		filepath.Join(self.Config.S3.UserID, "notes", "index.json"),
-	)
+	return b, nil
+}
+
+// writeIndexFile writes the notes to the local index.
+func (self *SelfApp) writeIndexFile() error {
+	self.Notes.Version = indexVersion
+
+	b, err := json.Marshal(self.Notes)
 	if err != nil {
 		return err
 	}
 
-	// Rewrite the sha file
-	sha, err := Sha1File(noteIndex)
+	return writeFileAtomic(self.indexFile(), b, 0664)
+}
+
+func (self *SelfApp) SaveIndexFile() error {
+	notes, err := self.saveIndexFile()
+	if notes != nil {
+		// The app has the notes from the other devices now
+		*self.Notes = *notes
+	}
+
+	return err
+}
+
+// saveIndexFile is the same as SaveIndexFile, but if the index was merged with
+// changes from other devices, the merged index is returned instead of
+// replacing the notes.
+func (self *SelfApp) saveIndexFile() (*NoteBook, error) {
+	if !self.IndexNeedsUpdating {
+		log.Printf("Not uploading any changes\n")
+		return nil, nil
+	}
+
+	err := self.checkWritable()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = os.WriteFile(noteIndex+".sha256", []byte(sha), 0664)
+	// All the notes must be uploaded before the index that points to them
+	flushErr := self.FlushQueue()
+
+	// Write the local index first, so nothing is lost if the upload fails
+
+	noteIndex := self.indexFile()
+
+	// Incase gnotes crashes while uploading it
+	err = self.updateJournal(func(j *journal) {
+		j.Index = true
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = self.Config.S3.UploadFile(
-		noteIndex+".sha256",
-		filepath.Join(self.Config.S3.UserID, "notes", "index.json.sha256"),
-	)
+	err = self.writeIndexFile()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
-}
+	// The local index has all the notes that were uploaded now
+	err = self.updateJournal(func(j *journal) {
+		j.Notes = nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-func writeNewFile(path string, data []byte) error {
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	// Then upload the index.json and index.json.sha256, merging with any
+	// changes from other devices
+	merged := false
+	uploadErr := flushErr
+	if uploadErr == nil {
+		merged, uploadErr = self.syncIndex()
+	}
+	if errors.Is(uploadErr, ErrIndexTooNew) {
+		// Another device upgraded the index, so this one can not be uploaded
+		self.setIndexTooNew(uploadErr)
+		return nil, uploadErr
+	}
+	if uploadErr != nil {
+		// Probably offline, the index will be uploaded next time
+		log.Printf("Failed to upload index: %s", uploadErr)
+
+		err = self.enqueuePut(noteIndex, self.remotePath("index.json"), false)
+		if err != nil {
+			return nil, err
+		}
+
+		err = self.deleteStale(true)
+		if err != nil {
+			return nil, err
+		}
+
+		if errors.Is(uploadErr, ErrChecksumMismatch) {
+			log.Printf("WARNING: %s, changes saved locally, and will be uploaded next time", uploadErr)
+		} else {
+			log.Printf("Offline: changes saved locally, and will be uploaded next time")
+		}
+
+		// The queued index will be uploaded with the pending operations
+		self.IndexNeedsUpdating = false
+
+		return nil, self.updateJournal(func(j *journal) {
+			j.Index = false
+		})
+	}
+
+	err = self.updateJournal(func(j *journal) {
+		j.Index = false
+	})
 	if err != nil {
-		return fmt.Errorf("failed to open file for writing: %s", err)
+		return nil, err
+	}
+
+	var notes *NoteBook
+	if merged {
+		// Reload the index, so the app has the notes from the other devices
+		b, err := os.ReadFile(noteIndex)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read json: %s", err)
+		}
+
+		notes, err = self.parseIndex(b)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	_, err = f.Write(data)
+	self.IndexNeedsUpdating = false
+
+	err = self.deleteStale(false)
 	if err != nil {
-		return fmt.Errorf("failed to write data: %s", err)
+		return notes, err
 	}
 
-	return nil
+	nb := self.Notes
+	if notes != nil {
+		nb = notes
+	}
+
+	// Every save is a commit for backends that support it
+	if c, ok := self.Backend.(Committer); ok {
+		err = c.Commit(fmt.Sprintf("Update index (%d books)", len(nb.Books)))
+		if err != nil {
+			return notes, fmt.Errorf("failed to commit changes: %w", err)
+		}
+	}
+
+	return notes, nil
 }
@@ -0,0 +1,293 @@
+//
+//  passphrase.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package gnotes
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// The crypt key can be derived from a passphrase with argon2id, instead of
+// setting a crypt_key. The salt, and argon2 parameters are stored (not
+// encrypted) next to the index, so all devices derive the same key.
+
+const (
+	// kdfTime, kdfMemory (in KiB), and kdfThreads are the argon2id
+	// parameters for new salts.
+	kdfTime    = 3
+	kdfMemory  = 64 * 1024
+	kdfThreads = 4
+
+	kdfSaltSize = 16
+	kdfKeySize  = 32
+
+	// kdfCheck is encrypted with the derived key, to know if the passphrase
+	// was right.
+	kdfCheck = "gnotes"
+)
+
+var (
+	// ErrNoCryptKey is returned by LoadConfig if there is no crypt_key, or
+	// passphrase.
+	ErrNoCryptKey = errors.New("no crypt_key, or passphrase set")
+
+	// ErrWrongPassphrase is returned when the passphrase does not match the
+	// one used for the notes.
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+
+	// ErrNeedsRekey is returned when a passphrase is set for notes that were
+	// encrypted with a crypt_key.
+	ErrNeedsRekey = errors.New("the notes are encrypted with a crypt_key, set the crypt_key again, and run 'gnotes rekey --passphrase' to switch to a passphrase")
+)
+
+// kdfParams is the kdf.json object.
+type kdfParams struct {
+	Salt    []byte `json:"salt"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+
+	// Check is kdfCheck, encrypted with the derived key.
+	Check []byte `json:"check"`
+}
+
+// newKDFParams returns the params with a new random salt.
+func newKDFParams() (*kdfParams, error) {
+	p := &kdfParams{
+		Salt:    make([]byte, kdfSaltSize),
+		Time:    kdfTime,
+		Memory:  kdfMemory,
+		Threads: kdfThreads,
+	}
+
+	_, err := io.ReadFull(rand.Reader, p.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	return p, nil
+}
+
+// deriveKey returns the crypt key for a passphrase.
+func (p *kdfParams) deriveKey(passphrase string) string {
+	return string(argon2.IDKey([]byte(passphrase), p.Salt, p.Time, p.Memory, p.Threads, kdfKeySize))
+}
+
+// checkKey returns ErrWrongPassphrase if key was not derived from the same
+// passphrase as Check.
+func (p *kdfParams) checkKey(key string) error {
+	c := &S3Config{CryptKey: key}
+
+	b, err := c.Decrypt(p.Check)
+	if err != nil || string(b) != kdfCheck {
+		return ErrWrongPassphrase
+	}
+
+	return nil
+}
+
+// checkCryptKey makes sure theres a crypt_key that can be used with AES, or a
+// passphrase.
+func (c *S3Config) checkCryptKey() error {
+	switch {
+	case c.CryptKey != "" && c.Passphrase != "":
+		return errors.New("only one of crypt_key, and passphrase can be set")
+	case c.Passphrase != "":
+		return nil
+	case c.CryptKey == "":
+		return ErrNoCryptKey
+	}
+
+	switch len(c.CryptKey) {
+	case 16, 24, 32:
+		return nil
+	}
+
+	return fmt.Errorf("crypt_key must be 16, 24, or 32 characters, not %d", len(c.CryptKey))
+}
+
+func (self *SelfApp) kdfPath() string {
+	return self.remotePath("kdf.json")
+}
+
+// kdfCacheFile is the local copy of kdf.json, for when offline.
+func (self *SelfApp) kdfCacheFile() string {
+	return filepath.Join(self.Config.App.NoteDir, "kdf.json")
+}
+
+// unlock derives the crypt key from the passphrase, if its set. A new salt is
+// created the first time, but only if there are no notes yet.
+func (self *SelfApp) unlock() error {
+	c := &self.Config.S3
+	if c.Passphrase == "" {
+		return nil
+	}
+
+	p, err := self.loadKDFParams()
+	if err != nil {
+		return err
+	}
+
+	if p == nil {
+		// Without a salt, the notes were encrypted with a crypt_key, and a new
+		// salt would give a key that can not decrypt them
+		err = self.checkNoNotes()
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Creating a new salt for the passphrase")
+
+		p, err = newKDFParams()
+		if err != nil {
+			return err
+		}
+
+		key := p.deriveKey(c.Passphrase)
+
+		p.Check, err = (&S3Config{CryptKey: key}).Encrypt([]byte(kdfCheck))
+		if err != nil {
+			return err
+		}
+
+		err = self.saveKDFParams(p)
+		if err != nil {
+			return err
+		}
+
+		c.CryptKey = key
+
+		return nil
+	}
+
+	key := p.deriveKey(c.Passphrase)
+
+	err = p.checkKey(key)
+	if err != nil {
+		return err
+	}
+
+	c.CryptKey = key
+
+	return nil
+}
+
+// checkNoNotes returns ErrNeedsRekey if theres already a index, locally or on
+// the backend.
+func (self *SelfApp) checkNoNotes() error {
+	_, err := os.Stat(self.indexFile())
+	if err == nil {
+		return ErrNeedsRekey
+	}
+
+	_, err = self.Backend.Stat(self.remotePath("index.json"))
+	if err == nil {
+		return ErrNeedsRekey
+	}
+	if !errors.Is(err, ErrObjectNotFound) {
+		return fmt.Errorf("failed to check for existing notes: %w", err)
+	}
+
+	return nil
+}
+
+// loadKDFParams downloads kdf.json, or uses the cached one if offline. If its
+// missing on the backend, the cached one is uploaded again. Returns nil if
+// there is none yet.
+func (self *SelfApp) loadKDFParams() (*kdfParams, error) {
+	cached, cacheErr := os.ReadFile(self.kdfCacheFile())
+	if cacheErr != nil && !errors.Is(cacheErr, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read kdf file: %w", cacheErr)
+	}
+
+	var b []byte
+
+	r, err := self.Backend.Get(self.kdfPath())
+	if err == nil {
+		b, err = io.ReadAll(r)
+		r.Close()
+	}
+
+	missing := errors.Is(err, ErrObjectNotFound)
+	if err != nil {
+		if cacheErr != nil {
+			if missing {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("failed to download kdf file: %w", err)
+		}
+
+		if missing {
+			log.Printf("The kdf file is missing on the backend, uploading it again")
+		} else {
+			log.Printf("Failed to download kdf file, using the cached one: %s", err)
+		}
+		b = cached
+	}
+
+	p := &kdfParams{}
+
+	err = json.Unmarshal(b, p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse kdf file: %w", err)
+	}
+	if len(p.Salt) == 0 || p.Time == 0 || p.Memory == 0 || p.Threads == 0 {
+		return nil, errors.New("invalid kdf file")
+	}
+
+	if missing {
+		return p, self.saveKDFParams(p)
+	}
+	if !bytes.Equal(b, cached) {
+		return p, self.cacheKDFParams(b)
+	}
+
+	return p, nil
+}
+
+// saveKDFParams uploads kdf.json, and caches it.
+func (self *SelfApp) saveKDFParams(p *kdfParams) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	err = self.Backend.Put(self.kdfPath(), bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("failed to upload kdf file: %w", err)
+	}
+
+	return self.cacheKDFParams(b)
+}
+
+func (self *SelfApp) cacheKDFParams(b []byte) error {
+	err := os.MkdirAll(self.Config.App.NoteDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(self.kdfCacheFile(), b, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write kdf file: %w", err)
+	}
+
+	return nil
+}
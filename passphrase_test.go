@@ -0,0 +1,74 @@
+package gnotes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newPassphraseApp is newTestApp, but unlocked with a passphrase.
+func newPassphraseApp(t *testing.T, backend Backend, passphrase string) (*SelfApp, error) {
+	app := newTestApp(t, backend)
+	app.Config.S3.CryptKey = ""
+	app.Config.S3.Passphrase = passphrase
+
+	return app, app.unlock()
+}
+
+func TestPassphrase(t *testing.T) {
+	backend := newMemBackend()
+
+	// The first device creates the salt
+	laptop, err := newPassphraseApp(t, backend, "correct horse battery staple")
+	require.NoError(t, err)
+	assert.Len(t, laptop.Config.S3.CryptKey, kdfKeySize)
+
+	_, err = backend.Stat(laptop.kdfPath())
+	require.NoError(t, err)
+
+	addNote(t, laptop, "hello\n")
+
+	// Another device derives the same key
+	desktop, err := newPassphraseApp(t, backend, "correct horse battery staple")
+	require.NoError(t, err)
+	assert.Equal(t, laptop.Config.S3.CryptKey, desktop.Config.S3.CryptKey)
+
+	require.NoError(t, desktop.LoadNotes())
+	assert.Equal(t, "hello\n", readNote(t, desktop, desktop.Notes.Books[0].Notes[0]))
+
+	// gc keeps the salt
+	report, err := desktop.FindOrphans()
+	require.NoError(t, err)
+	assert.Empty(t, report.Orphans)
+	assert.Equal(t, 0, report.Skipped)
+
+	// A wrong passphrase is caught before anything is decrypted
+	_, err = newPassphraseApp(t, backend, "wrong horse battery staple")
+	assert.ErrorIs(t, err, ErrWrongPassphrase)
+
+	// If the salt is lost on the backend, its uploaded again from the cache
+	require.NoError(t, backend.Delete(laptop.kdfPath()))
+
+	self = laptop
+	laptop.Config.S3.CryptKey = ""
+	require.NoError(t, laptop.unlock())
+	assert.Equal(t, desktop.Config.S3.CryptKey, laptop.Config.S3.CryptKey)
+
+	_, err = backend.Stat(laptop.kdfPath())
+	require.NoError(t, err)
+}
+
+func TestPassphraseExistingNotes(t *testing.T) {
+	backend := newMemBackend()
+
+	app := newTestApp(t, backend)
+	addNote(t, app, "hello\n")
+
+	// Another device sets a passphrase, instead of running rekey
+	_, err := newPassphraseApp(t, backend, "correct horse battery staple")
+	assert.ErrorIs(t, err, ErrNeedsRekey)
+
+	_, err = backend.Stat(app.kdfPath())
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+}
@@ -0,0 +1,118 @@
+//
+//  prefetch.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package gnotes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// defaultPrefetchWorkers is the number of notes to download at the same time,
+// if not set in the config file.
+const defaultPrefetchWorkers = 8
+
+// PrefetchNotes will download all the notes (not attachments) that are not
+// cached, or changed since they were cached. Uses a pool of workers so a fresh
+// install with hundreds of notes does not take minutes.
+func (self *SelfApp) PrefetchNotes(workers int) error {
+	conflicts, err := self.prefetchNotes(self.Notes, workers)
+
+	// Still resolve the ones that were downloaded
+	resolveErr := self.resolveConflicts(conflicts)
+	if err == nil {
+		err = resolveErr
+	}
+
+	return err
+}
+
+// prefetchNotes is the same as PrefetchNotes for the notes in nb, but the
+// notes that could not be merged are returned instead of changing the index.
+func (self *SelfApp) prefetchNotes(nb *NoteBook, workers int) ([]*noteConflict, error) {
+	if workers <= 0 {
+		workers = defaultPrefetchWorkers
+	}
+
+	noteDir := self.Config.App.NoteDir
+
+	// Find all the notes that need downloading first, so we only start the
+	// workers if theres anything to do.
+	var todo []*Note
+	for _, b := range nb.Books {
+		for _, n := range b.Notes {
+			if n.IsAttachment || n.Hash == "" || n.DeletedAt != 0 {
+				continue
+			}
+
+			current, err := SumFile(filepath.Join(noteDir, "notes", n.S3Path))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+
+			if !current.Matches(n.Hash) {
+				todo = append(todo, n)
+			}
+		}
+	}
+
+	if len(todo) == 0 {
+		log.Printf("All notes are cached")
+		return nil, nil
+	}
+
+	log.Printf("Prefetching %d notes with %d workers", len(todo), workers)
+
+	jobs := make(chan *Note)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed []error
+	var conflicts []*noteConflict
+
+	for i := 0; i < workers && i < len(todo); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range jobs {
+				conflict, err := n.download(noteDir)
+				mu.Lock()
+				if err != nil {
+					failed = append(failed, fmt.Errorf("%s: %w", n.S3Path, err))
+				}
+				if conflict != nil {
+					conflicts = append(conflicts, conflict)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, n := range todo {
+		jobs <- n
+	}
+	close(jobs)
+
+	wg.Wait()
+
+	if len(failed) > 0 {
+		for _, err := range failed {
+			log.Printf("Failed to prefetch: %s", err)
+		}
+		return conflicts, fmt.Errorf("failed to download %d of %d notes: %w", len(failed), len(todo), failed[0])
+	}
+
+	return conflicts, nil
+}
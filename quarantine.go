@@ -0,0 +1,280 @@
+//
+//  quarantine.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package gnotes
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrChecksumMismatch is wrapped by ChecksumError.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ChecksumError is returned when a download does not match its checksum. The
+// cached copy is kept, and the bad download is moved to the quarantine dir, so
+// it can be retried, or accepted (see RetryQuarantined, and
+// AcceptQuarantined).
+type ChecksumError struct {
+	// S3Path is the note, or "index.json".
+	S3Path string
+
+	Want string
+	Got  string
+
+	// Quarantined is the path to the bad download.
+	Quarantined string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s: %s (expected %s, got %s)", ErrChecksumMismatch, e.S3Path, e.Want, e.Got)
+}
+
+func (e *ChecksumError) Unwrap() error {
+	return ErrChecksumMismatch
+}
+
+func (self *SelfApp) quarantineDir() string {
+	return filepath.Join(self.Config.App.NoteDir, "quarantine")
+}
+
+// quarantinePath returns where the bad download of a note, or the index is
+// kept.
+func (self *SelfApp) quarantinePath(s3Path string) string {
+	return filepath.Join(self.quarantineDir(), s3Path)
+}
+
+// quarantine moves a bad download from tmp to the quarantine dir, and returns
+// the ChecksumError for it.
+func (self *SelfApp) quarantine(tmp, remote, want string, got Checksum) error {
+	s3Path := strings.TrimPrefix(remote, self.remotePath()+"/")
+	dst := self.quarantinePath(s3Path)
+
+	err := os.MkdirAll(filepath.Dir(dst), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create quarantine dir: %w", err)
+	}
+
+	err = renameInto(tmp, dst)
+	if err != nil {
+		return fmt.Errorf("failed to quarantine %s: %w", s3Path, err)
+	}
+
+	log.Printf("Checksum mismatch, quarantined download: %s -> %s", remote, dst)
+
+	return &ChecksumError{
+		S3Path:      s3Path,
+		Want:        want,
+		Got:         got.String(),
+		Quarantined: dst,
+	}
+}
+
+// quarantineBytes is the same as quarantine, for a download in memory.
+func (self *SelfApp) quarantineBytes(b []byte, remote, want string) error {
+	file, err := self.createTemp()
+	if err != nil {
+		return fmt.Errorf("failed to create tmp file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	_, err = file.Write(b)
+	if err != nil {
+		return fmt.Errorf("failed to write tmp file: %w", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write tmp file: %w", err)
+	}
+
+	return self.quarantine(file.Name(), remote, want, Sum(b))
+}
+
+// Quarantined returns the notes (or "index.json") that have a quarantined
+// download.
+func (self *SelfApp) Quarantined() ([]string, error) {
+	dir := self.quarantineDir()
+	paths := []string{}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, rel)
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quarantine dir: %w", err)
+	}
+
+	return paths, nil
+}
+
+// RetryQuarantined removes a quarantined download, and downloads it again. If
+// it still does not match, its quarantined again.
+func (self *SelfApp) RetryQuarantined(s3Path string) error {
+	err := os.Remove(self.quarantinePath(s3Path))
+	if err != nil {
+		return fmt.Errorf("failed to remove quarantined download: %w", err)
+	}
+
+	if s3Path == "index.json" {
+		_, err = self.pullIndex()
+		return err
+	}
+
+	n := self.Notes.noteByPath(s3Path)
+	if n == nil {
+		return fmt.Errorf("note not found: %s", s3Path)
+	}
+
+	return n.Download(self.Config.App.NoteDir)
+}
+
+// AcceptQuarantined uses a quarantined download even though it does not match
+// its checksum, like if the checksum in the index is wrong. The index is
+// changed to match it.
+func (self *SelfApp) AcceptQuarantined(s3Path string) error {
+	err := self.checkWritable()
+	if err != nil {
+		return err
+	}
+
+	b, err := os.ReadFile(self.quarantinePath(s3Path))
+	if err != nil {
+		return fmt.Errorf("failed to read quarantined download: %w", err)
+	}
+
+	if s3Path == "index.json" {
+		err = self.acceptIndex(b)
+	} else {
+		n := self.Notes.noteByPath(s3Path)
+		if n == nil {
+			return fmt.Errorf("note not found: %s", s3Path)
+		}
+		err = self.acceptNote(n, b)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Accepted quarantined download: %s", s3Path)
+
+	return os.Remove(self.quarantinePath(s3Path))
+}
+
+// acceptIndex merges a quarantined index with the local one, then uploads it,
+// so the remote index, and its checksum match again.
+func (self *SelfApp) acceptIndex(b []byte) error {
+	remote, err := self.parseIndex(b)
+	if err != nil {
+		return err
+	}
+
+	base, _, err := self.loadBaseIndex()
+	if err != nil {
+		return err
+	}
+
+	merged := mergeIndex(base, self.Notes, remote)
+	if remote.Generation > merged.Generation {
+		merged.Generation = remote.Generation
+	}
+
+	err = self.uploadIndex(merged)
+	if err != nil {
+		return err
+	}
+
+	*self.Notes = *merged
+	self.IndexNeedsUpdating = false
+
+	return nil
+}
+
+// acceptNote uses a quarantined download as the remote version of a note.
+func (self *SelfApp) acceptNote(n *Note, b []byte) error {
+	noteFile := filepath.Join(self.Config.App.NoteDir, "notes", n.S3Path)
+
+	current, err := SumFile(noteFile)
+	base := self.baseSum(n.S3Path)
+
+	if err == nil && !n.IsAttachment && base != (Checksum{}) && current != base {
+		// Keep the local changes too
+		_, err = self.mergeNote(n, b)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = os.MkdirAll(filepath.Dir(noteFile), 0755)
+		if err != nil {
+			return err
+		}
+
+		err = writeFileAtomic(noteFile, b, 0664)
+		if err != nil {
+			return fmt.Errorf("failed to write note: %w", err)
+		}
+
+		n.Hash = Sum(b).String()
+
+		if !n.IsAttachment {
+			err = self.saveBase(n.S3Path, b)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(n.Deltas) > 0 {
+		// So the head matches the index again
+		err = self.writeHead(n, n.Hash)
+		if err != nil {
+			return fmt.Errorf("failed to upload note head: %w", err)
+		}
+	}
+
+	self.IndexNeedsUpdating = true
+
+	return nil
+}
+
+// noteByPath returns the note with the s3 path, or nil.
+func (nb *NoteBook) noteByPath(s3Path string) *Note {
+	for _, b := range nb.Books {
+		for _, n := range b.Notes {
+			if n.S3Path == s3Path {
+				return n
+			}
+		}
+	}
+
+	return nil
+}
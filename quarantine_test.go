@@ -0,0 +1,123 @@
+package gnotes
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoteQuarantine(t *testing.T) {
+	backend := newMemBackend()
+
+	laptop := newTestApp(t, backend)
+	ln := addNote(t, laptop, "hello\n")
+	s3Path := ln.S3Path
+	laptopFile := notePath(laptop, ln)
+
+	desktop := openTestApp(t, backend)
+	desktopFile := notePath(desktop, desktop.Notes.Books[0].Notes[0])
+	readNote(t, desktop, desktop.Notes.Books[0].Notes[0])
+
+	// The note is changed, but the uploaded object is damaged
+	edit := func(content string) {
+		editNote(t, laptop, ln, content)
+		require.NoError(t, laptop.SaveIndexFile())
+		require.NoError(t, laptop.uploadBytes(laptop.remotePath(s3Path), []byte("damaged\n")))
+		self = desktop
+	}
+	edit("hello again\n")
+
+	// The sync still works, but the cached note is kept
+	_, err := desktop.Sync()
+	require.NoError(t, err)
+
+	b, err := os.ReadFile(desktopFile)
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", string(b))
+
+	paths, err := desktop.Quarantined()
+	require.NoError(t, err)
+	assert.Equal(t, []string{s3Path}, paths)
+
+	n := desktop.Notes.Books[0].Notes[0]
+	err = n.Download(desktop.Config.App.NoteDir)
+	var checksumErr *ChecksumError
+	require.True(t, errors.As(err, &checksumErr))
+	assert.Equal(t, s3Path, checksumErr.S3Path)
+	assert.Equal(t, n.Hash, checksumErr.Want)
+
+	b, err = os.ReadFile(checksumErr.Quarantined)
+	require.NoError(t, err)
+	assert.Equal(t, "damaged\n", string(b))
+
+	// Retry fails until the object is fixed
+	assert.ErrorIs(t, desktop.RetryQuarantined(s3Path), ErrChecksumMismatch)
+
+	self = laptop
+	require.NoError(t, laptop.UploadFile(laptopFile, laptop.remotePath(s3Path)))
+	self = desktop
+
+	require.NoError(t, desktop.RetryQuarantined(s3Path))
+	b, err = os.ReadFile(desktopFile)
+	require.NoError(t, err)
+	assert.Equal(t, "hello again\n", string(b))
+
+	paths, err = desktop.Quarantined()
+	require.NoError(t, err)
+	assert.Empty(t, paths)
+
+	// Or its accepted
+	edit("hello one more time\n")
+	_, err = desktop.Sync()
+	require.NoError(t, err)
+
+	n = desktop.Notes.Books[0].Notes[0]
+	require.NoError(t, desktop.AcceptQuarantined(s3Path))
+	b, err = os.ReadFile(desktopFile)
+	require.NoError(t, err)
+	assert.Equal(t, "damaged\n", string(b))
+	assert.Equal(t, Sum([]byte("damaged\n")).String(), n.Hash)
+	assert.True(t, desktop.IndexNeedsUpdating)
+
+	paths, err = desktop.Quarantined()
+	require.NoError(t, err)
+	assert.Empty(t, paths)
+}
+
+func TestIndexQuarantine(t *testing.T) {
+	backend := newMemBackend()
+
+	app := newTestApp(t, backend)
+	addNote(t, app, "hello\n")
+
+	// A index that does not match its checksum
+	damaged := &NoteBook{Books: append([]*Book{{Name: "Damaged", Notes: []*Note{}}}, app.Notes.Books...)}
+	putIndex(t, app, damaged, Sum([]byte("something else")).String())
+
+	// The last good index is kept
+	restarted := newTestApp(t, backend)
+	restarted.Config.App.NoteDir = app.Config.App.NoteDir
+	require.NoError(t, restarted.LoadNotes())
+	require.Len(t, restarted.Notes.Books, 1)
+	assert.Equal(t, "Notes", restarted.Notes.Books[0].Name)
+
+	paths, err := restarted.Quarantined()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"index.json"}, paths)
+
+	// Without a good index, it can not be loaded
+	other := newTestApp(t, backend)
+	assert.ErrorIs(t, other.LoadNotes(), ErrChecksumMismatch)
+
+	// Accepting it merges it, and uploads it again with the right checksum
+	self = restarted
+	require.NoError(t, restarted.AcceptQuarantined("index.json"))
+	assert.Len(t, restarted.Notes.Books, 2)
+
+	other = newTestApp(t, backend)
+	require.NoError(t, other.LoadNotes())
+	assert.Len(t, other.Notes.Books, 2)
+}
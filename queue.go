@@ -0,0 +1,372 @@
+//
+//  queue.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package gnotes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+// Retry settings for the queue. Will try 4 times, waiting 0.5s, 1s, then 2s
+// between them.
+const queueRetries = 4
+
+var queueRetryDelay = 500 * time.Millisecond
+
+// pendingOp is a upload or delete that failed (like when offline), and will be
+// retried later.
+type pendingOp struct {
+	Op string `json:"op"`
+
+	// Local is the file to upload, relative to the notes dir.
+	Local  string `json:"local,omitempty"`
+	Remote string `json:"remote"`
+
+	// Note is true if Local is a note in the index, it is merged with any
+	// remote changes before uploading.
+	Note bool `json:"note,omitempty"`
+
+	Added    int64 `json:"added"`
+	Attempts int   `json:"attempts"`
+}
+
+// opQueue is the list of pending operations, stored in the notes dir so they
+// survive restarts. Operations are always done in order.
+type opQueue struct {
+	Ops []*pendingOp `json:"ops"`
+}
+
+func (self *SelfApp) queueFile() string {
+	return filepath.Join(self.Config.App.NoteDir, "queue.json")
+}
+
+func (self *SelfApp) loadQueue() (*opQueue, error) {
+	q := &opQueue{}
+
+	b, err := os.ReadFile(self.queueFile())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return q, nil
+		}
+		return nil, fmt.Errorf("failed to read queue: %w", err)
+	}
+
+	err = json.Unmarshal(b, q)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse queue: %w", err)
+	}
+
+	return q, nil
+}
+
+func (self *SelfApp) saveQueue(q *opQueue) error {
+	if len(q.Ops) == 0 {
+		err := os.Remove(self.queueFile())
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove queue: %w", err)
+		}
+		return nil
+	}
+
+	b, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(self.queueFile(), b, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write queue: %w", err)
+	}
+
+	return nil
+}
+
+// enqueue adds a operation to the end of the queue. Any older operation for
+// the same remote object is replaced, since only the last one matters.
+func (self *SelfApp) enqueue(op *pendingOp) error {
+	q, err := self.loadQueue()
+	if err != nil {
+		return err
+	}
+
+	op.Added = time.Now().Unix()
+
+	ops := q.Ops[:0]
+	for _, o := range q.Ops {
+		if o.Remote != op.Remote {
+			ops = append(ops, o)
+		}
+	}
+	q.Ops = append(ops, op)
+
+	log.Printf("Queued %s for later: %s", op.Op, op.Remote)
+
+	return self.saveQueue(q)
+}
+
+// enqueuePut queues a file to be uploaded later. note should be true for the
+// notes in the index.
+func (self *SelfApp) enqueuePut(local, to string, note bool) error {
+	rel, err := filepath.Rel(self.Config.App.NoteDir, local)
+	if err != nil {
+		return err
+	}
+
+	return self.enqueue(&pendingOp{Op: opPut, Local: rel, Remote: to, Note: note})
+}
+
+// enqueueDelete queues a object to be deleted later.
+func (self *SelfApp) enqueueDelete(remote string) error {
+	return self.enqueue(&pendingOp{Op: opDelete, Remote: remote})
+}
+
+// indexPending returns true if the index upload is waiting in the queue, which
+// means the local index is newer then the remote one.
+func (self *SelfApp) indexPending() bool {
+	return self.putPending(self.remotePath("index.json"))
+}
+
+// putPending returns true if a upload to remote is waiting in the queue.
+func (self *SelfApp) putPending(remote string) bool {
+	q, err := self.loadQueue()
+	if err != nil {
+		return false
+	}
+
+	for _, op := range q.Ops {
+		if op.Op == opPut && op.Remote == remote {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PendingOps returns the number of operations waiting to be retried.
+func (self *SelfApp) PendingOps() (int, error) {
+	q, err := self.loadQueue()
+	if err != nil {
+		return 0, err
+	}
+
+	return len(q.Ops), nil
+}
+
+// FlushQueue retries all the pending operations in order, with exponential
+// backoff. Stops at the first one that still fails (probably still offline),
+// so the index is never uploaded before the notes it points to.
+func (self *SelfApp) FlushQueue() error {
+	if self.ReadOnly {
+		// The queue belongs to the gnotes that has the lock
+		return nil
+	}
+
+	q, err := self.loadQueue()
+	if err != nil {
+		return err
+	}
+
+	if len(q.Ops) == 0 {
+		return nil
+	}
+
+	log.Printf("Retrying %d pending operations", len(q.Ops))
+
+	for len(q.Ops) > 0 {
+		op := q.Ops[0]
+
+		err := retryWithBackoff(func() error {
+			op.Attempts++
+			return self.doOp(op)
+		})
+
+		saveErr := self.finishOp(op, err == nil)
+		if saveErr != nil {
+			return saveErr
+		}
+		if err != nil {
+			return fmt.Errorf("%d operations still pending: %s %s: %w", len(q.Ops), op.Op, op.Remote, err)
+		}
+
+		// doOp can queue more, like a conflict copy of a note
+		q, err = self.loadQueue()
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("All pending operations done")
+
+	return nil
+}
+
+// finishOp removes op from the queue if its done, otherwise saves the
+// attempts. The queue is read again, incase doOp queued more.
+func (self *SelfApp) finishOp(op *pendingOp, done bool) error {
+	q, err := self.loadQueue()
+	if err != nil {
+		return err
+	}
+
+	ops := q.Ops[:0]
+	for _, o := range q.Ops {
+		if o.Op == op.Op && o.Remote == op.Remote && o.Added == op.Added {
+			if done {
+				continue
+			}
+			o.Attempts = op.Attempts
+		}
+		ops = append(ops, o)
+	}
+	q.Ops = ops
+
+	return self.saveQueue(q)
+}
+
+func (self *SelfApp) doOp(op *pendingOp) error {
+	switch op.Op {
+	case opPut:
+		if op.Remote == self.remotePath("index.json") {
+			// Notes merged by the queue changed the index
+			if self.IndexNeedsUpdating {
+				err := self.writeIndexFile()
+				if err != nil {
+					return err
+				}
+			}
+
+			// Never overwrite the remote index, it may have changed while offline
+			_, err := self.syncIndex()
+			return err
+		}
+
+		local := filepath.Join(self.Config.App.NoteDir, op.Local)
+		if _, err := os.Stat(local); errors.Is(err, os.ErrNotExist) {
+			// Deleted since, so theres nothing to upload anymore
+			log.Printf("Dropping pending upload, file no longer exists: %s", op.Local)
+			return nil
+		}
+
+		if op.Note {
+			return self.putQueuedNote(op, local)
+		}
+
+		return self.UploadFile(local, op.Remote)
+	case opDelete:
+		err := self.DeleteFile(op.Remote)
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	return fmt.Errorf("unknown operation: %s", op.Op)
+}
+
+// putQueuedNote uploads a note that was saved while offline. Like saveNote, if
+// the remote note was changed since it was last synced, both changes are
+// merged first.
+func (self *SelfApp) putQueuedNote(op *pendingOp, local string) error {
+	s3Path := strings.TrimPrefix(op.Local, "notes"+string(filepath.Separator))
+
+	n := self.Notes.noteByPath(s3Path)
+	if n == nil || n.IsAttachment {
+		return self.UploadFile(local, op.Remote)
+	}
+
+	head, remote, err := self.remoteHead(n)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+
+	// Without a base, theres no way to tell if the remote changed
+	base := self.baseSum(s3Path)
+	changed := err == nil && base != (Checksum{}) && !base.Matches(head.Hash)
+
+	if changed {
+		current, err := SumFile(local)
+		if err != nil {
+			return err
+		}
+		changed = !current.Matches(head.Hash)
+	}
+
+	if changed {
+		if remote == nil {
+			remote, err = self.readVersion(n, head.Deltas)
+			if err != nil {
+				return fmt.Errorf("failed to download remote note: %w", err)
+			}
+		}
+
+		// If they conflict, a conflict copy is made, and the note is now the
+		// remote version. Its still uploaded below as a whole note, since the
+		// deltas are queued to be deleted after this.
+		_, err = self.mergeNote(n, remote)
+		if err != nil {
+			return err
+		}
+
+		n.Changed()
+		self.IndexNeedsUpdating = true
+	}
+
+	sum, err := self.uploadFile(local, op.Remote)
+	if err != nil {
+		return err
+	}
+
+	if changed {
+		// The uploaded note has the changes from the deltas now
+		self.deleteDeltas(n, head.Deltas)
+		if len(head.Deltas) > 0 {
+			self.deleteHead(n)
+		}
+		n.Deltas = nil
+		n.Hash = sum.String()
+	}
+
+	// Notes are now synced, so remember what they were based on
+	return self.saveBaseFromCache(s3Path)
+}
+
+// retryWithBackoff calls fn until it succeeds, up to queueRetries times,
+// doubling the delay every time.
+func retryWithBackoff(fn func() error) error {
+	delay := queueRetryDelay
+
+	var err error
+	for i := 0; i < queueRetries; i++ {
+		if i > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+
+		err = fn()
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,148 @@
+package gnotes
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errOffline = errors.New("offline")
+
+// offlineBackend fails every write while offline is true.
+type offlineBackend struct {
+	*memBackend
+	offline bool
+}
+
+func (o *offlineBackend) Put(key string, r io.Reader) error {
+	if o.offline {
+		return errOffline
+	}
+	return o.memBackend.Put(key, r)
+}
+
+func (o *offlineBackend) Delete(key string) error {
+	if o.offline {
+		return errOffline
+	}
+	return o.memBackend.Delete(key)
+}
+
+func TestOfflineQueue(t *testing.T) {
+	queueRetryDelay = time.Millisecond
+
+	backend := &offlineBackend{memBackend: newMemBackend(), offline: true}
+
+	// Nothing should fail while offline, just get queued
+	app := newTestApp(t, backend)
+	n := addNote(t, app, "written on a plane\n")
+
+	pending, err := app.PendingOps()
+	require.NoError(t, err)
+	assert.Equal(t, 2, pending)
+
+	sum, err := SumFile(notePath(app, n))
+	require.NoError(t, err)
+	assert.Equal(t, sum.String(), n.Hash)
+
+	// Still offline on restart, so the local index must be kept
+	require.NoError(t, app.LoadNotes())
+	require.Len(t, app.Notes.Books[0].Notes, 1)
+
+	q, err := app.loadQueue()
+	require.NoError(t, err)
+	assert.Greater(t, q.Ops[0].Attempts, queueRetries)
+
+	// Back online
+	backend.offline = false
+	require.NoError(t, app.LoadNotes())
+
+	pending, err = app.PendingOps()
+	require.NoError(t, err)
+	assert.Equal(t, 0, pending)
+
+	other := openTestApp(t, backend)
+	require.Len(t, other.Notes.Books[0].Notes, 1)
+
+	note := other.Notes.Books[0].Notes[0]
+	assert.Equal(t, "written on a plane\n", readNote(t, other, note))
+
+	// Deletes are queued too
+	backend.offline = true
+	require.NoError(t, other.Notes.Books[0].DeleteNote(0))
+	require.NoError(t, other.Notes.EmptyTrash())
+	_, err = backend.Stat(other.remotePath(note.S3Path))
+	require.NoError(t, err)
+
+	backend.offline = false
+	require.NoError(t, other.FlushQueue())
+	_, err = backend.Stat(other.remotePath(note.S3Path))
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+}
+
+func TestOfflineQueueMerge(t *testing.T) {
+	queueRetryDelay = time.Millisecond
+
+	mem := newMemBackend()
+	laptopBackend := &offlineBackend{memBackend: mem}
+
+	laptop := newTestApp(t, laptopBackend)
+	n := addNote(t, laptop, "one\ntwo\nthree\n")
+
+	desktop := openTestApp(t, mem)
+	readNote(t, desktop, desktop.Notes.Books[0].Notes[0])
+
+	// Both change the note while the laptop is offline
+	laptopBackend.offline = true
+	editNote(t, laptop, n, "one\ntwo\nthree\nfrom the laptop\n")
+	require.NoError(t, laptop.SaveIndexFile())
+
+	editNote(t, desktop, desktop.Notes.Books[0].Notes[0], "from the desktop\none\ntwo\nthree\n")
+	require.NoError(t, desktop.SaveIndexFile())
+
+	// The queued upload is merged, not overwriting the desktop changes
+	laptopBackend.offline = false
+	self = laptop
+	require.NoError(t, laptop.LoadNotes())
+
+	merged := "from the desktop\none\ntwo\nthree\nfrom the laptop\n"
+	require.Len(t, laptop.Notes.Books[0].Notes, 1)
+	assert.Equal(t, merged, readNote(t, laptop, laptop.Notes.Books[0].Notes[0]))
+
+	other := openTestApp(t, mem)
+	assert.Equal(t, merged, readNote(t, other, other.Notes.Books[0].Notes[0]))
+
+	// Changing the same line makes a conflict copy
+	self = desktop
+	require.NoError(t, desktop.LoadNotes())
+	readNote(t, desktop, desktop.Notes.Books[0].Notes[0])
+
+	laptopBackend.offline = true
+	editNote(t, laptop, laptop.Notes.Books[0].Notes[0], "laptop\n")
+	require.NoError(t, laptop.SaveIndexFile())
+
+	editNote(t, desktop, desktop.Notes.Books[0].Notes[0], "desktop\n")
+	require.NoError(t, desktop.SaveIndexFile())
+
+	laptopBackend.offline = false
+	self = laptop
+	require.NoError(t, laptop.LoadNotes())
+
+	other = openTestApp(t, mem)
+	require.Len(t, other.Notes.Books[0].Notes, 2)
+
+	var contents []string
+	for _, o := range other.Notes.Books[0].Notes {
+		contents = append(contents, readNote(t, other, o))
+	}
+	assert.Contains(t, contents, "desktop\n")
+	assert.Contains(t, contents[0]+contents[1], "laptop\n")
+
+	pending, err := laptop.PendingOps()
+	require.NoError(t, err)
+	assert.Equal(t, 0, pending)
+}
@@ -0,0 +1,168 @@
+//
+//  reencrypt.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package gnotes
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// ReencryptObjects encrypts every object on the backend that is still in the
+// old AES-CFB format again, in the authenticated format. Objects that were
+// already done are skipped, so its safe to run again if it was interrupted.
+// Objects that could not be decrypted are left as they are. Returns the number
+// of objects that were re-encrypted.
+func (self *SelfApp) ReencryptObjects() (int, error) {
+	err := self.checkWritable()
+	if err != nil {
+		return 0, err
+	}
+
+	objects, err := self.Backend.List(self.remotePath() + "/")
+	if err != nil {
+		return 0, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	done := 0
+	var failed []error
+
+	for _, o := range objects {
+		if o.Key == self.kdfPath() || o.Key == self.leasePath() {
+			// Not encrypted, or written by the lease renewal at the same time
+			continue
+		}
+
+		reencrypted, err := self.reencryptObject(o.Key)
+		if err != nil {
+			log.Printf("Failed to re-encrypt: %s", err)
+			failed = append(failed, err)
+			continue
+		}
+		if reencrypted {
+			done++
+		}
+	}
+
+	if done > 0 {
+		log.Printf("Re-encrypted %d objects", done)
+
+		if c, ok := self.Backend.(Committer); ok {
+			err = c.Commit(fmt.Sprintf("Re-encrypt %d objects", done))
+			if err != nil {
+				return done, fmt.Errorf("failed to commit changes: %w", err)
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return done, fmt.Errorf("failed to re-encrypt %d objects: %w", len(failed), failed[0])
+	}
+
+	return done, nil
+}
+
+// reencryptObject re-encrypts a object, if its in the old format. Returns true
+// if it was.
+func (self *SelfApp) reencryptObject(key string) (bool, error) {
+	r, err := self.Backend.Get(key)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	br := bufio.NewReader(r)
+	if !isLegacyEncrypted(br) {
+		return false, nil
+	}
+
+	dec, err := self.Config.S3.legacyDecryptReader(br)
+	if err != nil {
+		return false, fmt.Errorf("failed to decrypt %s: %w", key, err)
+	}
+
+	// Decrypt to the private tmp dir first, since the object is replaced
+	plain, err := self.createTemp()
+	if err != nil {
+		return false, fmt.Errorf("failed to create tmp file: %w", err)
+	}
+	defer os.Remove(plain.Name())
+	defer plain.Close()
+
+	h := newChecksumWriter()
+	_, err = io.Copy(io.MultiWriter(plain, h), dec)
+	if err != nil {
+		return false, fmt.Errorf("failed to decrypt %s: %w", key, err)
+	}
+
+	// The old format can not tell if it was decrypted with the right key, so
+	// make sure its valid before replacing it
+	err = checkGzip(plain)
+	if err != nil {
+		return false, fmt.Errorf("failed to decrypt %s, not re-encrypting it: %w", key, err)
+	}
+
+	pr, pw := io.Pipe()
+
+	// tmp file -> encrypt -> backend
+	go func() {
+		enc, err := self.Config.S3.encryptWriter(pw)
+		if err == nil {
+			_, err = io.Copy(enc, plain)
+		}
+		if err == nil {
+			err = enc.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	err = self.Backend.Put(key, pr)
+	// Make sure the writer does not block forever if the upload failed
+	pr.CloseWithError(err)
+	if err != nil {
+		return false, fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+
+	err = self.verifyObject(key, &self.Config.S3, h.Sum())
+	if err != nil {
+		return false, err
+	}
+
+	log.Printf("Re-encrypted: %s", key)
+
+	return true, nil
+}
+
+// checkGzip reads all of f to make sure its valid gzip data, then rewinds it.
+func checkGzip(f *os.File) error {
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(io.Discard, zr)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+
+	return err
+}
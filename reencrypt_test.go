@@ -0,0 +1,144 @@
+package gnotes
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// truncatingBackend loses the end of every upload.
+type truncatingBackend struct {
+	*memBackend
+}
+
+func (tb *truncatingBackend) Put(key string, r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	return tb.memBackend.Put(key, bytes.NewReader(b[:len(b)/2]))
+}
+
+// legacyEncrypt encrypts like older versions of gnotes, with AES-CFB.
+func legacyEncrypt(t *testing.T, c *S3Config, data []byte) []byte {
+	block, err := aes.NewCipher([]byte(c.CryptKey))
+	require.NoError(t, err)
+
+	out := make([]byte, aes.BlockSize+len(data))
+	_, err = io.ReadFull(rand.Reader, out[:aes.BlockSize])
+	require.NoError(t, err)
+
+	cipher.NewCFBEncrypter(block, out[:aes.BlockSize]).XORKeyStream(out[aes.BlockSize:], data)
+
+	return out
+}
+
+func TestEncrypt(t *testing.T) {
+	c := &S3Config{CryptKey: "DpiJ1QaSh25O1Kt3"}
+
+	for _, size := range []int{0, 10, cryptChunkSize, cryptChunkSize*2 + 100} {
+		data := bytes.Repeat([]byte("x"), size)
+
+		enc, err := c.Encrypt(data)
+		require.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(enc, []byte(cryptMagic)))
+
+		dec, err := c.Decrypt(enc)
+		require.NoError(t, err)
+		assert.Equal(t, data, dec)
+
+		// Changed
+		changed := append([]byte{}, enc...)
+		changed[len(changed)-1] ^= 1
+		_, err = c.Decrypt(changed)
+		assert.ErrorIs(t, err, ErrDecrypt)
+
+		// Truncated, even at a chunk boundary
+		if size > cryptChunkSize {
+			truncated := enc[:cryptHeaderSize+cryptChunkSize+16]
+			_, err = c.Decrypt(truncated)
+			assert.ErrorIs(t, err, ErrDecrypt)
+		}
+	}
+
+	// The old format can still be read
+	dec, err := c.Decrypt(legacyEncrypt(t, c, []byte("old")))
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(dec))
+}
+
+func TestReencryptObjects(t *testing.T) {
+	backend := newMemBackend()
+	app := newTestApp(t, backend)
+
+	addNote(t, app, "hello\n")
+
+	// A note uploaded by a older gnotes
+	gz := bytes.NewBuffer(nil)
+	zw := gzip.NewWriter(gz)
+	zw.Write([]byte("old note\n"))
+	require.NoError(t, zw.Close())
+	oldKey := app.remotePath("Notes/old/content")
+	require.NoError(t, backend.Put(oldKey, bytes.NewReader(legacyEncrypt(t, &app.Config.S3, gz.Bytes()))))
+
+	// Something that can not be decrypted is never replaced
+	badKey := app.remotePath("Notes/bad/content")
+	require.NoError(t, backend.Put(badKey, strings.NewReader("not a gnotes object")))
+
+	done, err := app.ReencryptObjects()
+	assert.Error(t, err)
+	assert.Equal(t, 1, done)
+
+	r, err := backend.Get(badKey)
+	require.NoError(t, err)
+	b, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "not a gnotes object", string(b))
+	require.NoError(t, backend.Delete(badKey))
+
+	// The lease is skipped, its written by the renewal at the same time
+	require.NoError(t, backend.Put(app.leasePath(), strings.NewReader("not encrypted")))
+
+	b, err = app.downloadBytes(oldKey)
+	require.NoError(t, err)
+	assert.Equal(t, "old note\n", string(b))
+
+	// Already done
+	done, err = app.ReencryptObjects()
+	require.NoError(t, err)
+	assert.Equal(t, 0, done)
+
+	r, err = backend.Get(oldKey)
+	require.NoError(t, err)
+	defer r.Close()
+	head := make([]byte, len(cryptMagic))
+	_, err = io.ReadFull(r, head)
+	require.NoError(t, err)
+	assert.Equal(t, cryptMagic, string(head))
+}
+
+func TestReencryptVerify(t *testing.T) {
+	backend := &truncatingBackend{memBackend: newMemBackend()}
+	app := newTestApp(t, backend)
+
+	gz := bytes.NewBuffer(nil)
+	zw := gzip.NewWriter(gz)
+	zw.Write([]byte("old note\n"))
+	require.NoError(t, zw.Close())
+	require.NoError(t, backend.memBackend.Put(app.remotePath("Notes/old/content"), bytes.NewReader(legacyEncrypt(t, &app.Config.S3, gz.Bytes()))))
+
+	// The upload can not be read back
+	done, err := app.ReencryptObjects()
+	assert.ErrorContains(t, err, "failed to verify")
+	assert.Equal(t, 0, done)
+}
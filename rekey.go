@@ -0,0 +1,479 @@
+//
+//  rekey.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package gnotes
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// rekeyState is kept in the notes dir while a rekey is not done, so it can be
+// resumed with the same key. It has no secrets.
+type rekeyState struct {
+	// KDF is the new salt, if changing to a passphrase.
+	KDF *kdfParams `json:"kdf,omitempty"`
+
+	// Check is kdfCheck, encrypted with the new key.
+	Check []byte `json:"check"`
+}
+
+// RekeyReport is what Rekey did.
+type RekeyReport struct {
+	// Reencrypted is the number of objects encrypted with the new key, the
+	// rest already were.
+	Reencrypted int
+
+	// ConfigUpdated is false if the key is not in the config file (like from
+	// the credential_cmd), so it must be changed by hand.
+	ConfigUpdated bool
+}
+
+func (self *SelfApp) rekeyStateFile() string {
+	return filepath.Join(self.Config.App.NoteDir, "rekey.json")
+}
+
+// RekeyPending returns true if a rekey was interrupted, it should be run again
+// with the same key, or passphrase.
+func (self *SelfApp) RekeyPending() bool {
+	_, err := os.Stat(self.rekeyStateFile())
+	return err == nil
+}
+
+// Rekey changes the crypt key to cryptKey, or a key derived from passphrase
+// (only one can be set). Every object is downloaded, decrypted with the old
+// key, and uploaded again with the new key, then checked. Objects that already
+// use the new key are skipped, so if it was interrupted, it can be run again.
+// Only once all objects are done is the config file changed to the new key.
+// The other devices must not change the notes until they have the new key
+// too.
+func (self *SelfApp) Rekey(cryptKey, passphrase string) (*RekeyReport, error) {
+	err := self.checkWritable()
+	if err != nil {
+		return nil, err
+	}
+
+	target := &S3Config{CryptKey: cryptKey, Passphrase: passphrase}
+	err = target.checkCryptKey()
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := self.loadRekeyState(target)
+	if err != nil {
+		return nil, err
+	}
+
+	newConf := &S3Config{CryptKey: target.CryptKey}
+	if state.KDF != nil {
+		newConf.CryptKey = state.KDF.deriveKey(passphrase)
+	}
+
+	if newConf.CryptKey == self.Config.S3.CryptKey {
+		os.Remove(self.rekeyStateFile())
+		return nil, errors.New("the new key is the same as the old one")
+	}
+
+	err = state.checkKey(newConf)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := self.Backend.List(self.remotePath() + "/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	report := &RekeyReport{}
+	var failed []error
+
+	for _, o := range objects {
+		if o.Key == self.kdfPath() || o.Key == self.leasePath() {
+			// Not encrypted, or written again below
+			continue
+		}
+
+		reencrypted, err := self.rekeyObject(o.Key, newConf)
+		if err != nil {
+			log.Printf("Failed to rekey: %s", err)
+			failed = append(failed, err)
+			continue
+		}
+		if reencrypted {
+			report.Reencrypted++
+		}
+	}
+
+	if report.Reencrypted > 0 {
+		if c, ok := self.Backend.(Committer); ok {
+			err = c.Commit(fmt.Sprintf("Rekey %d objects", report.Reencrypted))
+			if err != nil {
+				return report, fmt.Errorf("failed to commit changes: %w", err)
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return report, fmt.Errorf("failed to rekey %d objects, run it again to retry: %w", len(failed), failed[0])
+	}
+
+	// Anything uploaded since, or changed after it was rekeyed, would still
+	// use the old key
+	objects, err = self.Backend.List(self.remotePath() + "/")
+	if err != nil {
+		return report, fmt.Errorf("failed to list objects: %w", err)
+	}
+	for _, o := range objects {
+		if o.Key == self.kdfPath() || o.Key == self.leasePath() {
+			continue
+		}
+
+		err = self.checkObjectKey(o.Key, newConf)
+		if err != nil {
+			return report, fmt.Errorf("%s was uploaded, or changed during the rekey, run it again: %w", o.Key, err)
+		}
+	}
+
+	// Everything uses the new key, now switch to it
+	err = self.switchKey(state, target, newConf, report)
+	if err != nil {
+		return report, err
+	}
+
+	log.Printf("Rekeyed %d objects", report.Reencrypted)
+
+	return report, os.Remove(self.rekeyStateFile())
+}
+
+// loadRekeyState loads the state of a interrupted rekey, or starts a new one.
+func (self *SelfApp) loadRekeyState(target *S3Config) (*rekeyState, error) {
+	state := &rekeyState{}
+
+	b, err := os.ReadFile(self.rekeyStateFile())
+	if err == nil {
+		err = json.Unmarshal(b, state)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse rekey file: %w", err)
+		}
+		if (state.KDF != nil) != (target.Passphrase != "") {
+			return nil, errors.New("a interrupted rekey used a crypt_key, or passphrase, use the same one to finish it")
+		}
+
+		log.Printf("Resuming a interrupted rekey")
+
+		return state, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read rekey file: %w", err)
+	}
+
+	key := target.CryptKey
+	if target.Passphrase != "" {
+		state.KDF, err = newKDFParams()
+		if err != nil {
+			return nil, err
+		}
+		key = state.KDF.deriveKey(target.Passphrase)
+
+		state.KDF.Check, err = (&S3Config{CryptKey: key}).Encrypt([]byte(kdfCheck))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	state.Check, err = (&S3Config{CryptKey: key}).Encrypt([]byte(kdfCheck))
+	if err != nil {
+		return nil, err
+	}
+
+	// Saved before anything is changed, so a resume uses the same salt
+	b, err = json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeFileAtomic(self.rekeyStateFile(), b, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write rekey file: %w", err)
+	}
+
+	return state, nil
+}
+
+// checkKey makes sure a resumed rekey uses the same key.
+func (s *rekeyState) checkKey(c *S3Config) error {
+	b, err := c.Decrypt(s.Check)
+	if err != nil || string(b) != kdfCheck {
+		return errors.New("the key is not the same as the interrupted rekey, use the same one to finish it")
+	}
+
+	return nil
+}
+
+// rekeyObject encrypts a object with the new key, if its not already. Returns
+// true if it was.
+func (self *SelfApp) rekeyObject(key string, newConf *S3Config) (bool, error) {
+	r, err := self.Backend.Get(key)
+	if err != nil {
+		return false, fmt.Errorf("failed to download %s: %w", key, err)
+	}
+
+	encrypted, err := self.createTemp()
+	if err != nil {
+		r.Close()
+		return false, fmt.Errorf("failed to create tmp file: %w", err)
+	}
+	defer os.Remove(encrypted.Name())
+	defer encrypted.Close()
+
+	_, err = io.Copy(encrypted, r)
+	r.Close()
+	if err != nil {
+		return false, fmt.Errorf("failed to download %s: %w", key, err)
+	}
+
+	plain, err := self.createTemp()
+	if err != nil {
+		return false, fmt.Errorf("failed to create tmp file: %w", err)
+	}
+	defer os.Remove(plain.Name())
+	defer plain.Close()
+
+	// Already done if it was interrupted
+	_, err = decryptFile(newConf, encrypted, plain)
+	if err == nil {
+		return false, nil
+	}
+
+	sum, err := decryptFile(&self.Config.S3, encrypted, plain)
+	if err != nil {
+		return false, fmt.Errorf("failed to decrypt %s: %w", key, err)
+	}
+
+	pr, pw := io.Pipe()
+
+	// tmp file -> encrypt -> backend
+	go func() {
+		enc, err := newConf.encryptWriter(pw)
+		if err == nil {
+			_, err = io.Copy(enc, plain)
+		}
+		if err == nil {
+			err = enc.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	err = self.Backend.Put(key, pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		return false, fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+
+	err = self.verifyObject(key, newConf, sum)
+	if err != nil {
+		return false, err
+	}
+
+	log.Printf("Rekeyed: %s", key)
+
+	return true, nil
+}
+
+// verifyObject downloads a object that was just uploaded, to make sure it can
+// be decrypted with c, and matches the checksum of what was uploaded.
+func (self *SelfApp) verifyObject(key string, c *S3Config, sum Checksum) error {
+	r, err := self.Backend.Get(key)
+	if err != nil {
+		return fmt.Errorf("failed to verify %s: %w", key, err)
+	}
+	defer r.Close()
+
+	dec, err := c.decryptReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to verify %s: %w", key, err)
+	}
+
+	h := newChecksumWriter()
+	_, err = io.Copy(h, dec)
+	if err != nil {
+		return fmt.Errorf("failed to verify %s: %w", key, err)
+	}
+	if h.Sum() != sum {
+		return fmt.Errorf("failed to verify %s: %w", key, ErrChecksumMismatch)
+	}
+
+	return nil
+}
+
+// checkObjectKey makes sure a object can be decrypted with c.
+func (self *SelfApp) checkObjectKey(key string, c *S3Config) error {
+	r, err := self.Backend.Get(key)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	defer r.Close()
+
+	dec, err := c.decryptReader(r)
+	if err != nil {
+		return err
+	}
+
+	// The old format can not tell if it was decrypted with the right key
+	zr, err := gzip.NewReader(dec)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(io.Discard, zr)
+
+	return err
+}
+
+// decryptFile decrypts src to dst, and returns the checksum of the decrypted
+// data. Both files are rewound.
+func decryptFile(c *S3Config, src, dst *os.File) (Checksum, error) {
+	for _, f := range []*os.File{src, dst} {
+		_, err := f.Seek(0, io.SeekStart)
+		if err != nil {
+			return Checksum{}, err
+		}
+	}
+
+	err := dst.Truncate(0)
+	if err != nil {
+		return Checksum{}, err
+	}
+
+	dec, err := c.decryptReader(src)
+	if err != nil {
+		return Checksum{}, err
+	}
+
+	h := newChecksumWriter()
+	_, err = io.Copy(io.MultiWriter(dst, h), dec)
+	if err != nil {
+		return Checksum{}, err
+	}
+
+	// The old format can not tell if it was decrypted with the right key
+	err = checkGzip(dst)
+	if err != nil {
+		return Checksum{}, err
+	}
+
+	return h.Sum(), nil
+}
+
+// switchKey changes to the new key, once all the objects use it.
+func (self *SelfApp) switchKey(state *rekeyState, target, newConf *S3Config, report *RekeyReport) error {
+	if state.KDF != nil {
+		err := self.saveKDFParams(state.KDF)
+		if err != nil {
+			return err
+		}
+	} else if self.Config.S3.Passphrase != "" {
+		// Not needed for a crypt_key
+		err := self.Backend.Delete(self.kdfPath())
+		if err != nil && !errors.Is(err, ErrObjectNotFound) {
+			return fmt.Errorf("failed to delete kdf file: %w", err)
+		}
+
+		err = os.Remove(self.kdfCacheFile())
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to delete kdf file: %w", err)
+		}
+	}
+
+	var err error
+	if self.configFile != "" {
+		report.ConfigUpdated, err = setConfigKey(self.configFile, target)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The lease is renewed in the background, with the key
+	self.leaseMu.Lock()
+	defer self.leaseMu.Unlock()
+
+	self.Config.S3.CryptKey = newConf.CryptKey
+	self.Config.S3.Passphrase = target.Passphrase
+
+	if self.lock != nil && self.Config.App.RemoteLock {
+		err = self.writeLease(self.lock)
+		if err != nil {
+			log.Printf("%s", err)
+		}
+	}
+
+	return nil
+}
+
+// setConfigKey changes the crypt_key, or passphrase in the [s3] section of the
+// config file. Returns false if neither are in the file.
+func setConfigKey(configFile string, c *S3Config) (bool, error) {
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	b, err := os.ReadFile(configFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	keyLine := "crypt_key = " + c.CryptKey
+	if c.Passphrase != "" {
+		keyLine = "passphrase = " + c.Passphrase
+	}
+
+	lines := []string{}
+	section := ""
+	replaced := false
+
+	for _, line := range strings.Split(string(b), "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			section = trimmed
+		} else if name, _, ok := strings.Cut(trimmed, "="); ok && section == "[s3]" {
+			name = strings.TrimSpace(name)
+			if name == "crypt_key" || name == "passphrase" {
+				if !replaced {
+					lines = append(lines, keyLine)
+					replaced = true
+				}
+				continue
+			}
+		}
+
+		lines = append(lines, line)
+	}
+
+	if !replaced {
+		return false, nil
+	}
+
+	err = writeFileAtomic(configFile, []byte(strings.Join(lines, "\n")), info.Mode().Perm())
+	if err != nil {
+		return false, fmt.Errorf("failed to write config: %w", err)
+	}
+
+	return true, nil
+}
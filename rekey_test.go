@@ -0,0 +1,164 @@
+package gnotes
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const newCryptKey = "Z8xq2LmN4vB7cR1tY5wK9pD3hF6jS0aG"
+
+// listHookBackend calls onList before every listing, with the number of
+// listings so far.
+type listHookBackend struct {
+	*memBackend
+	lists  int
+	onList func(n int)
+}
+
+func (lb *listHookBackend) List(prefix string) ([]ObjectInfo, error) {
+	lb.lists++
+	lb.onList(lb.lists)
+
+	return lb.memBackend.List(prefix)
+}
+
+func TestRekey(t *testing.T) {
+	backend := newMemBackend()
+	app := newTestApp(t, backend)
+
+	app.configFile = filepath.Join(t.TempDir(), "config.ini")
+	require.NoError(t, os.WriteFile(app.configFile, []byte("[settings]\neditor = vim\n\n[s3]\n# The key\ncrypt_key = DpiJ1QaSh25O1Kt3\nuser_id = test-user\n"), 0600))
+
+	addNote(t, app, "hello\n")
+
+	// A object in the old format
+	gz := bytes.NewBuffer(nil)
+	zw := gzip.NewWriter(gz)
+	zw.Write([]byte("old note\n"))
+	require.NoError(t, zw.Close())
+	oldKey := app.remotePath("Notes/old/content")
+	require.NoError(t, backend.Put(oldKey, bytes.NewReader(legacyEncrypt(t, &app.Config.S3, gz.Bytes()))))
+
+	// Interrupted by something that can not be decrypted
+	badKey := app.remotePath("Notes/bad/content")
+	require.NoError(t, backend.Put(badKey, strings.NewReader("not a gnotes object")))
+
+	report, err := app.Rekey(newCryptKey, "")
+	assert.Error(t, err)
+	assert.True(t, app.RekeyPending())
+
+	// The config is not switched yet
+	assert.Equal(t, "DpiJ1QaSh25O1Kt3", app.Config.S3.CryptKey)
+	config, err := os.ReadFile(app.configFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(config), "crypt_key = DpiJ1QaSh25O1Kt3\n")
+
+	// It can only be resumed with the same key
+	_, err = app.Rekey("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", "")
+	assert.Error(t, err)
+	_, err = app.Rekey("", "a passphrase")
+	assert.Error(t, err)
+
+	require.NoError(t, backend.Delete(badKey))
+
+	done := report.Reencrypted
+	report, err = app.Rekey(newCryptKey, "")
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.Reencrypted, "already done")
+	assert.True(t, report.ConfigUpdated)
+	assert.False(t, app.RekeyPending())
+	assert.Equal(t, 4, done)
+
+	assert.Equal(t, newCryptKey, app.Config.S3.CryptKey)
+	config, err = os.ReadFile(app.configFile)
+	require.NoError(t, err)
+	assert.Equal(t, "[settings]\neditor = vim\n\n[s3]\n# The key\ncrypt_key = "+newCryptKey+"\nuser_id = test-user\n", string(config))
+
+	c, err := LoadConfig(app.configFile)
+	require.NoError(t, err)
+	assert.Equal(t, newCryptKey, c.S3.CryptKey)
+
+	// Another device with the new key can read everything
+	other := newTestApp(t, backend)
+	other.Config.S3.CryptKey = newCryptKey
+	require.NoError(t, other.LoadNotes())
+	assert.Equal(t, "hello\n", readNote(t, other, other.Notes.Books[0].Notes[0]))
+
+	b, err := other.downloadBytes(oldKey)
+	require.NoError(t, err)
+	assert.Equal(t, "old note\n", string(b))
+
+	// But not with the old one
+	old := newTestApp(t, backend)
+	assert.Error(t, old.LoadNotes())
+}
+
+func TestRekeyPassphrase(t *testing.T) {
+	backend := newMemBackend()
+	app := newTestApp(t, backend)
+
+	app.configFile = filepath.Join(t.TempDir(), "config.ini")
+	require.NoError(t, os.WriteFile(app.configFile, []byte("[s3]\ncrypt_key = DpiJ1QaSh25O1Kt3\n"), 0600))
+
+	addNote(t, app, "hello\n")
+
+	report, err := app.Rekey("", "correct horse battery staple")
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Reencrypted)
+
+	config, err := os.ReadFile(app.configFile)
+	require.NoError(t, err)
+	assert.Equal(t, "[s3]\npassphrase = correct horse battery staple\n", string(config))
+
+	// Another device unlocks with the passphrase
+	other, err := newPassphraseApp(t, backend, "correct horse battery staple")
+	require.NoError(t, err)
+	assert.Equal(t, app.Config.S3.CryptKey, other.Config.S3.CryptKey)
+	require.NoError(t, other.LoadNotes())
+	assert.Len(t, other.Notes.Books[0].Notes, 1)
+
+	// And back to a crypt_key, the salt is not needed anymore
+	self = app
+	_, err = app.Rekey(newCryptKey, "")
+	require.NoError(t, err)
+
+	_, err = backend.Stat(app.kdfPath())
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+	assert.Equal(t, "", app.Config.S3.Passphrase)
+}
+
+func TestRekeyChangedObject(t *testing.T) {
+	backend := &listHookBackend{memBackend: newMemBackend(), onList: func(int) {}}
+	app := newTestApp(t, backend)
+	n := addNote(t, app, "hello\n")
+
+	// Another device saves the note with the old key, after it was rekeyed
+	backend.onList = func(lists int) {
+		if lists == 2 {
+			require.NoError(t, app.uploadBytes(app.remotePath(n.S3Path), []byte("changed\n")))
+		}
+	}
+
+	_, err := app.Rekey(newCryptKey, "")
+	assert.ErrorContains(t, err, "run it again")
+	assert.True(t, app.RekeyPending())
+	assert.NotEqual(t, newCryptKey, app.Config.S3.CryptKey)
+
+	// Running it again rekeys the changed note
+	backend.onList = func(int) {}
+	report, err := app.Rekey(newCryptKey, "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Reencrypted)
+	assert.Equal(t, newCryptKey, app.Config.S3.CryptKey)
+
+	b, err := app.downloadBytes(app.remotePath(n.S3Path))
+	require.NoError(t, err)
+	assert.Equal(t, "changed\n", string(b))
+}
@@ -0,0 +1,274 @@
+//
+//  revisions.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package gnotes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default revision retention, if not set in the config file.
+const (
+	defaultMaxRevisions   = 20
+	defaultMaxRevisionAge = 90
+)
+
+var ErrRevisionNotFound = errors.New("revision not found")
+
+// Revision is a older version of a note. Its stored as a separate object next
+// to the note, eg. "catigory/uuid-1/revisions/<id>".
+type Revision struct {
+	ID string `json:"id"`
+
+	// Modified is when this version of the note was changed, and Saved is
+	// when it was kept as a revision.
+	Modified int64  `json:"modified"`
+	Saved    int64  `json:"saved,omitempty"`
+	Hash     string `json:"hash"`
+}
+
+// savedAt returns when the revision was saved. Older revisions have no Saved,
+// but the id is the time it was saved.
+func (r *Revision) savedAt() int64 {
+	if r.Saved != 0 {
+		return r.Saved
+	}
+
+	ns, err := strconv.ParseInt(r.ID, 10, 64)
+	if err != nil {
+		return r.Modified
+	}
+
+	return time.Unix(0, ns).Unix()
+}
+
+// revisionPath returns the backend path for a revision of a note.
+func (n *Note) revisionPath(id string) string {
+	return filepath.Join(filepath.Dir(n.S3Path), "revisions", id)
+}
+
+// FindRevision returns the revision with the id, or a unique prefix of it.
+func (n *Note) FindRevision(id string) (*Revision, error) {
+	var found *Revision
+
+	for _, r := range n.Revisions {
+		if r.ID == id {
+			return r, nil
+		}
+		if strings.HasPrefix(r.ID, id) {
+			if found != nil {
+				return nil, fmt.Errorf("revision id is not unique: %s", id)
+			}
+			found = r
+		}
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("%w: %s", ErrRevisionNotFound, id)
+	}
+
+	return found, nil
+}
+
+// saveRevision keeps the current remote version of a note as a revision,
+// before its replaced.
+func (self *SelfApp) saveRevision(n *Note) error {
+	now := time.Now()
+	rev := &Revision{
+		ID:       strconv.FormatInt(now.UnixNano(), 10),
+		Modified: n.Modified,
+		Saved:    now.Unix(),
+		Hash:     n.Hash,
+	}
+
+	if self.baseSum(n.S3Path).Matches(n.Hash) {
+		// The last synced copy is the current remote version
+		_, err := self.uploadFile(self.baseFile(n.S3Path), self.remotePath(n.revisionPath(rev.ID)))
+		if err != nil {
+			return fmt.Errorf("failed to upload revision: %w", err)
+		}
+	} else {
+		if len(n.Deltas) > 0 {
+			return fmt.Errorf("no synced copy of note with deltas: %s", n.S3Path)
+		}
+
+		// The object is already encrypted, so its just copied
+		r, err := self.Backend.Get(self.remotePath(n.S3Path))
+		if err != nil {
+			return fmt.Errorf("failed to read note for revision: %w", err)
+		}
+		defer r.Close()
+
+		err = self.Backend.Put(self.remotePath(n.revisionPath(rev.ID)), r)
+		if err != nil {
+			return fmt.Errorf("failed to upload revision: %w", err)
+		}
+	}
+
+	log.Printf("Saved revision %s of %s", rev.ID, n.S3Path)
+
+	n.Revisions = append(n.Revisions, rev)
+
+	self.pruneRevisions(n)
+
+	return nil
+}
+
+// pruneRevisions removes the oldest revisions, more then max_revisions, and
+// saved more then max_revision_age days ago.
+func (self *SelfApp) pruneRevisions(n *Note) {
+	maxCount := self.Config.App.MaxRevisions
+	if maxCount <= 0 {
+		maxCount = defaultMaxRevisions
+	}
+
+	var minSaved int64
+	if self.Config.App.MaxRevisionAge > 0 {
+		minSaved = time.Now().AddDate(0, 0, -self.Config.App.MaxRevisionAge).Unix()
+	}
+
+	// Revisions are always added to the end, so the oldest are first
+	keep := []*Revision{}
+	for i, r := range n.Revisions {
+		if len(n.Revisions)-i > maxCount || r.savedAt() < minSaved {
+			self.deleteRevision(n, r)
+			continue
+		}
+		keep = append(keep, r)
+	}
+
+	n.Revisions = keep
+}
+
+// deleteRevision deletes a revision object, or later if offline.
+func (self *SelfApp) deleteRevision(n *Note, r *Revision) {
+	self.deleteLater(self.remotePath(n.revisionPath(r.ID)))
+}
+
+// deleteRevisions deletes all the revisions of a note, like when its deleted.
+func (self *SelfApp) deleteRevisions(n *Note) {
+	for _, r := range n.Revisions {
+		self.deleteRevision(n, r)
+	}
+	n.Revisions = nil
+}
+
+// ReadRevision will download, and decrypt a revision of a note.
+func (self *SelfApp) ReadRevision(n *Note, id string) ([]byte, error) {
+	r, err := n.FindRevision(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return self.downloadBytes(self.remotePath(n.revisionPath(r.ID)))
+}
+
+// DiffRevision returns a line diff from a revision to the current cached note.
+func (self *SelfApp) DiffRevision(n *Note, id string) (string, error) {
+	old, err := self.ReadRevision(n, id)
+	if err != nil {
+		return "", err
+	}
+
+	current, err := os.ReadFile(filepath.Join(self.Config.App.NoteDir, "notes", n.S3Path))
+	if err != nil {
+		return "", fmt.Errorf("failed to read note: %w", err)
+	}
+
+	return diffLines(string(old), string(current)), nil
+}
+
+// RestoreRevision replaces a note with one of its revisions. The current
+// version is kept as a new revision, so this can be undone.
+func (b *Book) RestoreRevision(noteIndex int, id string) error {
+	err := self.checkWritable()
+	if err != nil {
+		return err
+	}
+
+	n := b.Notes[noteIndex]
+
+	old, err := self.ReadRevision(n, id)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(filepath.Join(self.Config.App.NoteDir, "notes", n.S3Path), old, 0664)
+	if err != nil {
+		return fmt.Errorf("failed to restore revision: %w", err)
+	}
+
+	return b.SaveNoteIndex(noteIndex)
+}
+
+// diffLines returns a simple line diff from a to b, lines starting with "-"
+// are removed and "+" are added.
+func diffLines(a, b string) string {
+	aLines := splitLines(a)
+	bLines := splitLines(b)
+	match := lcsMatch(aLines, bLines)
+
+	out := &strings.Builder{}
+	line := func(prefix, s string) {
+		out.WriteString(prefix + strings.TrimSuffix(s, "\n") + "\n")
+	}
+
+	j := 0
+	for i, l := range aLines {
+		if match[i] == -1 {
+			line("-", l)
+			continue
+		}
+		for ; j < match[i]; j++ {
+			line("+", bLines[j])
+		}
+		line(" ", l)
+		j++
+	}
+	for ; j < len(bLines); j++ {
+		line("+", bLines[j])
+	}
+
+	return out.String()
+}
+
+// FindNote returns the book, and index of a note by its id (the uuid in its
+// path, or a unique prefix of it), or by its title.
+func (nb *NoteBook) FindNote(query string) (*Book, int, error) {
+	var foundBook *Book
+	foundIndex := -1
+
+	for _, b := range nb.Books {
+		for i, n := range b.Notes {
+			id := filepath.Base(filepath.Dir(n.S3Path))
+			if !strings.HasPrefix(id, query) && !strings.Contains(strings.ToLower(n.Title), strings.ToLower(query)) {
+				continue
+			}
+			if foundBook != nil {
+				return nil, -1, fmt.Errorf("more then one note matches: %s", query)
+			}
+			foundBook, foundIndex = b, i
+		}
+	}
+
+	if foundBook == nil {
+		return nil, -1, fmt.Errorf("no note matches: %s", query)
+	}
+
+	return foundBook, foundIndex, nil
+}
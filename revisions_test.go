@@ -0,0 +1,118 @@
+package gnotes
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevisions(t *testing.T) {
+	backend := newMemBackend()
+
+	app := newTestApp(t, backend)
+	app.Config.App.KeepRevisions = true
+	app.Config.App.MaxRevisions = 2
+
+	n := addNote(t, app, "v1\n")
+	for _, content := range []string{"v2\n", "v3\n", "v4\n"} {
+		editNote(t, app, n, content)
+	}
+
+	// v1 should of been removed
+	require.Len(t, n.Revisions, 2)
+	objects, err := backend.List(app.remotePath(filepath.Dir(n.S3Path), "revisions"))
+	require.NoError(t, err)
+	assert.Len(t, objects, 2)
+
+	b, err := app.ReadRevision(n, n.Revisions[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, "v2\n", string(b))
+
+	diff, err := app.DiffRevision(n, n.Revisions[1].ID)
+	require.NoError(t, err)
+	assert.Equal(t, "-v3\n+v4\n", diff)
+
+	// Restoring keeps the current version as a revision
+	book := app.Notes.GetSelected()
+	require.NoError(t, book.RestoreRevision(0, n.Revisions[0].ID))
+	b, err = os.ReadFile(notePath(app, n))
+	require.NoError(t, err)
+	assert.Equal(t, "v2\n", string(b))
+	require.Len(t, n.Revisions, 2)
+
+	b, err = app.ReadRevision(n, n.Revisions[1].ID)
+	require.NoError(t, err)
+	assert.Equal(t, "v4\n", string(b))
+
+	_, err = n.FindRevision("foo")
+	assert.ErrorIs(t, err, ErrRevisionNotFound)
+
+	// Deleting the note removes all the revisions
+	require.NoError(t, book.DeleteNote(0))
+	require.NoError(t, app.Notes.EmptyTrash())
+	objects, err = backend.List(app.remotePath(filepath.Dir(n.S3Path)))
+	require.NoError(t, err)
+	assert.Empty(t, objects)
+}
+
+func TestRevisionAge(t *testing.T) {
+	backend := newMemBackend()
+
+	app := newTestApp(t, backend)
+	app.Config.App.KeepRevisions = true
+	app.Config.App.MaxRevisions = 10
+	app.Config.App.MaxRevisionAge = 90
+
+	n := addNote(t, app, "v1\n")
+
+	// A note that was not changed in a long time still keeps its history
+	old := time.Now().AddDate(0, 0, -200).Unix()
+	n.Modified = old
+
+	editNote(t, app, n, "v2\n")
+	require.Len(t, n.Revisions, 1)
+	assert.Equal(t, old, n.Revisions[0].Modified)
+
+	b, err := app.ReadRevision(n, n.Revisions[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, "v1\n", string(b))
+
+	// But revisions saved too long ago are removed
+	n.Revisions[0].Saved = old
+
+	editNote(t, app, n, "v3\n")
+	require.Len(t, n.Revisions, 1)
+
+	b, err = app.ReadRevision(n, n.Revisions[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, "v2\n", string(b))
+}
+
+func TestDiffLines(t *testing.T) {
+	assert.Equal(t, " a\n-b\n+B\n c\n+d\n", diffLines("a\nb\nc\n", "a\nB\nc\nd\n"))
+	assert.Equal(t, "+a\n", diffLines("", "a"))
+}
+
+func TestFindNote(t *testing.T) {
+	nb := &NoteBook{Books: []*Book{
+		{Name: "Notes", Notes: []*Note{
+			{S3Path: "Notes/1234-abcd/content", Title: "Shopping list"},
+			{S3Path: "Notes/5678-efgh/content", Title: "Todo"},
+		}},
+	}}
+
+	b, i, err := nb.FindNote("5678")
+	require.NoError(t, err)
+	assert.Equal(t, "Todo", b.Notes[i].Title)
+
+	_, i, err = nb.FindNote("shopping")
+	require.NoError(t, err)
+	assert.Equal(t, 0, i)
+
+	_, _, err = nb.FindNote("o")
+	assert.Error(t, err)
+}
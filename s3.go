@@ -14,203 +14,159 @@
 package gnotes
 
 import (
+	"bytes"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
-	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
-func (c S3Config) UploadFile(local, to string) error {
-	// gzip the file first
-	encFile, err := c.GzipAndEncrypt(local)
-	if err != nil {
-		return fmt.Errorf("failed to compress and encrypt file: %w", err)
-	}
-
-	s3Config := &aws.Config{
-		Credentials:      credentials.NewStaticCredentials(c.AccessKey, c.SecretKey, ""),
-		Endpoint:         aws.String(c.Endpoint),
-		Region:           aws.String(c.Region),
-		DisableSSL:       aws.Bool(true),
-		S3ForcePathStyle: aws.Bool(true),
-	}
-
-	newSession, err := session.NewSession(s3Config)
-	if err != nil {
-		return fmt.Errorf("error creating session: %s", err)
-	}
-
-	s3Client := s3.New(newSession)
-
-	bucket := aws.String(c.Bucket)
-	uploadFile := aws.String(to)
+// S3Backend stores all the objects in a S3 bucket. The session and client are
+// created once, and reused for every request.
+type S3Backend struct {
+	config S3Config
+	client *s3.S3
 
-	cparams := &s3.CreateBucketInput{
-		Bucket: bucket,
-	}
-
-	_, err = s3Client.CreateBucket(cparams)
-	if err != nil {
-		return err
-	}
+	// uploader does multipart uploads, so large attachments can be streamed
+	// without reading them into memory.
+	uploader *s3manager.Uploader
+}
 
-	f, err := os.ReadFile(encFile)
+func NewS3Backend(c S3Config) (*S3Backend, error) {
+	httpClient, err := c.httpClient()
 	if err != nil {
-		return fmt.Errorf("failed to read file to upload: %s", err)
+		return nil, err
 	}
 
-	_, err = s3Client.PutObject(&s3.PutObjectInput{
-		Body:   strings.NewReader(string(f)),
-		Bucket: bucket,
-		Key:    uploadFile,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to upload data to %s/%s, %s", c.Bucket, to, err)
+	if c.TLS && strings.HasPrefix(c.Endpoint, "http://") {
+		log.Printf("WARNING: s3 endpoint is plain http, credentials and notes will not use TLS: %s", c.Endpoint)
 	}
 
-	log.Printf("Uploaded: %s/%s <- %s (%v bytes)", c.Bucket, to, local, len(f))
-
-	return nil
-}
-
-func (c S3Config) DownloadFileFrom(s3File, endPath string) error {
-	endPath += ".enc"
-
-	bucket := aws.String(c.Bucket)
-
 	s3Config := &aws.Config{
-		Credentials:      credentials.NewStaticCredentials(c.AccessKey, c.SecretKey, ""),
+		Credentials:      c.credentials(),
 		Endpoint:         aws.String(c.Endpoint),
 		Region:           aws.String(c.Region),
-		DisableSSL:       aws.Bool(true),
-		S3ForcePathStyle: aws.Bool(true),
+		DisableSSL:       aws.Bool(!c.TLS),
+		S3ForcePathStyle: aws.Bool(c.PathStyle),
+		HTTPClient:       httpClient,
 	}
-	newSession, err := session.NewSession(s3Config)
-	if err != nil {
-		return fmt.Errorf("error creating session: %s", err)
+
+	opts := session.Options{
+		Config: *s3Config,
 	}
 
-	// Create the base dir if it does not exist
-	baseDir := filepath.Dir(endPath)
-	if _, err := os.Stat(baseDir); os.IsNotExist(err) {
-		err := os.MkdirAll(baseDir, 0755)
+	// Let the sdk load the ca bundle, so it takes priority over AWS_CA_BUNDLE
+	if c.CABundle != "" {
+		pem, err := os.ReadFile(c.CABundle)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("failed to read ca bundle: %w", err)
 		}
+		opts.CustomCABundle = bytes.NewReader(pem)
 	}
 
-	file, err := os.Create(endPath)
+	newSession, err := session.NewSessionWithOptions(opts)
 	if err != nil {
-		return fmt.Errorf("failed to create output file: %s", err)
+		return nil, fmt.Errorf("error creating session: %s", err)
 	}
-	defer file.Close()
 
-	downloader := s3manager.NewDownloader(newSession)
-	numBytes, err := downloader.Download(file,
-		&s3.GetObjectInput{
-			Bucket: bucket,
-			Key:    aws.String(s3File),
-		})
-	if err != nil {
-		return fmt.Errorf("failed to download file: %s: %w", s3File, err)
-	}
+	return &S3Backend{
+		config:   c,
+		client:   s3.New(newSession),
+		uploader: s3manager.NewUploader(newSession),
+	}, nil
+}
 
-	log.Printf("Downloaded: %s/%s -> %s (%v bytes)", c.Bucket, s3File, file.Name(), numBytes)
+// httpClient returns the http client with the TLS verify and timeout options
+// from the config.
+func (c S3Config) httpClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
 
-	// Decrypt, and ungzip it
-	err = c.DecryptAndDeGzip(endPath)
-	if err != nil {
-		return fmt.Errorf("failed to decrypt and de-gzip data: %w", err)
+	if c.InsecureSkipVerify {
+		log.Printf("WARNING: s3 certificate verification is disabled")
 	}
 
-	return nil
+	transport := timeoutTransport(c.Timeout)
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{Transport: transport}, nil
 }
 
-func (c S3Config) DecryptAndDeGzip(file string) error {
-	downloadedBytes, err := os.ReadFile(file)
-	if err != nil {
-		return err
-	}
+// timeoutTransport returns a http transport that will timeout after seconds
+// connecting, and waiting for a response. Large attachments can take longer
+// then that to upload, so there is no timeout for the whole request. 0 for no
+// timeout.
+func timeoutTransport(seconds int) *http.Transport {
+	timeout := time.Duration(seconds) * time.Second
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSHandshakeTimeout = timeout
+	transport.ResponseHeaderTimeout = timeout
+	transport.DialContext = (&net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+
+	return transport
+}
 
-	downloadedBytes, err = c.Decrypt(downloadedBytes)
-	if err != nil {
-		return fmt.Errorf("failed to decrypt data: %s", err)
-	}
+func (b *S3Backend) Put(key string, r io.Reader) error {
+	bucket := aws.String(b.config.Bucket)
 
-	// Remove the old file (it has a .enc suffix)
-	err = os.Remove(file)
-	if err != nil {
-		return fmt.Errorf("failed to cleanup old file: %w", err)
+	cparams := &s3.CreateBucketInput{
+		Bucket: bucket,
 	}
 
-	// Remove any .enc suffix
-	file = strings.TrimSuffix(file, ".enc")
-
-	downloadedBytes, err = gzipExtract(downloadedBytes)
+	_, err := b.client.CreateBucket(cparams)
 	if err != nil {
 		return err
 	}
 
-	err = os.WriteFile(file, downloadedBytes, 0664)
+	_, err = b.uploader.Upload(&s3manager.UploadInput{
+		Body:   r,
+		Bucket: bucket,
+		Key:    aws.String(key),
+	})
 	if err != nil {
-		return fmt.Errorf("failed to write output file: %w", err)
+		return fmt.Errorf("failed to upload data to %s/%s, %s", b.config.Bucket, key, err)
 	}
 
-	log.Printf("Decrypted -> decompressed -> %s", file)
-
 	return nil
 }
 
-func (c S3Config) GzipAndEncrypt(file string) (string, error) {
-	compressed, err := gzipCompressFile(file)
-	if err != nil {
-		return "", err
-	}
-
-	enc, err := c.Encrypt(compressed)
-	if err != nil {
-		return "", fmt.Errorf("failed to decrypt data: %s", err)
-	}
-
-	newFile := file + ".enc"
-
-	err = os.WriteFile(newFile, enc, 0664)
+func (b *S3Backend) Get(key string) (io.ReadCloser, error) {
+	out, err := b.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(b.config.Bucket),
+		Key:    aws.String(key),
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to write to file: %w", err)
+		if isS3NotFound(err) {
+			return nil, fmt.Errorf("%s/%s: %w", b.config.Bucket, key, ErrObjectNotFound)
+		}
+		return nil, fmt.Errorf("failed to download file: %s: %w", key, err)
 	}
 
-	log.Printf("Compressed -> encrypted -> %s", file)
-
-	return newFile, nil
+	return out.Body, nil
 }
 
-func (c S3Config) Delete(s3File string) error {
-	s3Config := &aws.Config{
-		Credentials:      credentials.NewStaticCredentials(c.AccessKey, c.SecretKey, ""),
-		Endpoint:         aws.String(c.Endpoint),
-		Region:           aws.String(c.Region),
-		DisableSSL:       aws.Bool(true),
-		S3ForcePathStyle: aws.Bool(true),
-	}
-
-	newSession, err := session.NewSession(s3Config)
-	if err != nil {
-		return fmt.Errorf("error creating session: %s", err)
-	}
-
-	svc := s3.New(newSession)
-
-	bucket := aws.String(c.Bucket)
-	deleteFile := aws.String(s3File)
+func (b *S3Backend) Delete(key string) error {
+	bucket := aws.String(b.config.Bucket)
+	deleteFile := aws.String(key)
 
-	_, err = svc.DeleteObject(&s3.DeleteObjectInput{
+	_, err := b.client.DeleteObject(&s3.DeleteObjectInput{
 		Bucket: bucket,
 		Key:    deleteFile,
 	})
@@ -218,7 +174,7 @@ func (c S3Config) Delete(s3File string) error {
 		return fmt.Errorf("failed to call delete object: %s", err)
 	}
 
-	err = svc.WaitUntilObjectNotExists(&s3.HeadObjectInput{
+	err = b.client.WaitUntilObjectNotExists(&s3.HeadObjectInput{
 		Bucket: bucket,
 		Key:    deleteFile,
 	})
@@ -226,7 +182,63 @@ func (c S3Config) Delete(s3File string) error {
 		return fmt.Errorf("failed to wait for delete")
 	}
 
-	fmt.Printf("Successfully deleted file: %s\n", s3File)
+	fmt.Printf("Successfully deleted file: %s\n", key)
 
 	return nil
 }
+
+func (b *S3Backend) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	err := b.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(b.config.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, o := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:      aws.StringValue(o.Key),
+				Size:     aws.Int64Value(o.Size),
+				Modified: aws.TimeValue(o.LastModified),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %s: %w", prefix, err)
+	}
+
+	return objects, nil
+}
+
+func (b *S3Backend) Stat(key string) (*ObjectInfo, error) {
+	out, err := b.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(b.config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, fmt.Errorf("%s/%s: %w", b.config.Bucket, key, ErrObjectNotFound)
+		}
+		return nil, fmt.Errorf("failed to stat object: %s: %w", key, err)
+	}
+
+	return &ObjectInfo{
+		Key:      key,
+		Size:     aws.Int64Value(out.ContentLength),
+		Modified: aws.TimeValue(out.LastModified),
+	}, nil
+}
+
+// isS3NotFound returns true if the error is a missing object error. HeadObject
+// has no body, so it only returns "NotFound".
+func isS3NotFound(err error) bool {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return true
+		}
+	}
+
+	return false
+}
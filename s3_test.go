@@ -0,0 +1,63 @@
+package gnotes
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3BackendTLS(t *testing.T) {
+	var gotPath string
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		w.Header().Set("Content-Length", "42")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	conf := defaultConfig().S3
+	conf.Endpoint = srv.URL
+	conf.Region = "us-east-1"
+	conf.Bucket = "gnotes"
+	conf.AccessKey = "ACCESS_KEY"
+	conf.SecretKey = "SECRET_KEY"
+
+	// Self-signed, so should fail by default
+	b, err := NewS3Backend(conf)
+	require.NoError(t, err)
+	_, err = b.Stat("user/notes/index.json")
+	assert.ErrorContains(t, err, "certificate")
+
+	// Trust the server cert
+	caBundle := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caBundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600))
+
+	conf.CABundle = caBundle
+	b, err = NewS3Backend(conf)
+	require.NoError(t, err)
+	info, err := b.Stat("user/notes/index.json")
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), info.Size)
+	assert.Equal(t, "/gnotes/user/notes/index.json", gotPath)
+
+	// Or skip verifying
+	conf.CABundle = ""
+	conf.InsecureSkipVerify = true
+	b, err = NewS3Backend(conf)
+	require.NoError(t, err)
+	_, err = b.Stat("user/notes/index.json")
+	require.NoError(t, err)
+
+	// Invalid ca bundle
+	require.NoError(t, os.WriteFile(caBundle, []byte("foo"), 0600))
+	conf.CABundle = caBundle
+	_, err = NewS3Backend(conf)
+	assert.Error(t, err)
+}
@@ -0,0 +1,191 @@
+//
+//  storage.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package gnotes
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// remotePath returns the backend key for a path relative to the users notes
+// dir, eg. "user-id/notes/index.json".
+func (self *SelfApp) remotePath(elem ...string) string {
+	return filepath.Join(append([]string{self.Config.S3.UserID, "notes"}, elem...)...)
+}
+
+// UploadFile will compress, encrypt and upload a local file to the backend.
+// The file is streamed, so it is never read into memory.
+func (self *SelfApp) UploadFile(local, to string) error {
+	_, err := self.uploadFile(local, to)
+	return err
+}
+
+// uploadFile is the same as UploadFile, but also returns the checksum of the
+// data that was uploaded.
+func (self *SelfApp) uploadFile(local, to string) (Checksum, error) {
+	f, err := os.Open(local)
+	if err != nil {
+		return Checksum{}, fmt.Errorf("failed to read file to upload: %s", err)
+	}
+	defer f.Close()
+
+	h := newChecksumWriter()
+	pr, pw := io.Pipe()
+
+	// file -> checksum -> gzip -> encrypt -> backend
+	go func() {
+		pw.CloseWithError(self.Config.S3.GzipAndEncrypt(pw, io.TeeReader(f, h)))
+	}()
+
+	err = self.Backend.Put(to, pr)
+	// Make sure the writer does not block forever if the upload failed
+	pr.CloseWithError(err)
+	if err != nil {
+		return Checksum{}, err
+	}
+
+	log.Printf("Uploaded: %s <- %s", to, local)
+
+	return h.Sum(), nil
+}
+
+// DownloadFileFrom will download a object from the backend, then decrypt and
+// decompress it to endPath.
+func (self *SelfApp) DownloadFileFrom(remote, endPath string) error {
+	_, err := self.downloadFile(remote, endPath)
+	return err
+}
+
+// downloadFile is the same as DownloadFileFrom, but also returns the checksum
+// of the downloaded file.
+func (self *SelfApp) downloadFile(remote, endPath string) (Checksum, error) {
+	return self.downloadVerified(remote, endPath, "")
+}
+
+// downloadVerified is the same as downloadFile, but if want is set the
+// download must match it. Otherwise endPath is not changed, the download is
+// quarantined, and a ChecksumError is returned.
+func (self *SelfApp) downloadVerified(remote, endPath, want string) (Checksum, error) {
+	// Create the base dir if it does not exist
+	baseDir := filepath.Dir(endPath)
+	if _, err := os.Stat(baseDir); os.IsNotExist(err) {
+		err := os.MkdirAll(baseDir, 0755)
+		if err != nil {
+			return Checksum{}, err
+		}
+	}
+
+	r, err := self.Backend.Get(remote)
+	if err != nil {
+		return Checksum{}, err
+	}
+	defer r.Close()
+
+	// Write to the private tmp dir first, so a failed download never leaves a
+	// partial file in the notes cache.
+	file, err := self.createTemp()
+	if err != nil {
+		return Checksum{}, fmt.Errorf("failed to create output file: %s", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	// backend -> decrypt -> gunzip -> checksum + file
+	h := newChecksumWriter()
+	err = self.Config.S3.DecryptAndDeGzip(io.MultiWriter(file, h), r)
+	if err != nil {
+		return Checksum{}, fmt.Errorf("failed to decrypt and de-gzip data: %s: %w", remote, err)
+	}
+
+	// Make sure its on disk before replacing the old file
+	err = file.Sync()
+	if err != nil {
+		return Checksum{}, fmt.Errorf("failed to write output file: %w", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		return Checksum{}, fmt.Errorf("failed to write output file: %w", err)
+	}
+
+	sum := h.Sum()
+	if want != "" && !sum.Matches(want) {
+		return Checksum{}, self.quarantine(file.Name(), remote, want, sum)
+	}
+
+	// CreateTemp only allows the user to read it, make it like any other note
+	err = os.Chmod(file.Name(), 0664)
+	if err != nil {
+		return Checksum{}, fmt.Errorf("failed to write output file: %w", err)
+	}
+
+	err = renameInto(file.Name(), endPath)
+	if err != nil {
+		return Checksum{}, fmt.Errorf("failed to write output file: %w", err)
+	}
+
+	log.Printf("Downloaded -> decrypted -> decompressed: %s -> %s", remote, endPath)
+
+	return sum, nil
+}
+
+// DeleteFile will delete a object from the backend.
+func (self *SelfApp) DeleteFile(remote string) error {
+	return self.Backend.Delete(remote)
+}
+
+// DecryptAndDeGzip will decrypt, and decompress everything from src to dst.
+func (c S3Config) DecryptAndDeGzip(dst io.Writer, src io.Reader) error {
+	dec, err := c.decryptReader(src)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt data: %s", err)
+	}
+
+	zr, err := gzip.NewReader(dec)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	_, err = io.Copy(dst, zr)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GzipAndEncrypt will compress, and encrypt everything from src to dst.
+func (c S3Config) GzipAndEncrypt(dst io.Writer, src io.Reader) error {
+	enc, err := c.encryptWriter(dst)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt data: %s", err)
+	}
+
+	zw := gzip.NewWriter(enc)
+
+	_, err = io.Copy(zw, src)
+	if err != nil {
+		return err
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+
+	return enc.Close()
+}
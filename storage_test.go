@@ -0,0 +1,88 @@
+package gnotes
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingBackend fails every upload after reading some of it.
+type failingBackend struct {
+	*memBackend
+}
+
+func (f *failingBackend) Put(key string, r io.Reader) error {
+	_, err := io.CopyN(io.Discard, r, cryptChunkSize)
+	if err != nil {
+		return err
+	}
+
+	return errors.New("connection reset")
+}
+
+func TestUploadFileStreamed(t *testing.T) {
+	backend := newMemBackend()
+	app := newTestApp(t, backend)
+
+	// Random data does not compress, so its still more then one chunk
+	data := make([]byte, 3*cryptChunkSize+123)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	local := filepath.Join(t.TempDir(), "attachment")
+	require.NoError(t, os.WriteFile(local, data, 0664))
+
+	sum, err := app.uploadFile(local, "test-user/attachment")
+	require.NoError(t, err)
+	assert.True(t, sum.Matches(Sum(data).String()))
+	assert.Greater(t, len(backend.objects["test-user/attachment"]), 3*cryptChunkSize)
+
+	out := filepath.Join(t.TempDir(), "out")
+	got, err := app.downloadFile("test-user/attachment", out)
+	require.NoError(t, err)
+	assert.Equal(t, sum, got)
+
+	b, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, data, b)
+}
+
+func TestUploadFileFailed(t *testing.T) {
+	app := newTestApp(t, &failingBackend{memBackend: newMemBackend()})
+
+	data := make([]byte, 4*cryptChunkSize)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	local := filepath.Join(t.TempDir(), "attachment")
+	require.NoError(t, os.WriteFile(local, data, 0664))
+
+	before := runtime.NumGoroutine()
+
+	done := make(chan error)
+	go func() {
+		_, err := app.uploadFile(local, "test-user/attachment")
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+		assert.ErrorContains(t, err, "connection reset")
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload did not return")
+	}
+
+	// The encrypt goroutine must not be left blocked on the pipe
+	for i := 0; runtime.NumGoroutine() > before && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+}
@@ -0,0 +1,296 @@
+//
+//  sync.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package gnotes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultSyncInterval is the seconds between syncs in watch mode, if not set
+// in the config file.
+const defaultSyncInterval = 30
+
+// SyncResult is the result of SyncRemote, it is applied to the notes with
+// ApplySync.
+type SyncResult struct {
+	// Changed is true if the notes changed.
+	Changed bool
+
+	// notes is the new index, or nil if it was not replaced.
+	notes *NoteBook
+
+	// conflicts are the downloaded notes that could not be merged.
+	conflicts []*noteConflict
+}
+
+// Sync does one full sync: uploads any cached notes that were changed (like
+// by another editor), uploads the index if needed, then gets any changes from
+// other devices. Returns true if the notes changed.
+func (self *SelfApp) Sync() (bool, error) {
+	r, err := self.SyncRemote()
+
+	applyErr := self.ApplySync(r)
+	if err == nil {
+		err = applyErr
+	}
+
+	return r.Changed, err
+}
+
+// SyncRemote does the backend part of Sync, so it can be run in the
+// background. The notes are not replaced, the new index is returned instead,
+// and must be applied with ApplySync. Always returns a result, even with a
+// error.
+func (self *SelfApp) SyncRemote() (*SyncResult, error) {
+	r := &SyncResult{}
+
+	err := self.FlushQueue()
+	if err != nil {
+		log.Printf("Failed to retry pending operations: %s", err)
+	}
+
+	self.checkLease()
+
+	if !self.ReadOnly {
+		r.Changed, err = self.pushNotes()
+		if err != nil {
+			return r, err
+		}
+	}
+
+	if self.IndexNeedsUpdating && !self.ReadOnly {
+		// Will merge any remote changes too
+		r.notes, err = self.saveIndexFile()
+		if err != nil {
+			return r, err
+		}
+		r.Changed = true
+	} else {
+		r.notes, err = self.fetchIndex()
+		if err != nil {
+			return r, err
+		}
+		r.Changed = r.Changed || r.notes != nil
+	}
+
+	if !r.Changed {
+		return r, nil
+	}
+
+	nb := r.notes
+	if nb == nil {
+		nb = self.Notes
+	}
+
+	r.conflicts, err = self.refreshCachedNotes(nb)
+
+	return r, err
+}
+
+// ApplySync replaces the notes with the index from SyncRemote, and resolves
+// any conflicts it found.
+func (self *SelfApp) ApplySync(r *SyncResult) error {
+	if !r.Changed {
+		return nil
+	}
+
+	// Keep the selected book, its per device
+	selected := self.Notes.GetSelected().Name
+
+	if r.notes != nil {
+		*self.Notes = *r.notes
+	}
+
+	self.Notes.Sort()
+
+	for i, b := range self.Notes.Books {
+		if b.Name == selected {
+			self.Notes.SetSelected(i)
+			break
+		}
+	}
+
+	// These change the index, so only one at a time
+	return self.resolveConflicts(r.conflicts)
+}
+
+// pushNotes uploads all the cached notes that changed since they were last
+// uploaded.
+func (self *SelfApp) pushNotes() (bool, error) {
+	changed := false
+
+	for _, b := range self.Notes.Books {
+		for i, n := range b.Notes {
+			if n.IsAttachment || n.DeletedAt != 0 {
+				continue
+			}
+
+			noteFile := filepath.Join(self.Config.App.NoteDir, "notes", n.S3Path)
+
+			info, err := os.Stat(noteFile)
+			if err != nil || info.Size() == 0 {
+				// Not cached, or still being written
+				continue
+			}
+
+			sum, err := SumFile(noteFile)
+			if err != nil {
+				return changed, err
+			}
+			if sum.Matches(n.Hash) {
+				continue
+			}
+
+			log.Printf("Uploading changed note: %s", n.S3Path)
+
+			err = b.SaveNoteIndex(i)
+			if err != nil {
+				return changed, fmt.Errorf("failed to upload note: %w", err)
+			}
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
+
+// pullIndex downloads the remote index, if it changed since it was last
+// synced. Should only be called if there are no local changes to the index.
+func (self *SelfApp) pullIndex() (bool, error) {
+	notes, err := self.fetchIndex()
+	if err != nil || notes == nil {
+		return false, err
+	}
+
+	*self.Notes = *notes
+
+	return true, nil
+}
+
+// fetchIndex is the same as pullIndex, but the new index is returned instead
+// of replacing the notes. Returns nil if it did not change.
+func (self *SelfApp) fetchIndex() (*NoteBook, error) {
+	if self.indexPending() {
+		// Still offline
+		return nil, nil
+	}
+
+	remoteSha, err := self.downloadBytes(self.remotePath("index.json.sha256"))
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to check remote index: %w", err)
+	}
+
+	lastSum := self.readOnlyIndexSum
+	if !self.ReadOnly {
+		baseJson, err := os.ReadFile(self.baseIndexFile())
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read base index: %w", err)
+		}
+		lastSum = Sum(baseJson)
+	}
+
+	sha := strings.TrimSpace(string(remoteSha))
+	if lastSum.Matches(sha) {
+		return nil, nil
+	}
+
+	log.Printf("Remote index changed, downloading")
+
+	b, err := self.downloadBytes(self.remotePath("index.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download index: %w", err)
+	}
+	if !Sum(b).Matches(sha) {
+		// Keep the current index
+		return nil, self.quarantineBytes(b, self.remotePath("index.json"), sha)
+	}
+
+	notes, err := self.parseIndex(b)
+	if errors.Is(err, ErrIndexTooNew) {
+		// Can still be read, but not changed
+		self.setIndexTooNew(err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if self.ReadOnly {
+		// The local index belongs to the gnotes that has the lock, or is too
+		// new to be written
+		self.readOnlyIndexSum = Sum(b)
+	} else {
+		err = writeFileAtomic(self.indexFile(), b, 0664)
+		if err != nil {
+			return nil, err
+		}
+		err = writeFileAtomic(self.indexFile()+".sha256", []byte(Sum(b).String()), 0664)
+		if err != nil {
+			return nil, err
+		}
+		err = self.saveBaseIndex(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(notes.Books) == 0 {
+		notes.NewBook("Notes")
+	}
+
+	return notes, nil
+}
+
+// refreshCachedNotes downloads the notes in nb that changed remotely, but only
+// the ones that are already cached (or all of them with prefetch). The notes
+// that could not be merged are returned, see resolveConflicts.
+func (self *SelfApp) refreshCachedNotes(nb *NoteBook) ([]*noteConflict, error) {
+	if self.Config.App.Prefetch {
+		return self.prefetchNotes(nb, self.Config.App.PrefetchWorkers)
+	}
+
+	var conflicts []*noteConflict
+
+	for _, b := range nb.Books {
+		for _, n := range b.Notes {
+			if n.IsAttachment || n.DeletedAt != 0 {
+				continue
+			}
+
+			_, err := os.Stat(filepath.Join(self.Config.App.NoteDir, "notes", n.S3Path))
+			if err != nil {
+				continue
+			}
+
+			conflict, err := n.download(self.Config.App.NoteDir)
+			if errors.Is(err, ErrChecksumMismatch) {
+				// The cached note is kept, see Quarantined
+				log.Printf("%s", err)
+				continue
+			}
+			if err != nil {
+				return conflicts, err
+			}
+			if conflict != nil {
+				conflicts = append(conflicts, conflict)
+			}
+		}
+	}
+
+	return conflicts, nil
+}
@@ -0,0 +1,56 @@
+package gnotes
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSync(t *testing.T) {
+	backend := newMemBackend()
+
+	laptop := newTestApp(t, backend)
+	n := addNote(t, laptop, "hello\n")
+	assert.False(t, laptop.IndexNeedsUpdating)
+
+	desktop := openTestApp(t, backend)
+	readNote(t, desktop, desktop.Notes.Books[0].Notes[0])
+
+	// Nothing changed
+	changed, err := desktop.Sync()
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	// The note is edited outside of gnotes on the laptop, and synced
+	self = laptop
+	require.NoError(t, os.WriteFile(notePath(laptop, n), []byte("hello from laptop\n"), 0664))
+	changed, err = laptop.Sync()
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	// Then the desktop gets the change
+	self = desktop
+	changed, err = desktop.Sync()
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	b, err := os.ReadFile(notePath(desktop, n))
+	require.NoError(t, err)
+	assert.Equal(t, "hello from laptop\n", string(b))
+	assert.Equal(t, laptop.Notes.Books[0].Notes[0].Hash, desktop.Notes.Books[0].Notes[0].Hash)
+
+	// A new book from the desktop shows up on the laptop
+	desktop.Notes.NewBook("Work")
+	desktop.IndexNeedsUpdating = true
+	_, err = desktop.Sync()
+	require.NoError(t, err)
+
+	self = laptop
+	changed, err = laptop.Sync()
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Len(t, laptop.Notes.Books, 2)
+	assert.Equal(t, "Notes", laptop.Notes.GetSelected().Name)
+}
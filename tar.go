@@ -15,15 +15,6 @@ import (
 	"strings"
 )
 
-func gzipCompressFile(file string) ([]byte, error) {
-	b, err := os.ReadFile(file)
-	if err != nil {
-		return []byte{}, err
-	}
-
-	return gzipCompress(b), nil
-}
-
 func gzipCompress(in []byte) []byte {
 	comp := bytes.NewBuffer(nil)
 	w := gzip.NewWriter(comp)
@@ -0,0 +1,236 @@
+//
+//  tmp.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package gnotes
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// staleSuffixes are the intermediate files older versions of gnotes left next
+// to the cached notes.
+var staleSuffixes = []string{".enc", ".part"}
+
+// staleTmpAge is how old a file in the tmp dir must be to be removed.
+const staleTmpAge = time.Hour
+
+// tmpDir returns the private dir for all intermediate files, only the user can
+// read it.
+func (self *SelfApp) tmpDir() (string, error) {
+	dir := filepath.Join(self.Config.App.NoteDir, "tmp")
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", fmt.Errorf("failed to create tmp dir: %w", err)
+	}
+
+	return dir, nil
+}
+
+// createTemp creates a new tmp file in the private tmp dir. The caller must
+// remove it.
+func (self *SelfApp) createTemp() (*os.File, error) {
+	dir, err := self.tmpDir()
+	if err != nil {
+		return nil, err
+	}
+
+	return os.CreateTemp(dir, "gnotes-")
+}
+
+// renameInto will move a tmp file to dst. If dst is on another filesystem
+// (like downloading a attachment to the current dir), it is copied next to dst
+// first, so dst is still replaced atomically.
+func renameInto(tmp, dst string) error {
+	err := os.Rename(tmp, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(dst), ".gnotes-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	// Keep the same mode as tmp
+	if err = out.Chmod(info.Mode().Perm()); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err = out.Close(); err != nil {
+		return err
+	}
+
+	err = os.Rename(out.Name(), dst)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(tmp)
+}
+
+// writeFileAtomic writes data to a tmp file next to path, syncs it to disk,
+// then renames it over path. So path always has either the old, or the new
+// contents, even after a crash. The tmp file ends with ".part", so its swept
+// if its left over.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	// Make sure the rename is on disk too
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return nil
+	}
+	defer dir.Close()
+
+	dir.Sync()
+
+	return nil
+}
+
+// cleanTmpDir removes any files left in the private tmp dir, like from a
+// crash. Only files older then staleTmpAge are removed, incase another gnotes
+// is still using them.
+func (self *SelfApp) cleanTmpDir() error {
+	dir := filepath.Join(self.Config.App.NoteDir, "tmp")
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to clean tmp dir: %w", err)
+	}
+
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < staleTmpAge {
+			continue
+		}
+
+		log.Printf("Removing stale tmp file: %s", e.Name())
+
+		err = os.RemoveAll(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to clean tmp dir: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// sweepStaleFiles removes any leftover intermediate files (like "content.enc")
+// from the notes cache. Files that are tracked by the index are never removed,
+// incase a attachment is named like that.
+func (self *SelfApp) sweepStaleFiles() error {
+	notesDir := filepath.Join(self.Config.App.NoteDir, "notes")
+
+	tracked := map[string]bool{}
+	for _, b := range self.Notes.Books {
+		for _, n := range b.Notes {
+			tracked[filepath.Join(notesDir, n.S3Path)] = true
+		}
+	}
+
+	removed := 0
+
+	err := filepath.WalkDir(notesDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || tracked[path] {
+			return nil
+		}
+
+		for _, suffix := range staleSuffixes {
+			if strings.HasSuffix(path, suffix) {
+				err := os.Remove(path)
+				if err != nil {
+					return err
+				}
+				removed++
+				break
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to sweep stale files: %w", err)
+	}
+
+	if removed > 0 {
+		log.Printf("Removed %d stale intermediate files", removed)
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package gnotes
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanTmpDir(t *testing.T) {
+	app := newTestApp(t, newMemBackend())
+
+	dir, err := app.tmpDir()
+	require.NoError(t, err)
+
+	info, err := os.Stat(dir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	// Left from a crash, and one that another gnotes is still using
+	old := filepath.Join(dir, "gnotes-old")
+	current := filepath.Join(dir, "gnotes-current")
+	require.NoError(t, os.WriteFile(old, []byte("old"), 0600))
+	require.NoError(t, os.WriteFile(current, []byte("current"), 0600))
+
+	stale := time.Now().Add(-staleTmpAge - time.Minute)
+	require.NoError(t, os.Chtimes(old, stale, stale))
+
+	require.NoError(t, app.cleanTmpDir())
+
+	assert.NoFileExists(t, old)
+	assert.FileExists(t, current)
+}
+
+func TestSweepStaleFiles(t *testing.T) {
+	app := newTestApp(t, newMemBackend())
+	n := addNote(t, app, "hello\n")
+
+	// A attachment that happens to be named like a intermediate file
+	book := app.Notes.GetSelected()
+	tracked := &Note{S3Path: filepath.Join(filepath.Dir(n.S3Path), "backup.enc")}
+	book.Notes = append(book.Notes, tracked)
+	require.NoError(t, os.WriteFile(notePath(app, tracked), []byte("attachment"), 0664))
+
+	stale := []string{notePath(app, n) + ".enc", notePath(app, n) + ".part"}
+	for _, path := range stale {
+		require.NoError(t, os.WriteFile(path, []byte("stale"), 0664))
+	}
+
+	require.NoError(t, app.sweepStaleFiles())
+
+	for _, path := range stale {
+		assert.NoFileExists(t, path)
+	}
+	assert.FileExists(t, notePath(app, n))
+	assert.FileExists(t, notePath(app, tracked))
+}
+
+func TestDownloadFileMode(t *testing.T) {
+	backend := newMemBackend()
+	app, other := testSync(t, backend, "hello\n")
+
+	// The download is created in the private tmp dir, but the note should not
+	// stay only readable by the user
+	info, err := os.Stat(notePath(other, other.Notes.Books[0].Notes[0]))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0664), info.Mode().Perm())
+
+	self = app
+	out := filepath.Join(t.TempDir(), "note.txt")
+	require.NoError(t, app.DownloadFileFrom(app.remotePath(app.Notes.Books[0].Notes[0].S3Path), out))
+
+	info, err = os.Stat(out)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0664), info.Mode().Perm())
+}
@@ -0,0 +1,212 @@
+//
+//  trash.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package gnotes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TrashBookName is the name of the book that deleted notes are moved to. No
+// other book can have it.
+const TrashBookName = "Trash"
+
+// defaultTrashRetention is how many days notes are kept in the trash, if not
+// set in the config file.
+const defaultTrashRetention = 30
+
+var ErrNotInTrash = errors.New("note is not in the trash")
+
+// IsTrash returns true if this is the trash book.
+func (b *Book) IsTrash() bool {
+	return b.Trash
+}
+
+// TrashBook returns the trash book, or nil if there is none.
+func (nb *NoteBook) TrashBook() *Book {
+	for _, b := range nb.Books {
+		if b.IsTrash() {
+			return b
+		}
+	}
+
+	return nil
+}
+
+// trashBook returns the trash book, creating it if needed.
+func (nb *NoteBook) trashBook() *Book {
+	trash := nb.TrashBook()
+	if trash == nil {
+		trash = &Book{
+			Name:  TrashBookName,
+			Notes: []*Note{},
+			Trash: true,
+		}
+		nb.Books = append(nb.Books, trash)
+	}
+
+	return trash
+}
+
+// DeleteNote will move a specific note to the trash. Notes already in the
+// trash, or that were never uploaded, are deleted forever.
+func (b *Book) DeleteNote(noteIndex int) error {
+	err := self.checkWritable()
+	if err != nil {
+		return err
+	}
+
+	n := b.Notes[noteIndex]
+
+	if b.IsTrash() || n.Hash == "" {
+		return b.purgeNote(noteIndex)
+	}
+
+	log.Printf("Moving note to trash: %s", n.S3Path)
+
+	// Remove the local cache if it was changed since the last save, since it
+	// may be empty (like when the note was deleted by removing all the text).
+	// The last saved version is downloaded again if its restored. Otherwise
+	// its kept, since the upload may still be queued (like when offline).
+	noteFile := filepath.Join(self.Config.App.NoteDir, "notes", n.S3Path)
+
+	current, err := SumFile(noteFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete note: %w", err)
+	}
+	if err == nil && !current.Matches(n.Hash) {
+		err = os.Remove(noteFile)
+		if err != nil {
+			return fmt.Errorf("failed to delete note: %w", err)
+		}
+	}
+
+	b.Notes = append(b.Notes[:noteIndex], b.Notes[noteIndex+1:]...)
+	b.Changed(-1)
+
+	n.DeletedAt = time.Now().Unix()
+	n.OriginalBook = b.Name
+	n.Changed()
+
+	trash := self.Notes.trashBook()
+	trash.Notes = append(trash.Notes, n)
+	trash.Changed(-1)
+
+	self.IndexNeedsUpdating = true
+
+	return nil
+}
+
+// RestoreNote moves a note from the trash back to the book it was deleted
+// from. The book is created again if it was deleted too.
+func (nb *NoteBook) RestoreNote(trashIndex int) error {
+	err := self.checkWritable()
+	if err != nil {
+		return err
+	}
+
+	trash := nb.TrashBook()
+	if trash == nil || trashIndex < 0 || trashIndex >= len(trash.Notes) {
+		return ErrNotInTrash
+	}
+
+	n := trash.Notes[trashIndex]
+
+	name := n.OriginalBook
+	if name == "" || name == TrashBookName {
+		name = "Notes"
+	}
+
+	var book *Book
+	for _, b := range nb.Books {
+		if b.Name == name {
+			book = b
+		}
+	}
+	if book == nil {
+		book = &Book{Name: name, Notes: []*Note{}}
+		nb.Books = append(nb.Books, book)
+	}
+
+	log.Printf("Restoring note from trash to %s: %s", name, n.S3Path)
+
+	trash.Notes = append(trash.Notes[:trashIndex], trash.Notes[trashIndex+1:]...)
+	trash.Changed(-1)
+
+	n.DeletedAt = 0
+	n.OriginalBook = ""
+	n.Changed()
+
+	book.Notes = append(book.Notes, n)
+	book.Changed(-1)
+
+	self.IndexNeedsUpdating = true
+
+	return nil
+}
+
+// EmptyTrash deletes all the notes in the trash forever.
+func (nb *NoteBook) EmptyTrash() error {
+	err := self.checkWritable()
+	if err != nil {
+		return err
+	}
+
+	trash := nb.TrashBook()
+	if trash == nil {
+		return nil
+	}
+
+	for len(trash.Notes) > 0 {
+		err := trash.purgeNote(0)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PurgeTrash deletes the notes that were in the trash for longer then
+// trash_retention days. Returns the number of notes deleted.
+func (self *SelfApp) PurgeTrash() (int, error) {
+	trash := self.Notes.TrashBook()
+	if trash == nil || self.Config.App.TrashRetention <= 0 || self.ReadOnly {
+		return 0, nil
+	}
+
+	minDeleted := time.Now().AddDate(0, 0, -self.Config.App.TrashRetention).Unix()
+
+	purged := 0
+	for i := 0; i < len(trash.Notes); {
+		if trash.Notes[i].DeletedAt >= minDeleted {
+			i++
+			continue
+		}
+
+		err := trash.purgeNote(i)
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+
+	if purged > 0 {
+		log.Printf("Purged %d notes from the trash", purged)
+	}
+
+	return purged, nil
+}
@@ -0,0 +1,88 @@
+package gnotes
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrash(t *testing.T) {
+	backend := newMemBackend()
+
+	app := newTestApp(t, backend)
+	app.Config.App.TrashRetention = 30
+
+	require.NoError(t, app.Notes.NewBook("Work"))
+	book := app.Notes.GetSelected()
+	n := addNote(t, app, "one\n")
+	addNote(t, app, "two\n")
+
+	// Like deleting all the text in the editor
+	require.NoError(t, os.WriteFile(notePath(app, n), []byte{}, 0664))
+	require.NoError(t, book.DeleteNote(0))
+
+	trash := app.Notes.TrashBook()
+	require.NotNil(t, trash)
+	require.Len(t, trash.Notes, 1)
+	assert.Equal(t, "Work", trash.Notes[0].OriginalBook)
+	assert.NotZero(t, trash.Notes[0].DeletedAt)
+	assert.Len(t, book.Notes, 1)
+
+	// Deleting the book moves the rest of its notes to the trash
+	require.NoError(t, app.Notes.DeleteBook(1))
+	assert.Len(t, trash.Notes, 2)
+	assert.Len(t, app.Notes.Books, 2)
+
+	// Restoring downloads the last uploaded version, and creates the book again
+	require.NoError(t, app.Notes.RestoreNote(0))
+	assert.Zero(t, n.DeletedAt)
+	assert.Equal(t, "one\n", readNote(t, app, n))
+	assert.Equal(t, "Work", app.Notes.Books[2].Name)
+
+	assert.ErrorIs(t, app.Notes.RestoreNote(5), ErrNotInTrash)
+
+	// Only notes older then the retention are purged
+	old := trash.Notes[0]
+	old.DeletedAt = time.Now().AddDate(0, 0, -31).Unix()
+	purged, err := app.PurgeTrash()
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	assert.Empty(t, trash.Notes)
+
+	_, err = backend.Stat(app.remotePath(old.S3Path))
+	assert.Error(t, err)
+	_, err = backend.Stat(app.remotePath(n.S3Path))
+	assert.NoError(t, err)
+}
+
+func TestTrashOffline(t *testing.T) {
+	queueRetryDelay = time.Millisecond
+
+	backend := &offlineBackend{memBackend: newMemBackend(), offline: true}
+
+	app := newTestApp(t, backend)
+	book := app.Notes.GetSelected()
+	require.NoError(t, book.NewNote(app.Config.App.NoteDir, nil))
+	n := book.Notes[0]
+
+	// Saved while offline, so the upload is queued
+	require.NoError(t, os.WriteFile(notePath(app, n), []byte("written on a plane\n"), 0664))
+	require.NoError(t, book.SaveNoteIndex(0))
+	require.True(t, app.putPending(app.remotePath(n.S3Path)))
+
+	require.NoError(t, book.DeleteNote(0))
+	require.NoError(t, app.SaveIndexFile())
+
+	// The queued upload is not dropped
+	backend.offline = false
+	require.NoError(t, app.FlushQueue())
+
+	_, err := backend.Stat(app.remotePath(n.S3Path))
+	require.NoError(t, err)
+
+	require.NoError(t, app.Notes.RestoreNote(0))
+	assert.Equal(t, "written on a plane\n", readNote(t, app, n))
+}
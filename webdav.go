@@ -0,0 +1,368 @@
+//
+//  webdav.go - https://github.com/WestleyR/gnotes
+//  gnotes - CLI based S3 syncing note app
+//
+// Source code: https://github.com/WestleyR/gnotes
+//
+// This software is licensed under a BSD 3-Clause Clear License.
+// Consult the LICENSE file that came with this software regarding
+// your rights to distribute this software.
+//
+
+package gnotes
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebDAVBackend stores all the objects on a WebDAV server, like Nextcloud or
+// ownCloud.
+type WebDAVBackend struct {
+	config WebDAVConfig
+	base   *url.URL
+	client *http.Client
+
+	// dirs is a cache of collections that are known to exist, so we dont need
+	// to MKCOL them on every upload.
+	dirs sync.Map
+}
+
+func NewWebDAVBackend(c WebDAVConfig) (*WebDAVBackend, error) {
+	if c.URL == "" {
+		return nil, fmt.Errorf("webdav: url cannot be empty")
+	}
+
+	base, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("webdav: invalid url: %w", err)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/") + "/"
+
+	return &WebDAVBackend{
+		config: c,
+		base:   base,
+		client: &http.Client{Transport: timeoutTransport(c.Timeout)},
+	}, nil
+}
+
+// url returns the full url for a key.
+func (b *WebDAVBackend) url(key string) string {
+	u := *b.base
+	u.Path = path.Join(b.base.Path, key)
+	if strings.HasSuffix(key, "/") {
+		u.Path += "/"
+	}
+
+	return u.String()
+}
+
+func (b *WebDAVBackend) do(method, key string, body io.Reader, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(method, b.url(key), body)
+	if err != nil {
+		return nil, err
+	}
+
+	// NewRequest only knows the size of some readers
+	if s, ok := body.(interface{ Size() int64 }); ok {
+		req.ContentLength = s.Size()
+	}
+
+	if b.config.Username != "" {
+		req.SetBasicAuth(b.config.Username, b.config.Password)
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("webdav: %s %s: %w", method, key, err)
+	}
+
+	return resp, nil
+}
+
+// mkdirAll will create all the parent collections for key.
+func (b *WebDAVBackend) mkdirAll(key string) error {
+	// Start with the base collection, it may not exist yet either
+	dirs := []string{""}
+
+	dir := ""
+	for _, p := range strings.Split(path.Dir(key), "/") {
+		if p == "" || p == "." {
+			continue
+		}
+		dir += p + "/"
+		dirs = append(dirs, dir)
+	}
+
+	for _, dir := range dirs {
+		if _, ok := b.dirs.Load(dir); ok {
+			continue
+		}
+
+		resp, err := b.do("MKCOL", dir, nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		// 405 means it already exists
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+			return fmt.Errorf("webdav: failed to create collection: %s: %s", dir, resp.Status)
+		}
+
+		b.dirs.Store(dir, true)
+	}
+
+	return nil
+}
+
+// createTemp creates a tmp file in the TmpDir from the config, or the system
+// tmp dir if not set.
+func (b *WebDAVBackend) createTemp() (*os.File, error) {
+	if b.config.TmpDir != "" {
+		err := os.MkdirAll(b.config.TmpDir, 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return os.CreateTemp(b.config.TmpDir, "gnotes-webdav-")
+}
+
+func (b *WebDAVBackend) Put(key string, r io.Reader) error {
+	err := b.mkdirAll(key)
+	if err != nil {
+		return err
+	}
+
+	// Some servers (like nginx) do not support chunked uploads, so the size
+	// must be known first. Buffer it to a tmp file if its not, the data is
+	// already encrypted.
+	if _, ok := r.(interface{ Size() int64 }); !ok {
+		tmp, err := b.createTemp()
+		if err != nil {
+			return fmt.Errorf("failed to create tmp file: %w", err)
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		size, err := io.Copy(tmp, r)
+		if err != nil {
+			return fmt.Errorf("failed to buffer upload: %w", err)
+		}
+
+		r = io.NewSectionReader(tmp, 0, size)
+	}
+
+	resp, err := b.do(http.MethodPut, key, r, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed to upload data to %s: %s", key, resp.Status)
+	}
+
+	return nil
+}
+
+func (b *WebDAVBackend) Get(key string) (io.ReadCloser, error) {
+	resp, err := b.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+	case resp.StatusCode != http.StatusOK:
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download file: %s: %s", key, resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+func (b *WebDAVBackend) Delete(key string) error {
+	resp, err := b.do(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed to delete object: %s: %s", key, resp.Status)
+	}
+
+	return nil
+}
+
+func (b *WebDAVBackend) List(prefix string) ([]ObjectInfo, error) {
+	// Start from the collection that contains the prefix, and walk down from
+	// there. Not all servers allow "Depth: infinity", so only use "Depth: 1".
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i != -1 {
+		dir = prefix[:i+1]
+	}
+
+	var objects []ObjectInfo
+
+	todo := []string{dir}
+	for len(todo) > 0 {
+		dir, todo = todo[0], todo[1:]
+
+		entries, err := b.propfind(dir, "1")
+		if err != nil {
+			if dir != "" && errors.Is(err, ErrObjectNotFound) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to list objects: %s: %w", prefix, err)
+		}
+
+		for _, e := range entries {
+			if e.Key == dir || e.Key+"/" == dir {
+				continue
+			}
+
+			if e.isDir {
+				if strings.HasPrefix(e.Key, prefix) || strings.HasPrefix(prefix, e.Key) {
+					todo = append(todo, e.Key)
+				}
+				continue
+			}
+
+			if strings.HasPrefix(e.Key, prefix) {
+				objects = append(objects, e.ObjectInfo)
+			}
+		}
+	}
+
+	return objects, nil
+}
+
+func (b *WebDAVBackend) Stat(key string) (*ObjectInfo, error) {
+	entries, err := b.propfind(key, "0")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 || entries[0].isDir {
+		return nil, fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+	}
+
+	return &entries[0].ObjectInfo, nil
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8" ?>
+<d:propfind xmlns:d="DAV:">
+  <d:prop>
+    <d:resourcetype/>
+    <d:getcontentlength/>
+    <d:getlastmodified/>
+  </d:prop>
+</d:propfind>`
+
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ContentLength string `xml:"getcontentlength"`
+				LastModified  string `xml:"getlastmodified"`
+			} `xml:"prop"`
+			Status string `xml:"status"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+type davEntry struct {
+	ObjectInfo
+	isDir bool
+}
+
+func (b *WebDAVBackend) propfind(key, depth string) ([]davEntry, error) {
+	resp, err := b.do("PROPFIND", key, bytes.NewBufferString(propfindBody), map[string]string{
+		"Depth":        depth,
+		"Content-Type": "application/xml",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+	case resp.StatusCode != http.StatusMultiStatus:
+		return nil, fmt.Errorf("webdav: PROPFIND %s: %s", key, resp.Status)
+	}
+
+	ms := davMultistatus{}
+	err = xml.NewDecoder(resp.Body).Decode(&ms)
+	if err != nil {
+		return nil, fmt.Errorf("webdav: failed to parse PROPFIND response: %w", err)
+	}
+
+	var entries []davEntry
+
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, fmt.Errorf("webdav: invalid href: %s: %w", r.Href, err)
+		}
+
+		// Make the href relative to the base url to get the key
+		if !strings.HasPrefix(href.Path+"/", b.base.Path) {
+			continue
+		}
+		e := davEntry{}
+		e.Key = strings.TrimPrefix(href.Path, b.base.Path)
+
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+
+			if ps.Prop.ResourceType.Collection != nil {
+				e.isDir = true
+			}
+			if ps.Prop.ContentLength != "" {
+				e.Size, _ = strconv.ParseInt(ps.Prop.ContentLength, 10, 64)
+			}
+			if ps.Prop.LastModified != "" {
+				e.Modified, _ = time.Parse(time.RFC1123, ps.Prop.LastModified)
+			}
+		}
+
+		if e.isDir && e.Key != "" && !strings.HasSuffix(e.Key, "/") {
+			e.Key += "/"
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
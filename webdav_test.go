@@ -0,0 +1,130 @@
+package gnotes
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+// newWebDAVServer starts a in-process WebDAV server, served under /dav/ and
+// requiring basic auth.
+func newWebDAVServer(t *testing.T) *httptest.Server {
+	dav := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "user" || pass != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// Like nginx, chunked uploads are not supported
+		if r.Method == http.MethodPut && r.ContentLength < 0 {
+			w.WriteHeader(http.StatusLengthRequired)
+			return
+		}
+		dav.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestWebDAVBackend(t *testing.T) {
+	srv := newWebDAVServer(t)
+	tmpDir := filepath.Join(t.TempDir(), "tmp")
+
+	b, err := NewWebDAVBackend(WebDAVConfig{
+		URL:      srv.URL + "/dav/gnotes",
+		Username: "user",
+		Password: "pass",
+		Timeout:  30,
+		TmpDir:   tmpDir,
+	})
+	require.NoError(t, err)
+
+	key := "user/notes/My Notes/uuid-1/content"
+
+	require.NoError(t, b.Put(key, strings.NewReader("foo bar")))
+	require.NoError(t, b.Put("user/notes/index.json", strings.NewReader("{}")))
+
+	// The size is not known for streamed uploads
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("baz"))
+		pw.Close()
+	}()
+	require.NoError(t, b.Put("user/notes/Other/uuid-2/content", pr))
+
+	// Buffered in the tmp dir, and removed after
+	stat, err := os.Stat(tmpDir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), stat.Mode().Perm())
+	files, err := os.ReadDir(tmpDir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	r, err := b.Get(key)
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "foo bar", string(data))
+
+	info, err := b.Stat(key)
+	require.NoError(t, err)
+	assert.Equal(t, key, info.Key)
+	assert.Equal(t, int64(7), info.Size)
+	assert.False(t, info.Modified.IsZero())
+
+	objects, err := b.List("user/notes/")
+	require.NoError(t, err)
+	assert.Len(t, objects, 3)
+
+	objects, err = b.List("user/notes/My")
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+	assert.Equal(t, key, objects[0].Key)
+
+	require.NoError(t, b.Delete(key))
+
+	_, err = b.Get(key)
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+	_, err = b.Stat(key)
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+	assert.NoError(t, b.Delete(key))
+
+	objects, err = b.List("not/found/")
+	require.NoError(t, err)
+	assert.Empty(t, objects)
+
+	// Wrong password
+	bad, err := NewWebDAVBackend(WebDAVConfig{URL: srv.URL + "/dav/gnotes", Username: "user", Password: "foo"})
+	require.NoError(t, err)
+	_, err = bad.Get("user/notes/index.json")
+	assert.Error(t, err)
+}
+
+func TestWebDAVBackendSync(t *testing.T) {
+	srv := newWebDAVServer(t)
+
+	b, err := NewWebDAVBackend(WebDAVConfig{URL: srv.URL + "/dav/", Username: "user", Password: "pass"})
+	require.NoError(t, err)
+
+	testSync(t, b, "webdav note\n")
+
+	// Same object layout as S3
+	_, err = b.Stat(filepath.Join("test-user", "notes", "index.json"))
+	require.NoError(t, err)
+}